@@ -0,0 +1,105 @@
+package macaroon
+
+import (
+	"fmt"
+)
+
+// Algorithm identifies the suite of cryptographic functions used
+// to compute a macaroon's signatures. All suites produce 256-bit
+// signatures and encrypt the root keys of third party caveats
+// with NaCl secretbox.
+//
+// The algorithm is chosen when a macaroon is created and is
+// recorded when the macaroon is marshaled. The discharge
+// macaroons for a macaroon's third party caveats must use
+// the same algorithm as the macaroon. As the algorithm is
+// taken from the macaroon, services that only mint macaroons
+// with one algorithm should require it when verifying; see
+// VerifyOptions.RequireAlgorithm.
+type Algorithm uint8
+
+const (
+	// HMACSHA256 specifies HMAC-SHA256, as used by
+	// libmacaroons. This is the default.
+	HMACSHA256 Algorithm = iota
+
+	// HMACSHA512 specifies HMAC-SHA512 truncated
+	// to 256 bits.
+	HMACSHA512
+
+	// BLAKE2b specifies keyed BLAKE2b with a 256-bit digest.
+	BLAKE2b
+
+	numAlgorithms = iota
+)
+
+var algorithmNames = [numAlgorithms]string{
+	HMACSHA256: "hmac-sha256",
+	HMACSHA512: "hmac-sha512",
+	BLAKE2b:    "blake2b",
+}
+
+// String returns the name of the algorithm. This is the
+// name used to record the algorithm in marshaled macaroons.
+func (alg Algorithm) String() string {
+	if !alg.valid() {
+		return fmt.Sprintf("Algorithm(%d)", uint8(alg))
+	}
+	return algorithmNames[alg]
+}
+
+// MinRootKeyLen returns the minimum length in bytes of the
+// root keys that can be used to mint macaroons and add third
+// party caveats with the algorithm. All the algorithms require
+// root keys of at least 256 bits. Existing macaroons with shorter
+// root keys can still be verified; see also NewWithLegacyRootKey.
+func (alg Algorithm) MinRootKeyLen() int {
+	return keyLen
+}
+
+func (alg Algorithm) valid() bool {
+	return int(alg) < numAlgorithms
+}
+
+// parseAlgorithm returns the algorithm with the given name.
+func parseAlgorithm(name string) (Algorithm, error) {
+	for alg, algName := range algorithmNames {
+		if name == algName {
+			return Algorithm(alg), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown algorithm %q", name)
+}
+
+// checkRootKey returns an error if rootKey cannot
+// be used with the algorithm.
+func (alg Algorithm) checkRootKey(rootKey []byte) error {
+	if !alg.valid() {
+		return fmt.Errorf("unknown algorithm %v", alg)
+	}
+	if len(rootKey) < alg.MinRootKeyLen() {
+		return &RootKeyLengthError{
+			Algorithm: alg,
+			Len:       len(rootKey),
+			Min:       alg.MinRootKeyLen(),
+		}
+	}
+	return nil
+}
+
+// RootKeyLengthError is returned when a root key is too
+// short to be used with a macaroon's algorithm.
+type RootKeyLengthError struct {
+	// Algorithm holds the algorithm.
+	Algorithm Algorithm
+
+	// Len holds the length of the root key.
+	Len int
+
+	// Min holds the minimum length of the root key.
+	Min int
+}
+
+func (e *RootKeyLengthError) Error() string {
+	return fmt.Sprintf("root key too short for %v (%d bytes; minimum %d)", e.Algorithm, e.Len, e.Min)
+}
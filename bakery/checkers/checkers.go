@@ -8,6 +8,7 @@ import (
 	"time"
 
 	"github.com/rogpeppe/macaroon/bakery"
+	"github.com/rogpeppe/macaroon/bakery/internal/timebefore"
 )
 
 func FirstParty(condition string) bakery.Caveat {
@@ -29,16 +30,12 @@ var Std = Map{
 
 func TimeBefore(t time.Time) bakery.Caveat {
 	return bakery.Caveat{
-		Condition: "time-before " + t.Format(time.RFC3339),
+		Condition: timebefore.Condition(t),
 	}
 }
 
 func timeBefore(cav string) error {
-	_, timeStr, err := ParseCaveat(cav)
-	if err != nil {
-		return err
-	}
-	t, err := time.Parse(time.RFC3339, timeStr)
+	t, err := timebefore.Parse(cav)
 	if err != nil {
 		return err
 	}
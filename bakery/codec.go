@@ -2,12 +2,12 @@ package bakery
 
 import (
 	"bytes"
-	"crypto/rand"
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
+	"io"
 
-	"code.google.com/p/go.crypto/nacl/box"
+	"golang.org/x/crypto/nacl/box"
 )
 
 type caveatIdRecord struct {
@@ -20,7 +20,7 @@ type caveatId struct {
 	ThirdPartyPublicKey []byte
 	FirstPartyPublicKey []byte
 	Nonce               []byte
-	Id                  string
+	Id                  []byte
 }
 
 // boxEncoder encodes caveat ids confidentially to a third-party service using
@@ -28,14 +28,17 @@ type caveatId struct {
 type boxEncoder struct {
 	locator PublicKeyLocator
 	key     *KeyPair
+	rand    io.Reader
 }
 
-// newBoxEncoder creates a new boxEncoder with the given public key pair and
-// third-party public key locator function.
-func newBoxEncoder(locator PublicKeyLocator, key *KeyPair) *boxEncoder {
+// newBoxEncoder creates a new boxEncoder with the given public key pair,
+// third-party public key locator function and source of randomness
+// for nonces.
+func newBoxEncoder(locator PublicKeyLocator, key *KeyPair, r io.Reader) *boxEncoder {
 	return &boxEncoder{
 		key:     key,
 		locator: locator,
+		rand:    r,
 	}
 }
 
@@ -60,7 +63,7 @@ func (enc *boxEncoder) encodeCaveatId(cav Caveat, rootKey []byte) (string, error
 
 func (enc *boxEncoder) newCaveatId(cav Caveat, rootKey []byte, thirdPartyPub *PublicKey) (*caveatId, error) {
 	var nonce [NonceLen]byte
-	if _, err := rand.Read(nonce[:]); err != nil {
+	if _, err := io.ReadFull(enc.rand, nonce[:]); err != nil {
 		return nil, fmt.Errorf("cannot generate random number for nonce: %v", err)
 	}
 	plain := caveatIdRecord{
@@ -76,7 +79,7 @@ func (enc *boxEncoder) newCaveatId(cav Caveat, rootKey []byte, thirdPartyPub *Pu
 		ThirdPartyPublicKey: thirdPartyPub[:],
 		FirstPartyPublicKey: enc.key.Public[:],
 		Nonce:               nonce[:],
-		Id:                  base64.StdEncoding.EncodeToString(sealed),
+		Id:                  sealed,
 	}, nil
 }
 
@@ -135,11 +138,7 @@ func (d *boxDecoder) encryptedCaveatId(id caveatId) ([]byte, error) {
 	}
 	copy(firstPartyPublicKey[:], id.FirstPartyPublicKey)
 
-	sealed, err := base64.StdEncoding.DecodeString(id.Id)
-	if err != nil {
-		return nil, fmt.Errorf("cannot base64-decode encrypted caveat id: %v", err)
-	}
-	out, ok := box.Open(nil, sealed, &nonce, (*[KeyLen]byte)(&firstPartyPublicKey), (*[KeyLen]byte)(&d.key.Private))
+	out, ok := box.Open(nil, id.Id, &nonce, (*[KeyLen]byte)(&firstPartyPublicKey), (*[KeyLen]byte)(&d.key.Private))
 	if !ok {
 		return nil, fmt.Errorf("decryption of public-key encrypted caveat id %#v failed", id)
 	}
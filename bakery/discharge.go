@@ -1,24 +1,29 @@
 package bakery
 
 import (
+	"crypto/sha256"
 	"fmt"
 
 	"gopkg.in/errgo.v1"
-	"gopkg.in/macaroon.v1"
+
+	"github.com/rogpeppe/macaroon"
 )
 
 // DischargeAll gathers discharge macaroons for all the third party caveats
 // in m (and any subsequent caveats required by those) using getDischarge to
-// acquire each discharge macaroon.
+// acquire each discharge macaroon. If getDischarge returns a discharge
+// macaroon that is identical to one already acquired, it is
+// not included again.
 func DischargeAll(
 	m *macaroon.Macaroon,
 	getDischarge func(firstPartyLocation string, cav macaroon.Caveat) (*macaroon.Macaroon, error),
 ) ([]*macaroon.Macaroon, error) {
 	var discharges []*macaroon.Macaroon
 	var need []macaroon.Caveat
+	seen := make(map[[sha256.Size]byte]bool)
 	addCaveats := func(m *macaroon.Macaroon) {
 		for _, cav := range m.Caveats() {
-			if cav.Location == "" {
+			if !cav.IsThirdParty() {
 				continue
 			}
 			need = append(need, cav)
@@ -33,6 +38,11 @@ func DischargeAll(
 		if err != nil {
 			return nil, errgo.NoteMask(err, fmt.Sprintf("cannot get discharge from %q", cav.Location), errgo.Any)
 		}
+		fp := dm.Fingerprint()
+		if seen[fp] {
+			continue
+		}
+		seen[fp] = true
 		discharges = append(discharges, dm)
 		addCaveats(dm)
 	}
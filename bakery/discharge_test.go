@@ -4,8 +4,8 @@ import (
 	"fmt"
 
 	gc "gopkg.in/check.v1"
-	"gopkg.in/macaroon.v1"
 
+	"github.com/rogpeppe/macaroon"
 	"github.com/rogpeppe/macaroon/bakery"
 )
 
@@ -18,7 +18,7 @@ func alwaysOK(string) error {
 }
 
 func (*DischargeSuite) TestDischargeAllNoDischarges(c *gc.C) {
-	rootKey := []byte("root key")
+	rootKey := []byte("a root key that is at least 32 bytes long")
 	m, err := macaroon.New(rootKey, "id0", "loc0")
 	c.Assert(err, gc.IsNil)
 	getDischarge := func(string, macaroon.Caveat) (*macaroon.Macaroon, error) {
@@ -34,7 +34,7 @@ func (*DischargeSuite) TestDischargeAllNoDischarges(c *gc.C) {
 }
 
 func (*DischargeSuite) TestDischargeAllManyDischarges(c *gc.C) {
-	rootKey := []byte("root key")
+	rootKey := []byte("a root key that is at least 32 bytes long")
 	m0, err := macaroon.New(rootKey, "id0", "location0")
 	c.Assert(err, gc.IsNil)
 	totalRequired := 40
@@ -45,7 +45,7 @@ func (*DischargeSuite) TestDischargeAllManyDischarges(c *gc.C) {
 				break
 			}
 			cid := fmt.Sprint("id", id)
-			err := m.AddThirdPartyCaveat([]byte("root key "+cid), cid, "somewhere")
+			err := m.AddThirdPartyCaveat([]byte("a third party root key for caveat "+cid), cid, "somewhere")
 			c.Assert(err, gc.IsNil)
 			id++
 			totalRequired--
@@ -54,7 +54,7 @@ func (*DischargeSuite) TestDischargeAllManyDischarges(c *gc.C) {
 	addCaveats(m0)
 	getDischarge := func(loc string, cav macaroon.Caveat) (*macaroon.Macaroon, error) {
 		c.Assert(loc, gc.Equals, "location0")
-		m, err := macaroon.New([]byte("root key "+cav.Id), cav.Id, "")
+		m, err := macaroon.New([]byte("a third party root key for caveat "+cav.Id), cav.Id, "")
 		c.Assert(err, gc.IsNil)
 		addCaveats(m)
 		return m, nil
@@ -70,3 +70,26 @@ func (*DischargeSuite) TestDischargeAllManyDischarges(c *gc.C) {
 	err = m0.Verify(rootKey, alwaysOK, ms)
 	c.Assert(err, gc.IsNil)
 }
+
+func (*DischargeSuite) TestDischargeAllDuplicateDischarges(c *gc.C) {
+	rootKey := []byte("a root key that is at least 32 bytes long")
+	m0, err := macaroon.New(rootKey, "id0", "location0")
+	c.Assert(err, gc.IsNil)
+	for i := 0; i < 3; i++ {
+		err := m0.AddThirdPartyCaveat([]byte("a shared root key of at least 32 bytes"), "id1", "somewhere")
+		c.Assert(err, gc.IsNil)
+	}
+	called := 0
+	getDischarge := func(loc string, cav macaroon.Caveat) (*macaroon.Macaroon, error) {
+		called++
+		return macaroon.New([]byte("a shared root key of at least 32 bytes"), cav.Id, "")
+	}
+	ms, err := bakery.DischargeAll(m0, getDischarge)
+	c.Assert(err, gc.IsNil)
+	c.Assert(called, gc.Equals, 3)
+	c.Assert(ms, gc.HasLen, 1)
+
+	ms[0].Bind(m0.Signature())
+	err = m0.Verify(rootKey, alwaysOK, ms)
+	c.Assert(err, gc.IsNil)
+}
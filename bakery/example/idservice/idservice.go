@@ -9,8 +9,8 @@ import (
 
 	"github.com/juju/utils/jsonhttp"
 	"gopkg.in/errgo.v1"
-	"gopkg.in/macaroon.v1"
 
+	"github.com/rogpeppe/macaroon"
 	"github.com/rogpeppe/macaroon/bakery"
 	"github.com/rogpeppe/macaroon/bakery/checkers"
 	"github.com/rogpeppe/macaroon/bakery/example/meeting"
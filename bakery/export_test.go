@@ -0,0 +1,48 @@
+package bakery
+
+import (
+	"time"
+)
+
+// SetMemStorageClock sets the function used by s
+// to find out the current time.
+func SetMemStorageClock(s *MemStorage, now func() time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.now = now
+}
+
+// MemStorageLen returns the number of items held
+// by s, including expired items.
+func MemStorageLen(s *MemStorage) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.values)
+}
+
+// SetFileStorageClock sets the function used by s
+// to find out the current time.
+func SetFileStorageClock(s *FileStorage, now func() time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.now = now
+}
+
+// FileStorageMinCompact holds the minimum number of records
+// in a FileStorage log before it is compacted automatically.
+const FileStorageMinCompact = fileStorageMinCompact
+
+// FileLockSupported reports whether a FileStorage
+// locks its directory on this system.
+const FileLockSupported = fileLockSupported
+
+// SetServiceClock sets the function used by svc
+// to find out the current time.
+func SetServiceClock(svc *Service, now func() time.Time) {
+	svc.now = now
+	if svc.rootKeys != nil {
+		svc.rootKeys.mu.Lock()
+		defer svc.rootKeys.mu.Unlock()
+		svc.rootKeys.now = now
+	}
+}
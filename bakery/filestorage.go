@@ -0,0 +1,393 @@
+package bakery
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	// fileStorageLog holds the name of the log file
+	// within a FileStorage directory.
+	fileStorageLog = "storage.log"
+
+	// fileStorageLock holds the name of the lock file
+	// within a FileStorage directory.
+	fileStorageLock = "storage.lock"
+
+	// fileStorageMinCompact holds the minimum number of
+	// records in the log before it will be compacted
+	// automatically.
+	fileStorageMinCompact = 1000
+)
+
+var errStorageClosed = errors.New("storage has been closed")
+
+// FileStorage is an implementation of Storage that keeps its items
+// in a log file in a directory, so that they survive restarts.
+// It implements BatchStorage, ExpiryStorage and Purger.
+//
+// Each change is appended to the log and flushed to disk before
+// the call returns. All items are also held in memory, so
+// reads do not touch the disk. The log is compacted when it
+// holds many more records than there are items, and when
+// Purge is called, by writing a new log and atomically renaming
+// it over the old one. If the process stops in the middle of
+// appending to the log, the incomplete record is discarded
+// when the storage is next opened. Any other records that
+// cannot be read are logged and skipped.
+//
+// Only one FileStorage may use a given directory at a time.
+// This is enforced with an exclusive lock on a lock file in
+// the directory, where the system supports it.
+type FileStorage struct {
+	dir string
+
+	// lock holds the lock file, which is locked
+	// until the storage is closed.
+	lock *os.File
+
+	// mu guards the fields following it.
+	mu sync.Mutex
+
+	// now returns the current time.
+	now func() time.Time
+
+	// file holds the log file, opened for appending.
+	// It is nil when the storage has been closed.
+	file *os.File
+
+	// size holds the size of the log file.
+	size int64
+
+	// nrecords holds the number of records in the log.
+	nrecords int
+
+	values map[string]memItem
+}
+
+// fileRecord holds a record in the log of a FileStorage.
+// The location and item are held as byte slices so that
+// they are encoded as base64 and survive intact even
+// when they are not valid UTF-8.
+type fileRecord struct {
+	Location []byte     `json:"loc"`
+	Item     []byte     `json:"item,omitempty"`
+	Expiry   *time.Time `json:"expiry,omitempty"`
+	Delete   bool       `json:"del,omitempty"`
+}
+
+// NewFileStorage returns a FileStorage that keeps its items
+// in the given directory, which is created if necessary.
+// Items stored by an earlier FileStorage using the same
+// directory are available. The storage should be closed
+// after use, so that the directory can be used by another
+// FileStorage.
+func NewFileStorage(dir string) (*FileStorage, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("cannot create storage directory: %v", err)
+	}
+	lock, err := lockFile(filepath.Join(dir, fileStorageLock))
+	if err != nil {
+		return nil, fmt.Errorf("cannot lock storage: %v", err)
+	}
+	s := &FileStorage{
+		dir:    dir,
+		lock:   lock,
+		now:    time.Now,
+		values: make(map[string]memItem),
+	}
+	file, err := os.OpenFile(s.logPath(), os.O_RDWR|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		lock.Close()
+		return nil, fmt.Errorf("cannot open storage: %v", err)
+	}
+	if err := s.replay(file); err != nil {
+		file.Close()
+		lock.Close()
+		return nil, fmt.Errorf("cannot read storage log: %v", err)
+	}
+	s.file = file
+	return s, nil
+}
+
+func (s *FileStorage) logPath() string {
+	return filepath.Join(s.dir, fileStorageLog)
+}
+
+// replay reads all the records from the given log file and
+// applies them. It truncates any incomplete record at the
+// end of the file. Records that cannot be parsed are logged
+// and skipped, so that one corrupt record does not lose the
+// rest of the log; they are removed when the log is next
+// compacted.
+func (s *FileStorage) replay(file *os.File) error {
+	r := bufio.NewReader(file)
+	for {
+		line, err := r.ReadBytes('\n')
+		if err == io.EOF {
+			if len(line) > 0 {
+				// The last record was not written
+				// completely, so discard it.
+				if err := file.Truncate(s.size); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		var rec fileRecord
+		if err := json.Unmarshal(line, &rec); err != nil {
+			log.Printf("warning: skipping bad record at offset %d in %s: %v", s.size, s.logPath(), err)
+		} else {
+			s.apply(&rec)
+		}
+		s.nrecords++
+		s.size += int64(len(line))
+	}
+}
+
+// apply applies the given record to s.values.
+func (s *FileStorage) apply(rec *fileRecord) {
+	if rec.Delete {
+		delete(s.values, string(rec.Location))
+		return
+	}
+	item := memItem{
+		item: string(rec.Item),
+	}
+	if rec.Expiry != nil {
+		item.expiry = *rec.Expiry
+	}
+	s.values[string(rec.Location)] = item
+}
+
+// append writes the given record to the log, flushes
+// it to disk and applies it. If the log needs compacting
+// and that fails, the error is logged rather than returned,
+// because the record has been written successfully.
+// Called with s.mu held.
+func (s *FileStorage) append(rec *fileRecord) error {
+	if s.file == nil {
+		return errStorageClosed
+	}
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return fmt.Errorf("cannot marshal storage record: %v", err)
+	}
+	data = append(data, '\n')
+	_, err = s.file.Write(data)
+	if err == nil {
+		err = s.file.Sync()
+	}
+	if err != nil {
+		// Remove any partially written record so that
+		// later records can still be read.
+		s.file.Truncate(s.size)
+		return fmt.Errorf("cannot write storage log: %v", err)
+	}
+	s.apply(rec)
+	s.nrecords++
+	s.size += int64(len(data))
+	if s.nrecords >= fileStorageMinCompact && s.nrecords > 2*len(s.values) {
+		if err := s.compact(); err != nil {
+			log.Printf("warning: cannot compact storage log: %v", err)
+		}
+	}
+	return nil
+}
+
+// Put implements Storage.Put.
+func (s *FileStorage) Put(location, item string) error {
+	return s.PutWithExpiry(location, item, time.Time{})
+}
+
+// PutWithExpiry implements ExpiryStorage.PutWithExpiry.
+// If expiry is the zero time, the item never expires.
+func (s *FileStorage) PutWithExpiry(location, item string, expiry time.Time) error {
+	logf("fileStorage.Put[%q] %q (expiry %v)", location, item, expiry)
+	rec := &fileRecord{
+		Location: []byte(location),
+		Item:     []byte(item),
+	}
+	if !expiry.IsZero() {
+		rec.Expiry = &expiry
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.append(rec)
+}
+
+// Get implements Storage.Get.
+func (s *FileStorage) Get(location string) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.file == nil {
+		return "", errStorageClosed
+	}
+	item, ok := s.values[location]
+	if !ok || item.expired(s.now()) {
+		logf("fileStorage.Get[%q] -> not found", location)
+		return "", ErrNotFound
+	}
+	logf("fileStorage.Get[%q] -> %q", location, item.item)
+	return item.item, nil
+}
+
+// GetMulti implements BatchStorage.GetMulti.
+func (s *FileStorage) GetMulti(locations []string) (map[string]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.file == nil {
+		return nil, errStorageClosed
+	}
+	now := s.now()
+	items := make(map[string]string)
+	for _, location := range locations {
+		if item, ok := s.values[location]; ok && !item.expired(now) {
+			items[location] = item.item
+		}
+	}
+	return items, nil
+}
+
+// Del implements Storage.Del.
+func (s *FileStorage) Del(location string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.file == nil {
+		return errStorageClosed
+	}
+	if _, ok := s.values[location]; !ok {
+		return nil
+	}
+	return s.append(&fileRecord{
+		Location: []byte(location),
+		Delete:   true,
+	})
+}
+
+// Purge implements Purger.Purge by removing all expired
+// items and compacting the log.
+func (s *FileStorage) Purge() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.file == nil {
+		return errStorageClosed
+	}
+	now := s.now()
+	for location, item := range s.values {
+		if item.expired(now) {
+			delete(s.values, location)
+		}
+	}
+	if s.nrecords == len(s.values) {
+		return nil
+	}
+	return s.compact()
+}
+
+// compact replaces the log with one that holds a single
+// record for each item. The new log is written to a
+// temporary file which is then renamed over the old log,
+// so a crash leaves either the old or the new log intact.
+// Called with s.mu held.
+func (s *FileStorage) compact() error {
+	var buf bytes.Buffer
+	for location, item := range s.values {
+		rec := fileRecord{
+			Location: []byte(location),
+			Item:     []byte(item.item),
+		}
+		if !item.expiry.IsZero() {
+			expiry := item.expiry
+			rec.Expiry = &expiry
+		}
+		data, err := json.Marshal(&rec)
+		if err != nil {
+			return fmt.Errorf("cannot marshal storage record: %v", err)
+		}
+		buf.Write(data)
+		buf.WriteByte('\n')
+	}
+	tmpPath := s.logPath() + ".tmp"
+	if err := writeFileSync(tmpPath, buf.Bytes()); err != nil {
+		return fmt.Errorf("cannot write compacted storage log: %v", err)
+	}
+	if err := os.Rename(tmpPath, s.logPath()); err != nil {
+		return fmt.Errorf("cannot replace storage log: %v", err)
+	}
+	syncDir(s.dir)
+	file, err := os.OpenFile(s.logPath(), os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		// We can't append to the log any more,
+		// so the storage is unusable.
+		s.file.Close()
+		s.file = nil
+		return fmt.Errorf("cannot reopen storage log: %v", err)
+	}
+	s.file.Close()
+	s.file = file
+	s.nrecords = len(s.values)
+	s.size = int64(buf.Len())
+	return nil
+}
+
+// Close closes the storage and releases its lock on
+// the directory. It must not be used after it has
+// been closed.
+func (s *FileStorage) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.lock == nil {
+		return nil
+	}
+	var err error
+	if s.file != nil {
+		err = s.file.Close()
+		s.file = nil
+	}
+	if lockErr := s.lock.Close(); err == nil {
+		err = lockErr
+	}
+	s.lock = nil
+	return err
+}
+
+// writeFileSync writes data to the named file
+// and flushes it to disk.
+func writeFileSync(path string, data []byte) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// syncDir flushes the directory entries in dir to disk,
+// so that a rename within it is durable. Not all systems
+// support this, so errors are ignored.
+func syncDir(dir string) {
+	if d, err := os.Open(dir); err == nil {
+		d.Sync()
+		d.Close()
+	}
+}
@@ -0,0 +1,32 @@
+//go:build darwin || dragonfly || freebsd || linux || netbsd || openbsd
+// +build darwin dragonfly freebsd linux netbsd openbsd
+
+package bakery
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// fileLockSupported reports whether lockFile
+// takes a lock on this system.
+const fileLockSupported = true
+
+// lockFile opens the file at the given path, creating it if
+// necessary, and takes an exclusive lock on it. The lock is
+// released when the returned file is closed.
+func lockFile(path string) (*os.File, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		f.Close()
+		if err == syscall.EWOULDBLOCK {
+			return nil, fmt.Errorf("directory is in use by another FileStorage")
+		}
+		return nil, err
+	}
+	return f, nil
+}
@@ -0,0 +1,19 @@
+//go:build !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd
+// +build !darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd
+
+package bakery
+
+import (
+	"os"
+)
+
+// fileLockSupported reports whether lockFile
+// takes a lock on this system.
+const fileLockSupported = false
+
+// lockFile opens the file at the given path, creating it if
+// necessary. File locking is not supported on this system,
+// so no lock is taken.
+func lockFile(path string) (*os.File, error) {
+	return os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+}
@@ -0,0 +1,337 @@
+package bakery_test
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	gc "gopkg.in/check.v1"
+
+	"github.com/rogpeppe/macaroon/bakery"
+)
+
+type FileStorageSuite struct {
+	dir string
+}
+
+var _ = gc.Suite(&FileStorageSuite{})
+
+func (s *FileStorageSuite) SetUpTest(c *gc.C) {
+	dir, err := ioutil.TempDir("", "bakery-storage-test")
+	c.Assert(err, gc.IsNil)
+	s.dir = dir
+}
+
+func (s *FileStorageSuite) TearDownTest(c *gc.C) {
+	os.RemoveAll(s.dir)
+}
+
+func (s *FileStorageSuite) open(c *gc.C) *bakery.FileStorage {
+	store, err := bakery.NewFileStorage(s.dir)
+	c.Assert(err, gc.IsNil)
+	return store
+}
+
+func (s *FileStorageSuite) logData(c *gc.C) []byte {
+	data, err := ioutil.ReadFile(filepath.Join(s.dir, "storage.log"))
+	c.Assert(err, gc.IsNil)
+	return data
+}
+
+func (s *FileStorageSuite) TestFileStorage(c *gc.C) {
+	store := s.open(c)
+	defer store.Close()
+	err := store.Put("foo", "bar")
+	c.Assert(err, gc.IsNil)
+	item, err := store.Get("foo")
+	c.Assert(err, gc.IsNil)
+	c.Assert(item, gc.Equals, "bar")
+
+	err = store.Put("foo", "baz")
+	c.Assert(err, gc.IsNil)
+	item, err = store.Get("foo")
+	c.Assert(err, gc.IsNil)
+	c.Assert(item, gc.Equals, "baz")
+
+	item, err = store.Get("nothing")
+	c.Assert(err, gc.Equals, bakery.ErrNotFound)
+	c.Assert(item, gc.Equals, "")
+
+	err = store.Del("foo")
+	c.Assert(err, gc.IsNil)
+	_, err = store.Get("foo")
+	c.Assert(err, gc.Equals, bakery.ErrNotFound)
+
+	// Deleting a missing item is not an error.
+	err = store.Del("foo")
+	c.Assert(err, gc.IsNil)
+}
+
+func (s *FileStorageSuite) TestPersistence(c *gc.C) {
+	store := s.open(c)
+	expiry := time.Now().Add(time.Hour).Round(time.Second)
+	err := store.Put("a", "a item")
+	c.Assert(err, gc.IsNil)
+	err = store.PutWithExpiry("b", "b item", expiry)
+	c.Assert(err, gc.IsNil)
+	err = store.Put("c", "c item")
+	c.Assert(err, gc.IsNil)
+	err = store.Del("c")
+	c.Assert(err, gc.IsNil)
+	err = store.Close()
+	c.Assert(err, gc.IsNil)
+
+	store = s.open(c)
+	defer store.Close()
+	items, err := store.GetMulti([]string{"a", "b", "c"})
+	c.Assert(err, gc.IsNil)
+	c.Assert(items, gc.DeepEquals, map[string]string{
+		"a": "a item",
+		"b": "b item",
+	})
+
+	// The expiry time is persisted too.
+	bakery.SetFileStorageClock(store, func() time.Time {
+		return expiry
+	})
+	_, err = store.Get("b")
+	c.Assert(err, gc.Equals, bakery.ErrNotFound)
+	item, err := store.Get("a")
+	c.Assert(err, gc.IsNil)
+	c.Assert(item, gc.Equals, "a item")
+}
+
+func (s *FileStorageSuite) TestNonUTF8Persistence(c *gc.C) {
+	const location, item = "loc\xff\xfe", "item\x80\xc3("
+	store := s.open(c)
+	err := store.Put(location, item)
+	c.Assert(err, gc.IsNil)
+	err = store.Close()
+	c.Assert(err, gc.IsNil)
+
+	store = s.open(c)
+	got, err := store.Get(location)
+	c.Assert(err, gc.IsNil)
+	c.Assert(got, gc.Equals, item)
+
+	// The data survives compaction too.
+	err = store.Purge()
+	c.Assert(err, gc.IsNil)
+	err = store.Close()
+	c.Assert(err, gc.IsNil)
+
+	store = s.open(c)
+	defer store.Close()
+	got, err = store.Get(location)
+	c.Assert(err, gc.IsNil)
+	c.Assert(got, gc.Equals, item)
+}
+
+func (s *FileStorageSuite) TestIncompleteRecordDiscarded(c *gc.C) {
+	store := s.open(c)
+	err := store.Put("a", "a item")
+	c.Assert(err, gc.IsNil)
+	err = store.Close()
+	c.Assert(err, gc.IsNil)
+	good := s.logData(c)
+
+	// Simulate a crash in the middle of writing a record.
+	f, err := os.OpenFile(filepath.Join(s.dir, "storage.log"), os.O_WRONLY|os.O_APPEND, 0)
+	c.Assert(err, gc.IsNil)
+	_, err = f.Write([]byte(`{"loc":"b","it`))
+	c.Assert(err, gc.IsNil)
+	f.Close()
+
+	store = s.open(c)
+	defer store.Close()
+	c.Assert(s.logData(c), gc.DeepEquals, good)
+	item, err := store.Get("a")
+	c.Assert(err, gc.IsNil)
+	c.Assert(item, gc.Equals, "a item")
+	_, err = store.Get("b")
+	c.Assert(err, gc.Equals, bakery.ErrNotFound)
+
+	// New records can be added after the discarded one.
+	err = store.Put("c", "c item")
+	c.Assert(err, gc.IsNil)
+	store.Close()
+	store = s.open(c)
+	defer store.Close()
+	item, err = store.Get("c")
+	c.Assert(err, gc.IsNil)
+	c.Assert(item, gc.Equals, "c item")
+}
+
+func (s *FileStorageSuite) TestCorruptRecordSkipped(c *gc.C) {
+	// The locations and items are base64 encoded.
+	data := `{"loc":"YQ==","item":"YSBpdGVt"}
+garbage
+{"loc":"Yg==","item":"YiBpdGVt"}
+`
+	err := ioutil.WriteFile(filepath.Join(s.dir, "storage.log"), []byte(data), 0600)
+	c.Assert(err, gc.IsNil)
+	store := s.open(c)
+	defer store.Close()
+	items, err := store.GetMulti([]string{"a", "b"})
+	c.Assert(err, gc.IsNil)
+	c.Assert(items, gc.DeepEquals, map[string]string{
+		"a": "a item",
+		"b": "b item",
+	})
+
+	// Compaction removes the corrupt record.
+	err = store.Purge()
+	c.Assert(err, gc.IsNil)
+	c.Assert(bytes.Contains(s.logData(c), []byte("garbage")), gc.Equals, false)
+}
+
+func (s *FileStorageSuite) TestDirectoryLocked(c *gc.C) {
+	if !bakery.FileLockSupported {
+		c.Skip("file locking not supported")
+	}
+	store := s.open(c)
+	_, err := bakery.NewFileStorage(s.dir)
+	c.Assert(err, gc.ErrorMatches, "cannot lock storage: directory is in use by another FileStorage")
+	err = store.Close()
+	c.Assert(err, gc.IsNil)
+
+	// The directory can be used again once
+	// the storage has been closed.
+	store = s.open(c)
+	store.Close()
+}
+
+func (s *FileStorageSuite) TestPurge(c *gc.C) {
+	store := s.open(c)
+	now := time.Now()
+	bakery.SetFileStorageClock(store, func() time.Time {
+		return now
+	})
+	for i := 0; i < 10; i++ {
+		err := store.PutWithExpiry(fmt.Sprint(i), "item", now.Add(time.Duration(i)*time.Minute))
+		c.Assert(err, gc.IsNil)
+	}
+	err := store.Put("live", "item")
+	c.Assert(err, gc.IsNil)
+	for i := 0; i < 5; i++ {
+		err := store.Put("live", "item")
+		c.Assert(err, gc.IsNil)
+	}
+	c.Assert(bytes.Count(s.logData(c), []byte("\n")), gc.Equals, 16)
+
+	now = now.Add(5 * time.Minute)
+	err = store.Purge()
+	c.Assert(err, gc.IsNil)
+	c.Assert(bytes.Count(s.logData(c), []byte("\n")), gc.Equals, 5)
+	_, err = os.Stat(filepath.Join(s.dir, "storage.log.tmp"))
+	c.Assert(os.IsNotExist(err), gc.Equals, true)
+
+	// The storage can still be written to after
+	// compaction, and the data survives reopening.
+	err = store.Put("new", "item")
+	c.Assert(err, gc.IsNil)
+	store.Close()
+	store = s.open(c)
+	defer store.Close()
+	bakery.SetFileStorageClock(store, func() time.Time {
+		return now
+	})
+	for _, loc := range []string{"6", "9", "live", "new"} {
+		_, err := store.Get(loc)
+		c.Assert(err, gc.IsNil, gc.Commentf("location %q", loc))
+	}
+	_, err = store.Get("5")
+	c.Assert(err, gc.Equals, bakery.ErrNotFound)
+}
+
+func (s *FileStorageSuite) TestAutomaticCompaction(c *gc.C) {
+	store := s.open(c)
+	defer store.Close()
+	for i := 0; i < bakery.FileStorageMinCompact; i++ {
+		err := store.Put("a", fmt.Sprint(i))
+		c.Assert(err, gc.IsNil)
+	}
+	c.Assert(bytes.Count(s.logData(c), []byte("\n")), gc.Equals, 1)
+	item, err := store.Get("a")
+	c.Assert(err, gc.IsNil)
+	c.Assert(item, gc.Equals, fmt.Sprint(bakery.FileStorageMinCompact-1))
+}
+
+func (s *FileStorageSuite) TestCompactionFailureNotReturned(c *gc.C) {
+	store := s.open(c)
+	defer store.Close()
+	// Prevent the compacted log from being written.
+	err := os.Mkdir(filepath.Join(s.dir, "storage.log.tmp"), 0700)
+	c.Assert(err, gc.IsNil)
+	for i := 0; i < bakery.FileStorageMinCompact; i++ {
+		err := store.Put("a", fmt.Sprint(i))
+		c.Assert(err, gc.IsNil)
+	}
+	c.Assert(bytes.Count(s.logData(c), []byte("\n")), gc.Equals, bakery.FileStorageMinCompact)
+	item, err := store.Get("a")
+	c.Assert(err, gc.IsNil)
+	c.Assert(item, gc.Equals, fmt.Sprint(bakery.FileStorageMinCompact-1))
+}
+
+func (s *FileStorageSuite) TestClosed(c *gc.C) {
+	store := s.open(c)
+	err := store.Close()
+	c.Assert(err, gc.IsNil)
+	err = store.Put("a", "b")
+	c.Assert(err, gc.ErrorMatches, "storage has been closed")
+	_, err = store.Get("a")
+	c.Assert(err, gc.ErrorMatches, "storage has been closed")
+	err = store.Close()
+	c.Assert(err, gc.IsNil)
+}
+
+func (s *FileStorageSuite) TestConcurrentFileStorage(c *gc.C) {
+	store := s.open(c)
+	defer store.Close()
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		i := i
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			k := fmt.Sprint(i)
+			err := store.Put(k, k)
+			c.Check(err, gc.IsNil)
+			v, err := store.Get(k)
+			c.Check(v, gc.Equals, k)
+			err = store.Del(k)
+			c.Check(err, gc.IsNil)
+			err = store.Purge()
+			c.Check(err, gc.IsNil)
+		}()
+	}
+	wg.Wait()
+}
+
+func (s *FileStorageSuite) TestServiceWithFileStorage(c *gc.C) {
+	newService := func(store bakery.Storage) *bakery.Service {
+		svc, err := bakery.NewService(bakery.NewServiceParams{
+			Location: "loc",
+			Store:    store,
+		})
+		c.Assert(err, gc.IsNil)
+		return svc
+	}
+	store := s.open(c)
+	m, err := newService(store).NewMacaroon("", nil, []bakery.Caveat{{Condition: "ok"}})
+	c.Assert(err, gc.IsNil)
+	store.Close()
+
+	// The macaroon can be checked by a new service
+	// using the same storage directory.
+	store = s.open(c)
+	defer store.Close()
+	req := newService(store).NewRequest(bakery.FirstPartyCheckerFunc(checkCondition))
+	req.AddClientMacaroon(m)
+	err = req.Check()
+	c.Assert(err, gc.IsNil)
+}
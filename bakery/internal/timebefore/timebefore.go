@@ -0,0 +1,30 @@
+// Package timebefore defines the format of time-before caveats.
+// It is shared by the bakery, which uses their expiry times to
+// expire stored root keys, and the checkers package, which
+// creates and checks them.
+package timebefore
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Prefix holds the prefix of the condition of
+// a time-before caveat.
+const Prefix = "time-before "
+
+// Condition returns the condition of a time-before
+// caveat that expires at the given time.
+func Condition(t time.Time) string {
+	return Prefix + t.Format(time.RFC3339)
+}
+
+// Parse returns the expiry time of the time-before
+// caveat with the given condition.
+func Parse(cond string) (time.Time, error) {
+	if !strings.HasPrefix(cond, Prefix) {
+		return time.Time{}, fmt.Errorf("not a time-before caveat")
+	}
+	return time.Parse(time.RFC3339, cond[len(Prefix):])
+}
@@ -3,10 +3,11 @@ package bakery
 import (
 	"crypto/rand"
 	"encoding/hex"
+	"io"
 	"strings"
 	"sync"
 
-	"code.google.com/p/go.crypto/nacl/box"
+	"golang.org/x/crypto/nacl/box"
 )
 
 // KeyLen is the byte length of the Ed25519 public and private keys used for
@@ -53,8 +54,14 @@ type KeyPair struct {
 
 // GenerateKey generates a new key pair.
 func GenerateKey() (*KeyPair, error) {
+	return generateKey(rand.Reader)
+}
+
+// generateKey generates a new key pair using
+// the given source of randomness.
+func generateKey(r io.Reader) (*KeyPair, error) {
 	var key KeyPair
-	pub, priv, err := box.GenerateKey(rand.Reader)
+	pub, priv, err := box.GenerateKey(r)
 	if err != nil {
 		return nil, err
 	}
@@ -0,0 +1,178 @@
+package bakery
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RootKeyPolicy holds the policy used by a service to share
+// root keys between the macaroons that it mints.
+type RootKeyPolicy struct {
+	// GenerateInterval holds the length of time for which a
+	// root key is used to mint new macaroons before a new
+	// root key is generated. It must be positive.
+	GenerateInterval time.Duration
+
+	// ExpiryDuration holds the length of time after its
+	// generation that a root key is kept in storage.
+	// Macaroons minted with the root key cannot be verified
+	// after that time. If it is zero, root keys never expire;
+	// otherwise it must be at least twice GenerateInterval,
+	// so that a macaroon minted just before a new root key
+	// is generated can still be verified for at least
+	// GenerateInterval.
+	ExpiryDuration time.Duration
+}
+
+const (
+	// sharedKeyIdPrefix holds the prefix of the id of a
+	// macaroon minted with a shared root key. The prefix is
+	// followed by the root key's id, a colon and the rest
+	// of the macaroon id.
+	sharedKeyIdPrefix = "rk:"
+
+	// rootKeyLocationPrefix holds the prefix of the
+	// storage location of a shared root key.
+	rootKeyLocationPrefix = "root-key:"
+)
+
+// sharedKeyMacaroonId returns the id of a macaroon
+// with the given id minted with the root key with
+// the given id.
+func sharedKeyMacaroonId(keyId, id string) string {
+	return sharedKeyIdPrefix + keyId + ":" + id
+}
+
+// parseSharedKeyId returns the id of the shared root key
+// embedded in the given macaroon id. It reports false
+// if the macaroon was not minted with a shared root key.
+func parseSharedKeyId(macaroonId string) (string, bool) {
+	if !strings.HasPrefix(macaroonId, sharedKeyIdPrefix) {
+		return "", false
+	}
+	rest := macaroonId[len(sharedKeyIdPrefix):]
+	i := strings.Index(rest, ":")
+	if i <= 0 {
+		return "", false
+	}
+	return rest[:i], true
+}
+
+// storageLocation returns the location of the storage item
+// holding the root key for the macaroon with the given id.
+// Shared root keys are only looked for if sharedKeys is true,
+// so that a service without a root key policy finds
+// macaroons stored under ids that happen to look like
+// shared key macaroon ids.
+func storageLocation(macaroonId string, sharedKeys bool) string {
+	if keyId, ok := parseSharedKeyId(macaroonId); ok && sharedKeys {
+		return rootKeyLocationPrefix + keyId
+	}
+	return macaroonId
+}
+
+// rootKeyStore manages the shared root keys of a service.
+// It caches the root keys that it has seen so that
+// they need not be fetched from storage each time
+// they are used.
+type rootKeyStore struct {
+	policy RootKeyPolicy
+	store  storage
+	rand   io.Reader
+	now    func() time.Time
+
+	// mu guards the fields following it.
+	mu sync.Mutex
+
+	// currentId holds the id of the root key currently
+	// used to mint new macaroons, and created holds
+	// the time it was generated.
+	currentId string
+	created   time.Time
+
+	// keys holds all the root keys known to the
+	// store, keyed by root key id.
+	keys map[string]*storageItem
+}
+
+func newRootKeyStore(policy RootKeyPolicy, store storage, rand io.Reader, now func() time.Time) (*rootKeyStore, error) {
+	if policy.GenerateInterval <= 0 {
+		return nil, fmt.Errorf("root key generation interval must be positive")
+	}
+	if policy.ExpiryDuration != 0 && policy.ExpiryDuration < 2*policy.GenerateInterval {
+		return nil, fmt.Errorf("root key expiry duration %v is less than twice the generation interval %v", policy.ExpiryDuration, policy.GenerateInterval)
+	}
+	return &rootKeyStore{
+		policy: policy,
+		store:  store,
+		rand:   rand,
+		now:    now,
+		keys:   make(map[string]*storageItem),
+	}, nil
+}
+
+// current returns the id and value of the root key to use
+// to mint a new macaroon, generating and storing a new
+// root key if the current one is too old.
+func (s *rootKeyStore) current() (string, []byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := s.now()
+	if item := s.keys[s.currentId]; item != nil && now.Before(s.created.Add(s.policy.GenerateInterval)) {
+		return s.currentId, item.RootKey, nil
+	}
+	rootKey, err := randomBytes(s.rand, rootKeyLen)
+	if err != nil {
+		return "", nil, fmt.Errorf("cannot generate root key: %v", err)
+	}
+	idBytes, err := randomBytes(s.rand, 8)
+	if err != nil {
+		return "", nil, fmt.Errorf("cannot generate root key id: %v", err)
+	}
+	keyId := fmt.Sprintf("%x", idBytes)
+	item := &storageItem{
+		RootKey: rootKey,
+	}
+	if s.policy.ExpiryDuration != 0 {
+		item.Expiry = now.Add(s.policy.ExpiryDuration)
+	}
+	if err := s.store.Put(rootKeyLocationPrefix+keyId, item); err != nil {
+		return "", nil, fmt.Errorf("cannot save root key to store: %v", err)
+	}
+	// Take the opportunity to forget expired keys.
+	for id, item := range s.keys {
+		if item.expired(now) {
+			delete(s.keys, id)
+		}
+	}
+	s.keys[keyId] = item
+	s.currentId = keyId
+	s.created = now
+	return keyId, rootKey, nil
+}
+
+// get returns the cached root key with the given id,
+// or nil if it is not cached or has expired.
+func (s *rootKeyStore) get(keyId string) *storageItem {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	item := s.keys[keyId]
+	if item == nil {
+		return nil
+	}
+	if item.expired(s.now()) {
+		delete(s.keys, keyId)
+		return nil
+	}
+	return item
+}
+
+// add adds the given root key, read from storage, to the cache.
+func (s *rootKeyStore) add(keyId string, item *storageItem) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.keys[keyId] = item
+}
@@ -2,15 +2,30 @@
 // a transport and storage-agnostic way of using macaroons to assert
 // client capabilities.
 //
+// INCOMPATIBLE CHANGE: the bakery now uses the macaroon package
+// at github.com/rogpeppe/macaroon rather than gopkg.in/macaroon.v1.
+// That package calculates signatures in the same way as libmacaroons,
+// so macaroons minted by a service built with gopkg.in/macaroon.v1
+// fail to verify with this version, and the reverse. Root keys in
+// existing storage are still used, but clients must acquire new
+// macaroons and discharge macaroons once a service has been upgraded,
+// and the services that mint and discharge a macaroon must be
+// upgraded together.
+//
 package bakery
 
 import (
 	"crypto/rand"
+	"errors"
 	"fmt"
+	"io"
 	"log"
+	"strings"
 	"sync"
+	"time"
 
-	"gopkg.in/macaroon.v1"
+	"github.com/rogpeppe/macaroon"
+	"github.com/rogpeppe/macaroon/bakery/internal/timebefore"
 )
 
 const debug = false
@@ -28,6 +43,18 @@ type Service struct {
 	store    storage
 	checker  FirstPartyChecker
 	encoder  *boxEncoder
+	rand     io.Reader
+	now      func() time.Time
+
+	// rootKeys holds the shared root keys used to mint
+	// new macaroons, or nil if each macaroon has its
+	// own root key.
+	rootKeys *rootKeyStore
+
+	// secrets holds the master secrets used to seal the
+	// root keys of stateless macaroons, or nil if the
+	// service does not mint stateless macaroons.
+	secrets *masterSecrets
 }
 
 // NewServiceParams holds the parameters for a NewService call.
@@ -49,6 +76,47 @@ type NewServiceParams struct {
 	// adding a third-party caveat.
 	// It may be nil, in which case, no third-party caveats can be created.
 	Locator PublicKeyLocator
+
+	// Rand is used as the source of randomness for
+	// the service's key pair if Key is nil, and for
+	// the root keys, ids and third party caveats of
+	// the macaroons that it creates. If it is nil,
+	// crypto/rand.Reader is used.
+	//
+	// A deterministic source can be used to produce
+	// reproducible macaroons, for example for test
+	// vectors. This should never be done in production.
+	Rand io.Reader
+
+	// RootKeys, if non-nil, causes the service to mint macaroons
+	// with a small set of shared root keys that are generated
+	// and expired according to the given policy, rather than
+	// storing a new root key for each macaroon. The id of the
+	// root key is embedded in the id of each macaroon, so
+	// the storage holds only one item for each root key,
+	// and the service caches the root keys that it reads.
+	//
+	// Macaroons minted with an explicit root key, such as
+	// discharge macaroons, still have their own root keys.
+	RootKeys *RootKeyPolicy
+
+	// MasterSecret, if non-nil, causes the service to mint
+	// stateless macaroons: macaroons whose ids hold their root
+	// keys encrypted with a key derived from the master secret,
+	// so that they can be verified without any access to the
+	// storage. As with RootKeys, macaroons minted with an
+	// explicit root key are stored as usual. MasterSecret
+	// cannot be used together with RootKeys.
+	//
+	// Anyone who knows the master secret can mint macaroons
+	// for the service, so it must be kept secret.
+	MasterSecret *[KeyLen]byte
+
+	// OldMasterSecrets holds master secrets that were used
+	// previously. They are used only to decrypt the root keys
+	// of existing stateless macaroons, so that the master
+	// secret can be changed without invalidating them.
+	OldMasterSecrets []*[KeyLen]byte
 }
 
 // NewService returns a new service that can mint new
@@ -57,14 +125,33 @@ func NewService(p NewServiceParams) (*Service, error) {
 	if p.Store == nil {
 		p.Store = NewMemStorage()
 	}
+	if p.Rand == nil {
+		p.Rand = rand.Reader
+	}
 	svc := &Service{
 		location: p.Location,
 		store:    storage{p.Store},
+		rand:     p.Rand,
+		now:      time.Now,
 	}
 
 	var err error
+	if p.MasterSecret != nil {
+		if p.RootKeys != nil {
+			return nil, fmt.Errorf("cannot use both shared root keys and a master secret")
+		}
+		svc.secrets = newMasterSecrets(p.MasterSecret, p.OldMasterSecrets, p.Rand)
+	} else if len(p.OldMasterSecrets) > 0 {
+		return nil, fmt.Errorf("old master secrets provided without a master secret")
+	}
+	if p.RootKeys != nil {
+		svc.rootKeys, err = newRootKeyStore(*p.RootKeys, svc.store, p.Rand, svc.now)
+		if err != nil {
+			return nil, err
+		}
+	}
 	if p.Key == nil {
-		p.Key, err = GenerateKey()
+		p.Key, err = generateKey(p.Rand)
 		if err != nil {
 			return nil, err
 		}
@@ -72,7 +159,7 @@ func NewService(p NewServiceParams) (*Service, error) {
 	if p.Locator == nil {
 		p.Locator = PublicKeyLocatorMap(nil)
 	}
-	svc.encoder = newBoxEncoder(p.Locator, p.Key)
+	svc.encoder = newBoxEncoder(p.Locator, p.Key, p.Rand)
 	return svc, nil
 }
 
@@ -114,9 +201,10 @@ type Request struct {
 	// with the request.
 	macaroons []*macaroon.Macaroon
 
-	// inStorage maps from macaroon id
-	// to the storage associated with that macaroon
-	// for all elements in macaroons.
+	// inStorage maps from each macaroon in macaroons
+	// to its associated storage item, or nil if it was
+	// not found in storage. Macaroons that have not yet
+	// been looked up have no entry.
 	inStorage map[*macaroon.Macaroon]*storageItem
 }
 
@@ -134,59 +222,146 @@ func (svc *Service) NewRequest(checker FirstPartyChecker) *Request {
 // the request. The macaroon will be taken into account when req.Check
 // is called.
 //
+// The macaroon's root key is not looked up until Check is
+// called, when the root keys of all the macaroons added since
+// the last call are fetched together; see BatchStorage.
+//
 // TODO(rog) provide a way of deleting client macaroons?
 func (req *Request) AddClientMacaroon(m *macaroon.Macaroon) {
 	req.mu.Lock()
 	defer req.mu.Unlock()
 
 	req.macaroons = append(req.macaroons, m)
-	if req.inStorage[m] != nil {
-		return
+}
+
+// lookup fetches the storage items for all the request's
+// macaroons that have not been looked up yet.
+// Shared root keys that the service has cached
+// and the root keys of stateless macaroons
+// are not fetched from storage.
+// Called with req.mu held.
+func (req *Request) lookup() {
+	rootKeys := req.svc.rootKeys
+	var locations []string
+	found := make(map[string]bool)
+	for _, m := range req.macaroons {
+		if _, ok := req.inStorage[m]; ok {
+			continue
+		}
+		if req.svc.secrets != nil && strings.HasPrefix(m.Id(), statelessIdPrefix) {
+			item, err := req.svc.secrets.open(m.Id())
+			if err == nil {
+				req.inStorage[m] = item
+				continue
+			}
+			// The macaroon may have been stored with
+			// an id that happens to look like a stateless
+			// macaroon id, so fall back to the storage.
+			logf("cannot open stateless macaroon id %q: %v", m.Id(), err)
+		}
+		if keyId, ok := parseSharedKeyId(m.Id()); ok && rootKeys != nil {
+			if item := rootKeys.get(keyId); item != nil {
+				req.inStorage[m] = item
+				continue
+			}
+		}
+		location := storageLocation(m.Id(), rootKeys != nil)
+		if !found[location] {
+			found[location] = true
+			locations = append(locations, location)
+		}
 	}
-	// TODO(rog) perhaps defer doing this until Check time,
-	// when we could fetch all the ids at once. We'd
-	// want to change Storage.Get to take a slice of ids.
-	item, err := req.svc.store.Get(m.Id())
-	if err == ErrNotFound {
+	if len(locations) == 0 {
 		return
 	}
+	items, err := req.svc.store.GetMulti(locations, req.svc.now())
 	if err != nil {
+		// Leave the macaroons to be looked up
+		// again by the next call to Check.
 		log.Printf("warning: failed to read storage: %v", err)
 		return
 	}
-	req.inStorage[m] = item
+	for _, m := range req.macaroons {
+		if _, ok := req.inStorage[m]; ok {
+			continue
+		}
+		item := items[storageLocation(m.Id(), rootKeys != nil)]
+		req.inStorage[m] = item
+		if keyId, ok := parseSharedKeyId(m.Id()); ok && rootKeys != nil && item != nil {
+			rootKeys.add(keyId, item)
+		}
+	}
 }
 
 // NewMacaroon mints a new macaroon with the given id and caveats.
-// If the id is empty, a random id will be used.
+// If the id is empty, a random id will be used. The id must not
+// start with "rk:", "sk:" or "root-key:", which are reserved
+// for use by the service.
 // If rootKey is nil, a random root key will be used.
 // The macaroon will be stored in the service's storage.
+//
+// If the service was created with a RootKeys policy and
+// rootKey is nil, the current shared root key is used
+// instead and nothing is stored; the id of the root key
+// is prepended to the macaroon's id. Similarly, if the service
+// was created with a MasterSecret and rootKey is nil, a
+// stateless macaroon is minted, with a random root key
+// sealed in its id.
+//
+// If the caveats include any time-before caveats (see
+// checkers.TimeBefore), the root key is stored with
+// the earliest of their expiry times, so that the storage
+// can discard it when the macaroon can no longer be used.
 func (svc *Service) NewMacaroon(id string, rootKey []byte, caveats []Caveat) (*macaroon.Macaroon, error) {
+	return svc.NewMacaroonWithExpiry(id, rootKey, caveats, time.Time{})
+}
+
+// NewMacaroonWithExpiry is like NewMacaroon except that the
+// root key is stored with the given expiry time instead of
+// one derived from the caveats. The macaroon will fail to
+// verify after that time. If expiry is the zero time, the
+// expiry time is derived from the caveats as for NewMacaroon.
+//
+// When a shared root key is used, the expiry is ignored;
+// the macaroon fails to verify when the root key expires.
+func (svc *Service) NewMacaroonWithExpiry(id string, rootKey []byte, caveats []Caveat, expiry time.Time) (*macaroon.Macaroon, error) {
+	return svc.newMacaroon(id, rootKey, caveats, expiry, false)
+}
+
+// newMacaroon implements NewMacaroonWithExpiry. If legacyRootKey
+// is true, rootKey may be shorter than the minimum root key
+// length; this is used to discharge third party caveats added
+// by earlier versions.
+func (svc *Service) newMacaroon(id string, rootKey []byte, caveats []Caveat, expiry time.Time, legacyRootKey bool) (*macaroon.Macaroon, error) {
+	if err := checkMacaroonId(id); err != nil {
+		return nil, err
+	}
+	if rootKey == nil && svc.rootKeys != nil {
+		return svc.newSharedKeyMacaroon(id, caveats)
+	}
+	stateless := rootKey == nil && svc.secrets != nil
 	if rootKey == nil {
-		newRootKey, err := randomBytes(24)
+		newRootKey, err := randomBytes(svc.rand, rootKeyLen)
 		if err != nil {
 			return nil, fmt.Errorf("cannot generate root key for new macaroon: %v", err)
 		}
 		rootKey = newRootKey
 	}
-	if id == "" {
-		idBytes, err := randomBytes(24)
-		if err != nil {
-			return nil, fmt.Errorf("cannot generate id for new macaroon: %v", err)
-		}
-		id = fmt.Sprintf("%x", idBytes)
+	if expiry.IsZero() {
+		expiry = caveatsExpiry(caveats)
 	}
-	m, err := macaroon.New(rootKey, id, svc.location)
+	item := &storageItem{
+		RootKey: rootKey,
+		Expiry:  expiry,
+	}
+	if stateless {
+		return svc.newStatelessMacaroon(id, item, caveats)
+	}
+	m, err := svc.bake(id, rootKey, legacyRootKey)
 	if err != nil {
-		return nil, fmt.Errorf("cannot bake macaroon: %v", err)
+		return nil, err
 	}
-
-	// TODO look at the caveats for expiry time and associate
-	// that with the storage item so that the storage can
-	// garbage collect it at an appropriate time.
-	if err := svc.store.Put(m.Id(), &storageItem{
-		RootKey: rootKey,
-	}); err != nil {
+	if err := svc.store.Put(m.Id(), item); err != nil {
 		return nil, fmt.Errorf("cannot save macaroon to store: %v", err)
 	}
 	for _, cav := range caveats {
@@ -200,17 +375,147 @@ func (svc *Service) NewMacaroon(id string, rootKey []byte, caveats []Caveat) (*m
 	return m, nil
 }
 
+// reservedIdPrefixes holds the prefixes of the macaroon ids
+// and storage locations that the service uses for its own
+// purposes.
+var reservedIdPrefixes = []string{
+	sharedKeyIdPrefix,
+	statelessIdPrefix,
+	rootKeyLocationPrefix,
+}
+
+// checkMacaroonId returns an error if the given macaroon id,
+// provided by a caller of NewMacaroon, starts with a prefix
+// reserved by the service. Such an id could be mistaken for
+// the id of a shared key or stateless macaroon, or
+// overwrite a shared root key in storage.
+func checkMacaroonId(id string) error {
+	for _, prefix := range reservedIdPrefixes {
+		if strings.HasPrefix(id, prefix) {
+			return fmt.Errorf("macaroon id %q has reserved prefix %q", id, prefix)
+		}
+	}
+	return nil
+}
+
+// newSharedKeyMacaroon mints a new macaroon with the given
+// id and caveats using the current shared root key.
+func (svc *Service) newSharedKeyMacaroon(id string, caveats []Caveat) (*macaroon.Macaroon, error) {
+	keyId, rootKey, err := svc.rootKeys.current()
+	if err != nil {
+		return nil, err
+	}
+	if id == "" {
+		if id, err = svc.randomId(); err != nil {
+			return nil, err
+		}
+	}
+	m, err := svc.bake(sharedKeyMacaroonId(keyId, id), rootKey, false)
+	if err != nil {
+		return nil, err
+	}
+	for _, cav := range caveats {
+		if err := svc.AddCaveat(m, cav); err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+// newStatelessMacaroon mints a new stateless macaroon with the
+// given id and caveats whose root key and expiry time are held
+// in item.
+func (svc *Service) newStatelessMacaroon(id string, item *storageItem, caveats []Caveat) (*macaroon.Macaroon, error) {
+	if id == "" {
+		var err error
+		if id, err = svc.randomId(); err != nil {
+			return nil, err
+		}
+	}
+	id, err := svc.secrets.seal(id, item)
+	if err != nil {
+		return nil, fmt.Errorf("cannot seal root key: %v", err)
+	}
+	m, err := svc.bake(id, item.RootKey, false)
+	if err != nil {
+		return nil, err
+	}
+	for _, cav := range caveats {
+		if err := svc.AddCaveat(m, cav); err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+// bake returns a new macaroon with the given id and root key,
+// using the service's location and source of randomness.
+// If id is empty, a random id is used. If legacyRootKey is
+// true, any non-empty root key is accepted.
+func (svc *Service) bake(id string, rootKey []byte, legacyRootKey bool) (*macaroon.Macaroon, error) {
+	if id == "" {
+		var err error
+		if id, err = svc.randomId(); err != nil {
+			return nil, err
+		}
+	}
+	var m *macaroon.Macaroon
+	var err error
+	if legacyRootKey {
+		m, err = macaroon.NewWithLegacyRootKey(rootKey, []byte(id), svc.location)
+	} else {
+		m, err = macaroon.New(rootKey, id, svc.location)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("cannot bake macaroon: %v", err)
+	}
+	m.SetRand(svc.rand)
+	return m, nil
+}
+
+// randomId returns a new random macaroon id.
+func (svc *Service) randomId() (string, error) {
+	idBytes, err := randomBytes(svc.rand, 24)
+	if err != nil {
+		return "", fmt.Errorf("cannot generate id for new macaroon: %v", err)
+	}
+	return fmt.Sprintf("%x", idBytes), nil
+}
+
+// caveatsExpiry returns the earliest expiry time of the
+// time-before caveats in caveats, or the zero time if there
+// are none. Caveats that cannot be parsed are ignored,
+// as they will not be satisfied anyway.
+func caveatsExpiry(caveats []Caveat) time.Time {
+	var expiry time.Time
+	for _, cav := range caveats {
+		if cav.Location != "" {
+			continue
+		}
+		t, err := timebefore.Parse(cav.Condition)
+		if err != nil {
+			continue
+		}
+		if expiry.IsZero() || t.Before(expiry) {
+			expiry = t
+		}
+	}
+	return expiry
+}
+
 // AddCaveat adds a caveat to the given macaroon.
 //
 // If it's a third-party caveat, it uses the service's caveat-id encoder
-// to create the id of the new caveat.
+// to create the id of the new caveat, and the service's source of
+// randomness to encrypt its root key. The macaroon's own source of
+// randomness is left unchanged.
 func (svc *Service) AddCaveat(m *macaroon.Macaroon, cav Caveat) error {
 	logf("Service.AddCaveat id %q; cav %#v", m.Id(), cav)
 	if cav.Location == "" {
 		m.AddFirstPartyCaveat(cav.Condition)
 		return nil
 	}
-	rootKey, err := randomBytes(24)
+	rootKey, err := randomBytes(svc.rand, rootKeyLen)
 	if err != nil {
 		return fmt.Errorf("cannot generate third party secret: %v", err)
 	}
@@ -218,7 +523,7 @@ func (svc *Service) AddCaveat(m *macaroon.Macaroon, cav Caveat) error {
 	if err != nil {
 		return fmt.Errorf("cannot create third party caveat id at %q: %v", cav.Location, err)
 	}
-	if err := m.AddThirdPartyCaveat(rootKey, id, cav.Location); err != nil {
+	if err := m.AddThirdPartyCaveatWithRand(rootKey, id, cav.Location, svc.rand); err != nil {
 		return fmt.Errorf("cannot add third party caveat: %v", err)
 	}
 	return nil
@@ -241,12 +546,18 @@ func (svc *Service) Discharge(checker ThirdPartyChecker, id string) (*macaroon.M
 	if err != nil {
 		return nil, err
 	}
-	return svc.NewMacaroon(id, rootKey, caveats)
+	// The root key was chosen by the first party, which may
+	// be running an earlier version that used shorter keys.
+	return svc.newMacaroon(id, rootKey, caveats, time.Time{}, true)
 }
 
-func randomBytes(n int) ([]byte, error) {
+// rootKeyLen holds the length of the root keys
+// generated by the service.
+var rootKeyLen = macaroon.HMACSHA256.MinRootKeyLen()
+
+func randomBytes(r io.Reader, n int) ([]byte, error) {
 	b := make([]byte, n)
-	_, err := rand.Read(b)
+	_, err := io.ReadFull(r, b)
 	if err != nil {
 		return nil, fmt.Errorf("cannot generate %d random bytes: %v", n, err)
 	}
@@ -260,28 +571,40 @@ func randomBytes(n int) ([]byte, error) {
 func (req *Request) Check() error {
 	req.mu.Lock()
 	defer req.mu.Unlock()
-	if len(req.macaroons) == 0 {
-		return &VerificationError{
-			Reason: fmt.Errorf("no possible macaroons found"),
-		}
-	}
+	req.lookup()
 	var anError error
+	now := req.svc.now()
 	for _, m := range req.macaroons {
 		item := req.inStorage[m]
-		if item == nil {
+		if item == nil || item.expired(now) {
 			continue
 		}
-		err := m.Verify(item.RootKey, req.checker.CheckFirstPartyCaveat, req.macaroons)
+		err := m.VerifyWithOptions(item.RootKey, req.checker.CheckFirstPartyCaveat, req.macaroons, verifyOptions)
 		if err == nil {
 			return nil
 		}
 		anError = err
 	}
+	if anError == nil {
+		anError = ErrNoMacaroons
+	}
 	return &VerificationError{
 		Reason: anError,
 	}
 }
 
+// verifyOptions holds the options used to verify client macaroons.
+// The service only mints macaroons that use the default algorithm,
+// so macaroons that claim to use any other are rejected.
+var verifyOptions = macaroon.VerifyOptions{
+	RequireAlgorithm: true,
+	Algorithm:        macaroon.HMACSHA256,
+}
+
+// ErrNoMacaroons is used as the Reason in a VerificationError
+// when the request holds no macaroons minted by the service.
+var ErrNoMacaroons = errors.New("no possible macaroons found")
+
 type CaveatNotRecognizedError struct {
 	Caveat string
 }
@@ -290,7 +613,18 @@ func (e *CaveatNotRecognizedError) Error() string {
 	return fmt.Sprintf("caveat %q not recognized", e.Caveat)
 }
 
+// VerificationError is returned by Request.Check when
+// the client's macaroons fail to verify.
 type VerificationError struct {
+	// Reason holds the cause of the failure. If the client
+	// provided no suitable macaroons, it is ErrNoMacaroons;
+	// otherwise it holds the error returned by Macaroon.Verify
+	// for one of the client's macaroons, which will be one of
+	// the error types defined by the macaroon package, such as
+	// *macaroon.CaveatError or *macaroon.DischargeNotFoundError.
+	// This can be used to decide whether a new macaroon
+	// or new discharge macaroons may allow the
+	// request to succeed.
 	Reason error
 }
 
@@ -0,0 +1,789 @@
+package bakery_test
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"strings"
+	"time"
+
+	gc "gopkg.in/check.v1"
+
+	"github.com/rogpeppe/macaroon"
+	"github.com/rogpeppe/macaroon/bakery"
+	"github.com/rogpeppe/macaroon/bakery/checkers"
+)
+
+type ServiceSuite struct{}
+
+var _ = gc.Suite(&ServiceSuite{})
+
+func newService(c *gc.C, location string, locator bakery.PublicKeyLocator) *bakery.Service {
+	svc, err := bakery.NewService(bakery.NewServiceParams{
+		Location: location,
+		Locator:  locator,
+	})
+	c.Assert(err, gc.IsNil)
+	return svc
+}
+
+func checkCondition(cond string) error {
+	if cond == "ok" {
+		return nil
+	}
+	return fmt.Errorf("condition %q not met", cond)
+}
+
+func (*ServiceSuite) TestCheckNoMacaroons(c *gc.C) {
+	svc := newService(c, "loc", nil)
+	req := svc.NewRequest(bakery.FirstPartyCheckerFunc(checkCondition))
+	err := req.Check()
+	c.Assert(err, gc.FitsTypeOf, (*bakery.VerificationError)(nil))
+	c.Assert(err.(*bakery.VerificationError).Reason, gc.Equals, bakery.ErrNoMacaroons)
+
+	// A macaroon minted elsewhere is ignored.
+	m, err := macaroon.New([]byte("another key that is at least 32 bytes long"), "id", "loc")
+	c.Assert(err, gc.IsNil)
+	req.AddClientMacaroon(m)
+	err = req.Check()
+	c.Assert(err, gc.ErrorMatches, "verification failed: no possible macaroons found")
+	c.Assert(err.(*bakery.VerificationError).Reason, gc.Equals, bakery.ErrNoMacaroons)
+}
+
+func (*ServiceSuite) TestCheckFirstPartyCaveatError(c *gc.C) {
+	svc := newService(c, "loc", nil)
+	m, err := svc.NewMacaroon("", nil, []bakery.Caveat{{
+		Condition: "ok",
+	}, {
+		Condition: "not ok",
+	}})
+	c.Assert(err, gc.IsNil)
+	req := svc.NewRequest(bakery.FirstPartyCheckerFunc(checkCondition))
+	req.AddClientMacaroon(m)
+	err = req.Check()
+	c.Assert(err, gc.ErrorMatches, `verification failed: condition "not ok" not met`)
+	reason, ok := err.(*bakery.VerificationError).Reason.(*macaroon.CaveatError)
+	c.Assert(ok, gc.Equals, true)
+	c.Assert(reason.Index, gc.Equals, 1)
+	c.Assert(reason.Condition, gc.Equals, "not ok")
+	c.Assert(reason.InDischarge, gc.Equals, false)
+}
+
+func (*ServiceSuite) TestCheckRequiresDefaultAlgorithm(c *gc.C) {
+	svc := newService(c, "loc", nil)
+	rootKey := make([]byte, 32)
+	_, err := svc.NewMacaroon("some-id", rootKey, nil)
+	c.Assert(err, gc.IsNil)
+
+	// A macaroon with the same id and root key that uses
+	// another algorithm is rejected.
+	m, err := macaroon.NewWithAlgorithm(macaroon.BLAKE2b, rootKey, []byte("some-id"), "loc")
+	c.Assert(err, gc.IsNil)
+	req := svc.NewRequest(bakery.FirstPartyCheckerFunc(checkCondition))
+	req.AddClientMacaroon(m)
+	err = req.Check()
+	c.Assert(err, gc.ErrorMatches, `verification failed: macaroon "some-id" uses algorithm blake2b, not hmac-sha256`)
+	c.Assert(err.(*bakery.VerificationError).Reason, gc.FitsTypeOf, (*macaroon.AlgorithmMismatchError)(nil))
+}
+
+func (*ServiceSuite) TestCheckDischargeNotFound(c *gc.C) {
+	thirdPartyKey, err := bakery.GenerateKey()
+	c.Assert(err, gc.IsNil)
+	svc := newService(c, "loc", bakery.PublicKeyLocatorMap{
+		"other": &thirdPartyKey.Public,
+	})
+	m, err := svc.NewMacaroon("", nil, []bakery.Caveat{{
+		Location:  "other",
+		Condition: "something",
+	}})
+	c.Assert(err, gc.IsNil)
+	req := svc.NewRequest(bakery.FirstPartyCheckerFunc(checkCondition))
+	req.AddClientMacaroon(m)
+	err = req.Check()
+	reason, ok := err.(*bakery.VerificationError).Reason.(*macaroon.DischargeNotFoundError)
+	c.Assert(ok, gc.Equals, true)
+	c.Assert(reason.Location, gc.Equals, "other")
+	c.Assert(reason.CaveatId, gc.Equals, m.Caveats()[0].Id)
+}
+
+func (*ServiceSuite) TestDeterministicRand(c *gc.C) {
+	thirdPartyKey, err := bakery.GenerateKey()
+	c.Assert(err, gc.IsNil)
+	newMacaroon := func(seed int64) []byte {
+		svc, err := bakery.NewService(bakery.NewServiceParams{
+			Location: "loc",
+			Locator: bakery.PublicKeyLocatorMap{
+				"other": &thirdPartyKey.Public,
+			},
+			Rand: rand.New(rand.NewSource(seed)),
+		})
+		c.Assert(err, gc.IsNil)
+		m, err := svc.NewMacaroon("", nil, []bakery.Caveat{{
+			Location:  "other",
+			Condition: "something",
+		}})
+		c.Assert(err, gc.IsNil)
+		data, err := m.MarshalBinary()
+		c.Assert(err, gc.IsNil)
+		return data
+	}
+	data := newMacaroon(1)
+	c.Assert(newMacaroon(1), gc.DeepEquals, data)
+	c.Assert(newMacaroon(2), gc.Not(gc.DeepEquals), data)
+}
+
+func (*ServiceSuite) TestAddCaveatLeavesMacaroonRand(c *gc.C) {
+	thirdPartyKey, err := bakery.GenerateKey()
+	c.Assert(err, gc.IsNil)
+	svc, err := bakery.NewService(bakery.NewServiceParams{
+		Location: "loc",
+		Locator: bakery.PublicKeyLocatorMap{
+			"other": &thirdPartyKey.Public,
+		},
+	})
+	c.Assert(err, gc.IsNil)
+	m, err := macaroon.New([]byte("a secret root key of at least 32 bytes"), "id", "loc")
+	c.Assert(err, gc.IsNil)
+	m.SetRand(errorReader{})
+	err = svc.AddCaveat(m, bakery.Caveat{
+		Location:  "other",
+		Condition: "something",
+	})
+	c.Assert(err, gc.IsNil)
+
+	// The service's source of randomness was used for the
+	// caveat, but the macaroon still uses its own.
+	err = m.AddThirdPartyCaveat([]byte("another secret root key of at least 32 bytes"), "caveat", "somewhere")
+	c.Assert(err, gc.ErrorMatches, "cannot generate random bytes: fail")
+}
+
+// errorReader is an io.Reader that always fails.
+type errorReader struct{}
+
+func (errorReader) Read([]byte) (int, error) {
+	return 0, fmt.Errorf("fail")
+}
+
+func (*ServiceSuite) TestNewMacaroonExpiry(c *gc.C) {
+	store := bakery.NewMemStorageWithExpiry()
+	svc, err := bakery.NewService(bakery.NewServiceParams{
+		Location: "loc",
+		Store:    store,
+	})
+	c.Assert(err, gc.IsNil)
+	now := time.Now()
+	var clock time.Time
+	bakery.SetMemStorageClock(store, func() time.Time {
+		return clock
+	})
+	check := checkers.PushFirstPartyChecker(checkers.Std, bakery.FirstPartyCheckerFunc(checkCondition))
+
+	tests := []struct {
+		about   string
+		caveats []bakery.Caveat
+		expiry  time.Time
+		expect  time.Time
+	}{{
+		about: "no expiry",
+	}, {
+		about:   "time-before caveat",
+		caveats: []bakery.Caveat{checkers.TimeBefore(now.Add(time.Hour))},
+		expect:  now.Add(time.Hour),
+	}, {
+		about: "earliest time-before caveat",
+		caveats: []bakery.Caveat{
+			checkers.TimeBefore(now.Add(2 * time.Hour)),
+			checkers.FirstParty("ok"),
+			checkers.TimeBefore(now.Add(time.Hour)),
+		},
+		expect: now.Add(time.Hour),
+	}, {
+		about:  "explicit expiry",
+		expiry: now.Add(time.Hour),
+		expect: now.Add(time.Hour),
+	}, {
+		about:   "explicit expiry before caveat",
+		caveats: []bakery.Caveat{checkers.TimeBefore(now.Add(2 * time.Hour))},
+		expiry:  now.Add(time.Hour),
+		expect:  now.Add(time.Hour),
+	}, {
+		about:   "explicit expiry overrides caveat",
+		caveats: []bakery.Caveat{checkers.TimeBefore(now.Add(time.Hour))},
+		expiry:  now.Add(2 * time.Hour),
+		expect:  now.Add(2 * time.Hour),
+	}}
+	for i, test := range tests {
+		c.Logf("test %d: %s", i, test.about)
+		clock = now
+		var m *macaroon.Macaroon
+		if test.expiry.IsZero() {
+			m, err = svc.NewMacaroon("", nil, test.caveats)
+		} else {
+			m, err = svc.NewMacaroonWithExpiry("", nil, test.caveats, test.expiry)
+		}
+		c.Assert(err, gc.IsNil)
+		req := svc.NewRequest(check)
+		req.AddClientMacaroon(m)
+		c.Assert(req.Check(), gc.IsNil)
+
+		// Just before the expected expiry time, the
+		// root key is still available.
+		if !test.expect.IsZero() {
+			clock = test.expect.Add(-time.Second)
+		} else {
+			clock = now.Add(1000 * time.Hour)
+		}
+		_, err = store.Get(m.Id())
+		c.Assert(err, gc.IsNil)
+		if test.expect.IsZero() {
+			continue
+		}
+		// The RFC3339 format used by time-before
+		// caveats has a resolution of one second.
+		clock = test.expect.Add(time.Second)
+		_, err = store.Get(m.Id())
+		c.Assert(err, gc.Equals, bakery.ErrNotFound)
+	}
+}
+
+func (*ServiceSuite) TestCheckIgnoresExpiredRootKey(c *gc.C) {
+	store := bakery.NewMemStorageWithExpiry()
+	svc, err := bakery.NewService(bakery.NewServiceParams{
+		Location: "loc",
+		Store:    store,
+	})
+	c.Assert(err, gc.IsNil)
+	now := time.Now()
+	m, err := svc.NewMacaroonWithExpiry("", nil, nil, now.Add(time.Minute))
+	c.Assert(err, gc.IsNil)
+
+	// The root key is not returned once it has expired
+	// according to the service's clock, even if the
+	// storage has not yet discarded it.
+	bakery.SetServiceClock(svc, func() time.Time {
+		return now.Add(2 * time.Minute)
+	})
+	bakery.SetMemStorageClock(store, func() time.Time {
+		return time.Time{}
+	})
+	req := svc.NewRequest(bakery.FirstPartyCheckerFunc(checkCondition))
+	req.AddClientMacaroon(m)
+	err = req.Check()
+	c.Assert(err, gc.FitsTypeOf, (*bakery.VerificationError)(nil))
+	c.Assert(err.(*bakery.VerificationError).Reason, gc.Equals, bakery.ErrNoMacaroons)
+}
+
+// countingStorage wraps a Storage and records
+// the locations passed to its Get and GetMulti
+// methods.
+type countingStorage struct {
+	bakery.Storage
+	gets      []string
+	getMultis [][]string
+	getErr    error
+}
+
+func (s *countingStorage) Get(location string) (string, error) {
+	s.gets = append(s.gets, location)
+	if s.getErr != nil {
+		return "", s.getErr
+	}
+	return s.Storage.Get(location)
+}
+
+// batchStorage adds a GetMulti method to countingStorage.
+type batchStorage struct {
+	*countingStorage
+}
+
+func (s batchStorage) GetMulti(locations []string) (map[string]string, error) {
+	s.getMultis = append(s.getMultis, locations)
+	if s.getErr != nil {
+		return nil, s.getErr
+	}
+	return s.Storage.(bakery.BatchStorage).GetMulti(locations)
+}
+
+func (*ServiceSuite) TestCheckBatchesLookups(c *gc.C) {
+	cstore := &countingStorage{
+		Storage: bakery.NewMemStorage(),
+	}
+	svc, err := bakery.NewService(bakery.NewServiceParams{
+		Location: "loc",
+		Store:    batchStorage{cstore},
+	})
+	c.Assert(err, gc.IsNil)
+	m0, err := svc.NewMacaroon("id0", nil, []bakery.Caveat{{Condition: "not ok"}})
+	c.Assert(err, gc.IsNil)
+	m1, err := svc.NewMacaroon("id1", nil, []bakery.Caveat{{Condition: "ok"}})
+	c.Assert(err, gc.IsNil)
+	other, err := macaroon.New([]byte("another key that is at least 32 bytes long"), "other", "loc")
+	c.Assert(err, gc.IsNil)
+
+	req := svc.NewRequest(bakery.FirstPartyCheckerFunc(checkCondition))
+	req.AddClientMacaroon(m0)
+	req.AddClientMacaroon(other)
+	c.Assert(cstore.getMultis, gc.HasLen, 0)
+	err = req.Check()
+	c.Assert(err, gc.ErrorMatches, `verification failed: condition "not ok" not met`)
+	c.Assert(cstore.getMultis, gc.DeepEquals, [][]string{{"id0", "other"}})
+
+	// Only macaroons that have not been looked
+	// up already are looked up.
+	req.AddClientMacaroon(m1)
+	err = req.Check()
+	c.Assert(err, gc.IsNil)
+	err = req.Check()
+	c.Assert(err, gc.IsNil)
+	c.Assert(cstore.getMultis, gc.DeepEquals, [][]string{{"id0", "other"}, {"id1"}})
+	c.Assert(cstore.gets, gc.HasLen, 0)
+}
+
+func (*ServiceSuite) TestCheckWithoutBatchStorage(c *gc.C) {
+	cstore := &countingStorage{
+		Storage: bakery.NewMemStorage(),
+	}
+	svc, err := bakery.NewService(bakery.NewServiceParams{
+		Location: "loc",
+		Store:    cstore,
+	})
+	c.Assert(err, gc.IsNil)
+	m, err := svc.NewMacaroon("id", nil, []bakery.Caveat{{Condition: "ok"}})
+	c.Assert(err, gc.IsNil)
+	req := svc.NewRequest(bakery.FirstPartyCheckerFunc(checkCondition))
+	req.AddClientMacaroon(m)
+	c.Assert(cstore.gets, gc.HasLen, 0)
+	err = req.Check()
+	c.Assert(err, gc.IsNil)
+	c.Assert(cstore.gets, gc.DeepEquals, []string{"id"})
+}
+
+func (*ServiceSuite) TestCheckRetriesAfterStorageError(c *gc.C) {
+	cstore := &countingStorage{
+		Storage: bakery.NewMemStorage(),
+	}
+	svc, err := bakery.NewService(bakery.NewServiceParams{
+		Location: "loc",
+		Store:    batchStorage{cstore},
+	})
+	c.Assert(err, gc.IsNil)
+	m, err := svc.NewMacaroon("id", nil, []bakery.Caveat{{Condition: "ok"}})
+	c.Assert(err, gc.IsNil)
+	req := svc.NewRequest(bakery.FirstPartyCheckerFunc(checkCondition))
+	req.AddClientMacaroon(m)
+
+	cstore.getErr = fmt.Errorf("storage unavailable")
+	err = req.Check()
+	c.Assert(err, gc.FitsTypeOf, (*bakery.VerificationError)(nil))
+	c.Assert(err.(*bakery.VerificationError).Reason, gc.Equals, bakery.ErrNoMacaroons)
+
+	cstore.getErr = nil
+	err = req.Check()
+	c.Assert(err, gc.IsNil)
+	c.Assert(cstore.getMultis, gc.HasLen, 2)
+}
+
+func (*ServiceSuite) TestSharedRootKeys(c *gc.C) {
+	store := bakery.NewMemStorageWithExpiry()
+	svc, err := bakery.NewService(bakery.NewServiceParams{
+		Location: "loc",
+		Store:    store,
+		RootKeys: &bakery.RootKeyPolicy{
+			GenerateInterval: time.Minute,
+			ExpiryDuration:   time.Hour,
+		},
+	})
+	c.Assert(err, gc.IsNil)
+	now := time.Now()
+	clock := func() time.Time {
+		return now
+	}
+	bakery.SetServiceClock(svc, clock)
+	bakery.SetMemStorageClock(store, clock)
+
+	// Macaroons minted within the generation interval
+	// share a single root key.
+	m0, err := svc.NewMacaroon("id0", nil, []bakery.Caveat{{Condition: "ok"}})
+	c.Assert(err, gc.IsNil)
+	now = now.Add(30 * time.Second)
+	m1, err := svc.NewMacaroon("", nil, []bakery.Caveat{{Condition: "ok"}})
+	c.Assert(err, gc.IsNil)
+	c.Assert(m0.Id(), gc.Matches, `rk:[0-9a-f]+:id0`)
+	c.Assert(m1.Id()[:len(m0.Id())-len("id0")], gc.Equals, m0.Id()[:len(m0.Id())-len("id0")])
+	c.Assert(bakery.MemStorageLen(store), gc.Equals, 1)
+
+	// A new root key is generated after the interval.
+	now = now.Add(time.Minute)
+	m2, err := svc.NewMacaroon("id2", nil, []bakery.Caveat{{Condition: "ok"}})
+	c.Assert(err, gc.IsNil)
+	c.Assert(m2.Id(), gc.Not(gc.Matches), m0.Id()[:len(m0.Id())-len("id0")]+".*")
+	c.Assert(bakery.MemStorageLen(store), gc.Equals, 2)
+
+	for i, m := range []*macaroon.Macaroon{m0, m1, m2} {
+		c.Logf("test %d", i)
+		req := svc.NewRequest(bakery.FirstPartyCheckerFunc(checkCondition))
+		req.AddClientMacaroon(m)
+		c.Assert(req.Check(), gc.IsNil)
+	}
+
+	// The first root key expires an hour after it
+	// was generated; the second one is still valid.
+	now = now.Add(time.Hour - time.Minute)
+	for i, test := range []struct {
+		m      *macaroon.Macaroon
+		expect error
+	}{{m0, bakery.ErrNoMacaroons}, {m1, bakery.ErrNoMacaroons}, {m2, nil}} {
+		c.Logf("test %d", i)
+		req := svc.NewRequest(bakery.FirstPartyCheckerFunc(checkCondition))
+		req.AddClientMacaroon(test.m)
+		err := req.Check()
+		if test.expect == nil {
+			c.Assert(err, gc.IsNil)
+		} else {
+			c.Assert(err, gc.FitsTypeOf, (*bakery.VerificationError)(nil))
+			c.Assert(err.(*bakery.VerificationError).Reason, gc.Equals, test.expect)
+		}
+	}
+	c.Assert(store.Purge(), gc.IsNil)
+	c.Assert(bakery.MemStorageLen(store), gc.Equals, 1)
+}
+
+func (*ServiceSuite) TestSharedRootKeysCached(c *gc.C) {
+	cstore := &countingStorage{
+		Storage: bakery.NewMemStorage(),
+	}
+	policy := &bakery.RootKeyPolicy{
+		GenerateInterval: time.Minute,
+	}
+	svc0, err := bakery.NewService(bakery.NewServiceParams{
+		Location: "loc",
+		Store:    batchStorage{cstore},
+		RootKeys: policy,
+	})
+	c.Assert(err, gc.IsNil)
+	m0, err := svc0.NewMacaroon("id0", nil, []bakery.Caveat{{Condition: "ok"}})
+	c.Assert(err, gc.IsNil)
+	m1, err := svc0.NewMacaroon("id1", nil, []bakery.Caveat{{Condition: "ok"}})
+	c.Assert(err, gc.IsNil)
+
+	// The minting service already knows the root key.
+	req := svc0.NewRequest(bakery.FirstPartyCheckerFunc(checkCondition))
+	req.AddClientMacaroon(m0)
+	c.Assert(req.Check(), gc.IsNil)
+	c.Assert(cstore.getMultis, gc.HasLen, 0)
+
+	// Another service sharing the storage reads the root
+	// key once, even for several macaroons.
+	svc1, err := bakery.NewService(bakery.NewServiceParams{
+		Location: "loc",
+		Store:    batchStorage{cstore},
+		RootKeys: policy,
+	})
+	c.Assert(err, gc.IsNil)
+	req = svc1.NewRequest(bakery.FirstPartyCheckerFunc(checkCondition))
+	req.AddClientMacaroon(m0)
+	req.AddClientMacaroon(m1)
+	c.Assert(req.Check(), gc.IsNil)
+	c.Assert(cstore.getMultis, gc.HasLen, 1)
+	c.Assert(cstore.getMultis[0], gc.HasLen, 1)
+	c.Assert(cstore.getMultis[0][0], gc.Matches, `root-key:[0-9a-f]+`)
+
+	req = svc1.NewRequest(bakery.FirstPartyCheckerFunc(checkCondition))
+	req.AddClientMacaroon(m1)
+	c.Assert(req.Check(), gc.IsNil)
+	c.Assert(cstore.getMultis, gc.HasLen, 1)
+	c.Assert(cstore.gets, gc.HasLen, 0)
+}
+
+func (*ServiceSuite) TestSharedRootKeysWithExplicitRootKey(c *gc.C) {
+	store := bakery.NewMemStorage()
+	svc, err := bakery.NewService(bakery.NewServiceParams{
+		Location: "loc",
+		Store:    store,
+		RootKeys: &bakery.RootKeyPolicy{
+			GenerateInterval: time.Minute,
+		},
+	})
+	c.Assert(err, gc.IsNil)
+
+	// A macaroon with an explicit root key is
+	// stored under its own id, as before.
+	m, err := svc.NewMacaroon("id", []byte("a root key that is at least 32 bytes long"), []bakery.Caveat{{Condition: "ok"}})
+	c.Assert(err, gc.IsNil)
+	c.Assert(m.Id(), gc.Equals, "id")
+	_, err = store.Get("id")
+	c.Assert(err, gc.IsNil)
+
+	req := svc.NewRequest(bakery.FirstPartyCheckerFunc(checkCondition))
+	req.AddClientMacaroon(m)
+	c.Assert(req.Check(), gc.IsNil)
+}
+
+func (*ServiceSuite) TestRootKeyPolicyValidation(c *gc.C) {
+	for i, test := range []struct {
+		policy      bakery.RootKeyPolicy
+		expectError string
+	}{{
+		policy:      bakery.RootKeyPolicy{},
+		expectError: "root key generation interval must be positive",
+	}, {
+		policy: bakery.RootKeyPolicy{
+			GenerateInterval: time.Hour,
+			ExpiryDuration:   time.Minute,
+		},
+		expectError: "root key expiry duration 1m0s is less than twice the generation interval 1h0m0s",
+	}, {
+		policy: bakery.RootKeyPolicy{
+			GenerateInterval: time.Hour,
+			ExpiryDuration:   time.Hour,
+		},
+		expectError: "root key expiry duration 1h0m0s is less than twice the generation interval 1h0m0s",
+	}, {
+		policy: bakery.RootKeyPolicy{
+			GenerateInterval: time.Hour,
+			ExpiryDuration:   2*time.Hour - 1,
+		},
+		expectError: "root key expiry duration 1h59m59.999999999s is less than twice the generation interval 1h0m0s",
+	}, {
+		policy: bakery.RootKeyPolicy{
+			GenerateInterval: time.Hour,
+			ExpiryDuration:   2 * time.Hour,
+		},
+	}, {
+		policy: bakery.RootKeyPolicy{
+			GenerateInterval: time.Hour,
+		},
+	}} {
+		c.Logf("test %d", i)
+		policy := test.policy
+		_, err := bakery.NewService(bakery.NewServiceParams{
+			RootKeys: &policy,
+		})
+		if test.expectError == "" {
+			c.Assert(err, gc.IsNil)
+		} else {
+			c.Assert(err, gc.ErrorMatches, test.expectError)
+		}
+	}
+}
+
+func (*ServiceSuite) TestStatelessMacaroons(c *gc.C) {
+	cstore := &countingStorage{
+		Storage: bakery.NewMemStorage(),
+	}
+	secret := &[bakery.KeyLen]byte{1}
+	svc, err := bakery.NewService(bakery.NewServiceParams{
+		Location:     "loc",
+		Store:        batchStorage{cstore},
+		MasterSecret: secret,
+	})
+	c.Assert(err, gc.IsNil)
+	m, err := svc.NewMacaroon("id", nil, []bakery.Caveat{{Condition: "ok"}})
+	c.Assert(err, gc.IsNil)
+	c.Assert(m.Id(), gc.Matches, `sk:[a-zA-Z0-9_=-]+:id`)
+
+	// A macaroon with an explicit root key is stored as usual.
+	m1, err := svc.NewMacaroon("id1", []byte("a root key that is at least 32 bytes long"), []bakery.Caveat{{Condition: "ok"}})
+	c.Assert(err, gc.IsNil)
+	c.Assert(m1.Id(), gc.Equals, "id1")
+	c.Assert(bakery.MemStorageLen(cstore.Storage.(*bakery.MemStorage)), gc.Equals, 1)
+
+	req := svc.NewRequest(bakery.FirstPartyCheckerFunc(checkCondition))
+	req.AddClientMacaroon(m)
+	c.Assert(req.Check(), gc.IsNil)
+	c.Assert(cstore.getMultis, gc.HasLen, 0)
+	c.Assert(cstore.gets, gc.HasLen, 0)
+
+	req = svc.NewRequest(bakery.FirstPartyCheckerFunc(checkCondition))
+	req.AddClientMacaroon(m1)
+	c.Assert(req.Check(), gc.IsNil)
+	c.Assert(cstore.getMultis, gc.DeepEquals, [][]string{{"id1"}})
+
+	// Another service with the same master secret
+	// and no storage in common can verify the macaroon.
+	svc1, err := bakery.NewService(bakery.NewServiceParams{
+		Location:     "loc",
+		MasterSecret: secret,
+	})
+	c.Assert(err, gc.IsNil)
+	req = svc1.NewRequest(bakery.FirstPartyCheckerFunc(checkCondition))
+	req.AddClientMacaroon(m)
+	c.Assert(req.Check(), gc.IsNil)
+}
+
+func (*ServiceSuite) TestStatelessMacaroonSecretRotation(c *gc.C) {
+	oldSecret := &[bakery.KeyLen]byte{1}
+	newSecret := &[bakery.KeyLen]byte{2}
+	svc, err := bakery.NewService(bakery.NewServiceParams{
+		Location:     "loc",
+		MasterSecret: oldSecret,
+	})
+	c.Assert(err, gc.IsNil)
+	m, err := svc.NewMacaroon("", nil, []bakery.Caveat{{Condition: "ok"}})
+	c.Assert(err, gc.IsNil)
+
+	for i, test := range []struct {
+		secret      *[bakery.KeyLen]byte
+		oldSecrets  []*[bakery.KeyLen]byte
+		expectError bool
+	}{{
+		secret:     newSecret,
+		oldSecrets: []*[bakery.KeyLen]byte{oldSecret},
+	}, {
+		secret:      newSecret,
+		expectError: true,
+	}, {
+		secret:      newSecret,
+		oldSecrets:  []*[bakery.KeyLen]byte{{3}},
+		expectError: true,
+	}} {
+		c.Logf("test %d", i)
+		svc, err := bakery.NewService(bakery.NewServiceParams{
+			Location:         "loc",
+			MasterSecret:     test.secret,
+			OldMasterSecrets: test.oldSecrets,
+		})
+		c.Assert(err, gc.IsNil)
+		req := svc.NewRequest(bakery.FirstPartyCheckerFunc(checkCondition))
+		req.AddClientMacaroon(m)
+		err = req.Check()
+		if !test.expectError {
+			c.Assert(err, gc.IsNil)
+			continue
+		}
+		c.Assert(err, gc.FitsTypeOf, (*bakery.VerificationError)(nil))
+		c.Assert(err.(*bakery.VerificationError).Reason, gc.Equals, bakery.ErrNoMacaroons)
+	}
+}
+
+func (*ServiceSuite) TestStatelessMacaroonExpiry(c *gc.C) {
+	svc, err := bakery.NewService(bakery.NewServiceParams{
+		Location:     "loc",
+		MasterSecret: &[bakery.KeyLen]byte{1},
+	})
+	c.Assert(err, gc.IsNil)
+	now := time.Now()
+	bakery.SetServiceClock(svc, func() time.Time {
+		return now
+	})
+	m, err := svc.NewMacaroonWithExpiry("", nil, []bakery.Caveat{{Condition: "ok"}}, now.Add(time.Minute))
+	c.Assert(err, gc.IsNil)
+
+	req := svc.NewRequest(bakery.FirstPartyCheckerFunc(checkCondition))
+	req.AddClientMacaroon(m)
+	c.Assert(req.Check(), gc.IsNil)
+
+	now = now.Add(time.Minute)
+	err = req.Check()
+	c.Assert(err, gc.FitsTypeOf, (*bakery.VerificationError)(nil))
+	c.Assert(err.(*bakery.VerificationError).Reason, gc.Equals, bakery.ErrNoMacaroons)
+}
+
+func (*ServiceSuite) TestStatelessMacaroonBadId(c *gc.C) {
+	store := bakery.NewMemStorage()
+	svc, err := bakery.NewService(bakery.NewServiceParams{
+		Location:     "loc",
+		Store:        store,
+		MasterSecret: &[bakery.KeyLen]byte{1},
+	})
+	c.Assert(err, gc.IsNil)
+
+	// A macaroon stored by an earlier version with an id
+	// that looks like a stateless macaroon id is still
+	// found in storage.
+	m := storeMacaroon(c, store, "sk:notsealed:id")
+	req := svc.NewRequest(bakery.FirstPartyCheckerFunc(checkCondition))
+	req.AddClientMacaroon(m)
+	c.Assert(req.Check(), gc.IsNil)
+
+	// A macaroon whose sealed root key has been
+	// changed is not verified.
+	m, err = svc.NewMacaroon("id", nil, []bakery.Caveat{{Condition: "ok"}})
+	c.Assert(err, gc.IsNil)
+	id := []byte(m.Id())
+	id[10] ^= 1
+	assertNotVerified(c, svc, string(id))
+
+	// Neither is one whose sealed header (the version and
+	// master secret identifier) has been changed.
+	parts := strings.SplitN(m.Id(), ":", 3)
+	sealed, err := base64.URLEncoding.DecodeString(parts[1])
+	c.Assert(err, gc.IsNil)
+	for i := 0; i < 5; i++ {
+		c.Logf("header byte %d", i)
+		data := append([]byte(nil), sealed...)
+		data[i] ^= 1
+		assertNotVerified(c, svc, "sk:"+base64.URLEncoding.EncodeToString(data)+":id")
+	}
+}
+
+// assertNotVerified asserts that a macaroon with the given
+// id, minted with an arbitrary root key, is not verified
+// by svc.
+func assertNotVerified(c *gc.C, svc *bakery.Service, id string) {
+	forged, err := macaroon.New([]byte("another key that is at least 32 bytes long"), id, "loc")
+	c.Assert(err, gc.IsNil)
+	req := svc.NewRequest(bakery.FirstPartyCheckerFunc(checkCondition))
+	req.AddClientMacaroon(forged)
+	err = req.Check()
+	c.Assert(err, gc.FitsTypeOf, (*bakery.VerificationError)(nil))
+	c.Assert(err.(*bakery.VerificationError).Reason, gc.Equals, bakery.ErrNoMacaroons)
+}
+
+// storeMacaroon mints a macaroon with the given id and
+// stores its root key directly in store, as an earlier
+// version of the service that did not reserve any id
+// prefixes might have done.
+func storeMacaroon(c *gc.C, store bakery.Storage, id string) *macaroon.Macaroon {
+	rootKey := []byte("a root key that is at least 32 bytes long")
+	m, err := macaroon.New(rootKey, id, "loc")
+	c.Assert(err, gc.IsNil)
+	item, err := json.Marshal(struct{ RootKey []byte }{rootKey})
+	c.Assert(err, gc.IsNil)
+	err = store.Put(id, string(item))
+	c.Assert(err, gc.IsNil)
+	return m
+}
+
+func (*ServiceSuite) TestReservedIdPrefixes(c *gc.C) {
+	svc, err := bakery.NewService(bakery.NewServiceParams{
+		Location: "loc",
+	})
+	c.Assert(err, gc.IsNil)
+	for _, id := range []string{"rk:key:id", "sk:x:id", "root-key:key"} {
+		_, err := svc.NewMacaroon(id, nil, nil)
+		c.Assert(err, gc.ErrorMatches, `macaroon id ".*" has reserved prefix ".*"`)
+	}
+}
+
+func (*ServiceSuite) TestSharedKeyIdWithoutRootKeyPolicy(c *gc.C) {
+	store := bakery.NewMemStorage()
+	svc, err := bakery.NewService(bakery.NewServiceParams{
+		Location: "loc",
+		Store:    store,
+	})
+	c.Assert(err, gc.IsNil)
+
+	// Without a root key policy, a macaroon stored by an
+	// earlier version with an id that looks like a shared
+	// key macaroon id is found under its own id.
+	m := storeMacaroon(c, store, "rk:key:id")
+	req := svc.NewRequest(bakery.FirstPartyCheckerFunc(checkCondition))
+	req.AddClientMacaroon(m)
+	c.Assert(req.Check(), gc.IsNil)
+}
+
+func (*ServiceSuite) TestMasterSecretErrors(c *gc.C) {
+	_, err := bakery.NewService(bakery.NewServiceParams{
+		MasterSecret: &[bakery.KeyLen]byte{1},
+		RootKeys: &bakery.RootKeyPolicy{
+			GenerateInterval: time.Minute,
+		},
+	})
+	c.Assert(err, gc.ErrorMatches, "cannot use both shared root keys and a master secret")
+	_, err = bakery.NewService(bakery.NewServiceParams{
+		OldMasterSecrets: []*[bakery.KeyLen]byte{{1}},
+	})
+	c.Assert(err, gc.ErrorMatches, "old master secrets provided without a master secret")
+}
@@ -0,0 +1,155 @@
+package bakery
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/nacl/secretbox"
+)
+
+const (
+	// statelessIdPrefix holds the prefix of the id of a
+	// stateless macaroon. The prefix is followed by the
+	// base64-encoded sealed root key, a colon and the
+	// rest of the macaroon id.
+	statelessIdPrefix = "sk:"
+
+	// statelessVersion holds the version of the format
+	// of the sealed root key in a stateless macaroon id.
+	statelessVersion = 1
+
+	// secretIdLen holds the length of the identifier of
+	// a master secret in a sealed root key.
+	secretIdLen = 4
+
+	// headerLen holds the length of the header of a sealed
+	// root key: the version and the master secret identifier.
+	headerLen = 1 + secretIdLen
+)
+
+// masterSecrets holds the master secrets used to seal
+// and open the root keys of stateless macaroons.
+type masterSecrets struct {
+	// secrets holds the keys derived from all the master
+	// secrets. The first is used to seal new root keys;
+	// all are used to open them.
+	secrets []*sealKey
+	rand    io.Reader
+}
+
+// sealKey holds the keys derived from a master secret.
+type sealKey struct {
+	// header holds the header of the root keys sealed
+	// with the secret.
+	header [headerLen]byte
+
+	// key holds the secretbox key, which is bound
+	// to the header so that the header cannot be
+	// changed without the sealed data failing to open.
+	key [KeyLen]byte
+}
+
+func newMasterSecrets(current *[KeyLen]byte, old []*[KeyLen]byte, rand io.Reader) *masterSecrets {
+	s := &masterSecrets{
+		rand: rand,
+	}
+	for _, secret := range append([]*[KeyLen]byte{current}, old...) {
+		s.secrets = append(s.secrets, newSealKey(secret))
+	}
+	return s
+}
+
+// newSealKey derives the keys used to seal root keys from
+// the given master secret. The master secret is never used
+// directly, so it can safely be used for other purposes too.
+func newSealKey(secret *[KeyLen]byte) *sealKey {
+	var k sealKey
+	k.header[0] = statelessVersion
+	copy(k.header[1:], deriveSecret(secret, []byte("bakery stateless secret id")))
+	purpose := append([]byte("bakery stateless root key\x00"), k.header[:]...)
+	copy(k.key[:], deriveSecret(secret, purpose))
+	return &k
+}
+
+// deriveSecret returns a secret derived from the given
+// master secret for the given purpose.
+func deriveSecret(secret *[KeyLen]byte, purpose []byte) []byte {
+	h := hmac.New(sha256.New, secret[:])
+	h.Write(purpose)
+	return h.Sum(nil)
+}
+
+// seal returns the id of a stateless macaroon with the given id
+// whose root key and expiry time are held in item. The sealed data
+// holds the version, the identifier of the master secret, a
+// nonce and the root key and expiry encrypted with secretbox
+// using a key derived from the master secret and the header.
+func (s *masterSecrets) seal(id string, item *storageItem) (string, error) {
+	var nonce [NonceLen]byte
+	if _, err := io.ReadFull(s.rand, nonce[:]); err != nil {
+		return "", fmt.Errorf("cannot generate random number for nonce: %v", err)
+	}
+	plain := make([]byte, 8, 8+len(item.RootKey))
+	if !item.Expiry.IsZero() {
+		binary.BigEndian.PutUint64(plain, uint64(item.Expiry.UnixNano()))
+	}
+	plain = append(plain, item.RootKey...)
+
+	key := s.secrets[0]
+	data := append([]byte(nil), key.header[:]...)
+	data = append(data, nonce[:]...)
+	data = secretbox.Seal(data, plain, &nonce, &key.key)
+	return statelessIdPrefix + base64.URLEncoding.EncodeToString(data) + ":" + id, nil
+}
+
+// open returns the root key and expiry time sealed in the
+// given macaroon id. It returns an error if the id was not
+// created by seal with one of the master secrets.
+func (s *masterSecrets) open(macaroonId string) (*storageItem, error) {
+	if !strings.HasPrefix(macaroonId, statelessIdPrefix) {
+		return nil, fmt.Errorf("not a stateless macaroon id")
+	}
+	rest := macaroonId[len(statelessIdPrefix):]
+	i := strings.Index(rest, ":")
+	if i < 0 {
+		return nil, fmt.Errorf("no sealed root key found")
+	}
+	data, err := base64.URLEncoding.DecodeString(rest[:i])
+	if err != nil {
+		return nil, fmt.Errorf("cannot base64-decode sealed root key: %v", err)
+	}
+	if len(data) < headerLen+NonceLen+secretbox.Overhead {
+		return nil, fmt.Errorf("sealed root key too short")
+	}
+	if data[0] != statelessVersion {
+		return nil, fmt.Errorf("unknown sealed root key version %d", data[0])
+	}
+	header, data := data[:headerLen], data[headerLen:]
+	var nonce [NonceLen]byte
+	copy(nonce[:], data)
+	sealed := data[NonceLen:]
+	for _, key := range s.secrets {
+		if !bytes.Equal(key.header[:], header) {
+			continue
+		}
+		plain, ok := secretbox.Open(nil, sealed, &nonce, &key.key)
+		if !ok || len(plain) < 8 {
+			continue
+		}
+		item := &storageItem{
+			RootKey: plain[8:],
+		}
+		if t := binary.BigEndian.Uint64(plain); t != 0 {
+			item.Expiry = time.Unix(0, int64(t))
+		}
+		return item, nil
+	}
+	return nil, fmt.Errorf("cannot decrypt sealed root key")
+}
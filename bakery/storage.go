@@ -4,7 +4,9 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"log"
 	"sync"
+	"time"
 )
 
 // Storage defines storage for macaroons.
@@ -26,50 +28,216 @@ type Storage interface {
 
 var ErrNotFound = errors.New("item not found")
 
+// BatchStorage is implemented by Storage implementations that
+// can retrieve several items at once, for example with a single
+// round trip to a remote database. When a Request is checked,
+// the root keys of all its macaroons are retrieved with GetMulti
+// if the storage implements it.
+type BatchStorage interface {
+	Storage
+
+	// GetMulti retrieves the items from the given locations.
+	// The returned map holds an entry for each location
+	// that holds an item; locations without an item
+	// are omitted.
+	GetMulti(locations []string) (map[string]string, error)
+}
+
+// ExpiryStorage is implemented by Storage implementations that
+// can discard items automatically when they expire. When a
+// Service stores the root key of a macaroon that expires, it
+// uses PutWithExpiry if the storage implements it.
+type ExpiryStorage interface {
+	Storage
+
+	// PutWithExpiry is like Put except that the item
+	// may be deleted at any time after the given expiry
+	// time, and Get will not return it after that time.
+	PutWithExpiry(location string, item string, expiry time.Time) error
+}
+
+// Purger is implemented by Storage implementations that
+// can remove expired items on demand. See NewSweeper.
+type Purger interface {
+	// Purge removes all expired items.
+	Purge() error
+}
+
 // NewMemStorage returns an implementation of Storage
 // that stores all items in memory.
 func NewMemStorage() Storage {
-	return &memStorage{
-		values: make(map[string]string),
+	return NewMemStorageWithExpiry()
+}
+
+// NewMemStorageWithExpiry is like NewMemStorage except
+// that it returns the concrete type, which also implements
+// ExpiryStorage and Purger.
+func NewMemStorageWithExpiry() *MemStorage {
+	return &MemStorage{
+		values: make(map[string]memItem),
+		now:    time.Now,
 	}
 }
 
-type memStorage struct {
-	mu     sync.Mutex
-	values map[string]string
+// MemStorage is an implementation of Storage that stores
+// all items in memory. It implements ExpiryStorage and Purger:
+// expired items are never returned, and they are removed
+// when Purge is called. Use NewSweeper to purge expired
+// items periodically.
+type MemStorage struct {
+	// mu guards the fields following it.
+	mu sync.Mutex
+
+	// now returns the current time.
+	now func() time.Time
+
+	values map[string]memItem
 }
 
-func (s memStorage) Put(location, item string) error {
-	logf("storage.Put[%q] %q", location, item)
+type memItem struct {
+	item string
+
+	// expiry holds the expiry time of the item,
+	// or the zero time if it never expires.
+	expiry time.Time
+}
+
+func (item memItem) expired(now time.Time) bool {
+	return !item.expiry.IsZero() && !now.Before(item.expiry)
+}
+
+// Put implements Storage.Put.
+func (s *MemStorage) Put(location, item string) error {
+	return s.PutWithExpiry(location, item, time.Time{})
+}
+
+// PutWithExpiry implements ExpiryStorage.PutWithExpiry.
+// If expiry is the zero time, the item never expires.
+func (s *MemStorage) PutWithExpiry(location, item string, expiry time.Time) error {
+	logf("storage.Put[%q] %q (expiry %v)", location, item, expiry)
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	s.values[location] = item
+	s.values[location] = memItem{
+		item:   item,
+		expiry: expiry,
+	}
 	return nil
 }
 
-func (s memStorage) Get(location string) (string, error) {
+// Get implements Storage.Get.
+func (s *MemStorage) Get(location string) (string, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 	item, ok := s.values[location]
+	if ok && item.expired(s.now()) {
+		delete(s.values, location)
+		ok = false
+	}
 	if !ok {
 		logf("storage.Get[%q] -> not found", location)
 		return "", ErrNotFound
 	}
-	logf("storage.Get[%q] -> %q", location, item)
-	return item, nil
+	logf("storage.Get[%q] -> %q", location, item.item)
+	return item.item, nil
 }
 
-func (s memStorage) Del(location string) error {
+// GetMulti implements BatchStorage.GetMulti.
+func (s *MemStorage) GetMulti(locations []string) (map[string]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := s.now()
+	items := make(map[string]string)
+	for _, location := range locations {
+		item, ok := s.values[location]
+		if !ok {
+			continue
+		}
+		if item.expired(now) {
+			delete(s.values, location)
+			continue
+		}
+		items[location] = item.item
+	}
+	logf("storage.GetMulti%q -> %d items", locations, len(items))
+	return items, nil
+}
+
+// Del implements Storage.Del.
+func (s *MemStorage) Del(location string) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 	delete(s.values, location)
 	return nil
 }
 
+// Purge implements Purger.Purge.
+func (s *MemStorage) Purge() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := s.now()
+	for location, item := range s.values {
+		if item.expired(now) {
+			delete(s.values, location)
+		}
+	}
+	return nil
+}
+
+// Sweeper periodically removes expired items from a storage.
+type Sweeper struct {
+	stop chan struct{}
+	done chan struct{}
+}
+
+// NewSweeper starts a goroutine that calls p.Purge at the
+// given interval until the returned Sweeper is stopped.
+// Errors from Purge are logged.
+func NewSweeper(p Purger, interval time.Duration) *Sweeper {
+	sw := &Sweeper{
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+	go sw.run(p, interval)
+	return sw
+}
+
+func (sw *Sweeper) run(p Purger, interval time.Duration) {
+	defer close(sw.done)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := p.Purge(); err != nil {
+				log.Printf("cannot purge expired items: %v", err)
+			}
+		case <-sw.stop:
+			return
+		}
+	}
+}
+
+// Stop stops the sweeper and waits for any
+// purge in progress to complete.
+func (sw *Sweeper) Stop() {
+	close(sw.stop)
+	<-sw.done
+}
+
 // storageItem is the format used to store items in
 // the store.
 type storageItem struct {
 	RootKey []byte
+
+	// Expiry holds the time after which the root key
+	// is no longer needed, or the zero time if it is
+	// needed indefinitely.
+	Expiry time.Time
+}
+
+// expired reports whether the item has expired at the given time.
+func (item *storageItem) expired(now time.Time) bool {
+	return !item.Expiry.IsZero() && !now.Before(item.Expiry)
 }
 
 // storage is a thin wrapper around Storage that
@@ -79,15 +247,75 @@ type storage struct {
 	store Storage
 }
 
-func (s storage) Get(location string) (*storageItem, error) {
+// Get returns the item stored at the given location.
+// Items that have expired at the given time are treated
+// as not found.
+func (s storage) Get(location string, now time.Time) (*storageItem, error) {
 	itemStr, err := s.store.Get(location)
 	if err != nil {
 		return nil, err
 	}
+	return s.decode(location, itemStr, now)
+}
+
+// GetMulti returns the items stored at the given locations,
+// keyed by location. Locations without an item, or whose item
+// has expired at the given time, are omitted.
+// It makes a single call to the underlying storage
+// if it implements BatchStorage.
+func (s storage) GetMulti(locations []string, now time.Time) (map[string]*storageItem, error) {
+	var itemStrs map[string]string
+	if bs, ok := s.store.(BatchStorage); ok {
+		var err error
+		itemStrs, err = bs.GetMulti(locations)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		itemStrs = make(map[string]string)
+		for _, location := range locations {
+			itemStr, err := s.store.Get(location)
+			if err == ErrNotFound {
+				continue
+			}
+			if err != nil {
+				return nil, err
+			}
+			itemStrs[location] = itemStr
+		}
+	}
+	items := make(map[string]*storageItem)
+	for location, itemStr := range itemStrs {
+		item, err := s.decode(location, itemStr, now)
+		if err == ErrNotFound {
+			continue
+		}
+		if err != nil {
+			// Don't let one bad item prevent
+			// the others from being used.
+			log.Printf("warning: cannot read item %q: %v", location, err)
+			continue
+		}
+		items[location] = item
+	}
+	return items, nil
+}
+
+// decode decodes the item stored at the given location.
+// It returns ErrNotFound if the item has expired at the given time.
+func (s storage) decode(location, itemStr string, now time.Time) (*storageItem, error) {
 	var item storageItem
 	if err := json.Unmarshal([]byte(itemStr), &item); err != nil {
 		return nil, fmt.Errorf("badly formatted item in store: %v", err)
 	}
+	if item.expired(now) {
+		// The underlying storage may not know about expiry
+		// times, so remove the item ourselves.
+		if err := s.store.Del(location); err != nil {
+			logf("cannot delete expired item %q: %v", location, err)
+		}
+		return nil, ErrNotFound
+	}
 	return &item, nil
 }
 
@@ -96,5 +324,8 @@ func (s storage) Put(location string, item *storageItem) error {
 	if err != nil {
 		panic(fmt.Errorf("cannot marshal storage item: %v", err))
 	}
+	if es, ok := s.store.(ExpiryStorage); ok && !item.Expiry.IsZero() {
+		return es.PutWithExpiry(location, string(data), item.Expiry)
+	}
 	return s.store.Put(location, string(data))
 }
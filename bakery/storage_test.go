@@ -2,6 +2,7 @@ package bakery_test
 
 import (
 	"fmt"
+	"time"
 
 	gc "gopkg.in/check.v1"
 
@@ -60,3 +61,86 @@ func (*StorageSuite) TestConcurrentMemStorage(c *gc.C) {
 		<-done
 	}
 }
+
+func (*StorageSuite) TestMemStorageExpiry(c *gc.C) {
+	store := bakery.NewMemStorageWithExpiry()
+	now := time.Date(2015, 1, 1, 0, 0, 0, 0, time.UTC)
+	bakery.SetMemStorageClock(store, func() time.Time {
+		return now
+	})
+	err := store.PutWithExpiry("a", "a item", now.Add(time.Minute))
+	c.Assert(err, gc.IsNil)
+	err = store.PutWithExpiry("b", "b item", now.Add(time.Hour))
+	c.Assert(err, gc.IsNil)
+	err = store.Put("c", "c item")
+	c.Assert(err, gc.IsNil)
+
+	item, err := store.Get("a")
+	c.Assert(err, gc.IsNil)
+	c.Assert(item, gc.Equals, "a item")
+
+	now = now.Add(time.Minute)
+	_, err = store.Get("a")
+	c.Assert(err, gc.Equals, bakery.ErrNotFound)
+	c.Assert(bakery.MemStorageLen(store), gc.Equals, 2)
+
+	now = now.Add(24 * time.Hour)
+	err = store.Purge()
+	c.Assert(err, gc.IsNil)
+	c.Assert(bakery.MemStorageLen(store), gc.Equals, 1)
+	item, err = store.Get("c")
+	c.Assert(err, gc.IsNil)
+	c.Assert(item, gc.Equals, "c item")
+
+	// Putting an item without an expiry time
+	// removes any existing expiry time.
+	err = store.PutWithExpiry("d", "d item", now)
+	c.Assert(err, gc.IsNil)
+	err = store.Put("d", "d item")
+	c.Assert(err, gc.IsNil)
+	item, err = store.Get("d")
+	c.Assert(err, gc.IsNil)
+	c.Assert(item, gc.Equals, "d item")
+}
+
+func (*StorageSuite) TestSweeper(c *gc.C) {
+	store := bakery.NewMemStorageWithExpiry()
+	for i := 0; i < 10; i++ {
+		err := store.PutWithExpiry(fmt.Sprint(i), "item", time.Now().Add(-time.Second))
+		c.Assert(err, gc.IsNil)
+	}
+	err := store.Put("live", "item")
+	c.Assert(err, gc.IsNil)
+	sw := bakery.NewSweeper(store, time.Millisecond)
+	deadline := time.Now().Add(5 * time.Second)
+	for bakery.MemStorageLen(store) != 1 {
+		if time.Now().After(deadline) {
+			c.Fatalf("expired items not purged; %d items remaining", bakery.MemStorageLen(store))
+		}
+		time.Sleep(time.Millisecond)
+	}
+	sw.Stop()
+
+	// No more items are purged after the
+	// sweeper has been stopped.
+	err = store.PutWithExpiry("dead", "item", time.Now().Add(-time.Second))
+	c.Assert(err, gc.IsNil)
+	time.Sleep(10 * time.Millisecond)
+	c.Assert(bakery.MemStorageLen(store), gc.Equals, 2)
+}
+
+func (*StorageSuite) TestMemStorageGetMulti(c *gc.C) {
+	store := bakery.NewMemStorageWithExpiry()
+	err := store.Put("a", "a item")
+	c.Assert(err, gc.IsNil)
+	err = store.Put("b", "b item")
+	c.Assert(err, gc.IsNil)
+	err = store.PutWithExpiry("c", "c item", time.Now().Add(-time.Second))
+	c.Assert(err, gc.IsNil)
+	items, err := store.GetMulti([]string{"a", "b", "c", "d"})
+	c.Assert(err, gc.IsNil)
+	c.Assert(items, gc.DeepEquals, map[string]string{
+		"a": "a item",
+		"b": "b item",
+	})
+}
@@ -0,0 +1,104 @@
+package macaroon
+
+import (
+	"fmt"
+	"runtime"
+	"sync"
+	"sync/atomic"
+)
+
+// BatchItem holds a macaroon to be verified by VerifyBatch,
+// along with the information needed to verify it.
+type BatchItem struct {
+	// Macaroon holds the primary macaroon.
+	Macaroon *Macaroon
+
+	// RootKey holds the root key that the
+	// macaroon was minted with.
+	RootKey []byte
+
+	// Check is called to check each first party caveat,
+	// as for Macaroon.Verify. Items are verified
+	// concurrently, so if the same function is used
+	// by several items, it must be safe to call
+	// concurrently.
+	Check func(caveat string) error
+
+	// Discharges holds the discharge macaroons
+	// for the macaroon's third party caveats.
+	Discharges []*Macaroon
+}
+
+// BatchOptions holds options for VerifyBatch.
+// The zero value specifies the defaults.
+type BatchOptions struct {
+	// Concurrency holds the maximum number of items
+	// that will be verified at the same time. If this
+	// is zero, runtime.GOMAXPROCS(0) is used.
+	Concurrency int
+
+	// Verify holds the options used to
+	// verify each item.
+	Verify VerifyOptions
+}
+
+// VerifyBatch verifies all the given items using a pool of
+// concurrent workers, and returns the result of verifying
+// each one: the error from verifying items[i] is held in
+// the i'th element of the returned slice, which is nil
+// if the verification succeeded. The errors are the same
+// as those returned by Macaroon.VerifyWithOptions, except
+// that if an item's check function panics, the item's error
+// describes the panic.
+//
+// Each worker reuses its verification state for all the
+// items that it verifies, so verifying a batch is more
+// efficient than verifying each item separately.
+func VerifyBatch(items []BatchItem, opts BatchOptions) []error {
+	errs := make([]error, len(items))
+	n := opts.Concurrency
+	if n <= 0 {
+		n = runtime.GOMAXPROCS(0)
+	}
+	if n > len(items) {
+		n = len(items)
+	}
+	// next holds the index of the next item to verify.
+	var next int64 = -1
+	var wg sync.WaitGroup
+	wg.Add(n)
+	for i := 0; i < n; i++ {
+		go func() {
+			defer wg.Done()
+			v := verifierPool.Get().(*verifier)
+			defer verifierPool.Put(v)
+			for {
+				i := int(atomic.AddInt64(&next, 1))
+				if i >= len(items) {
+					return
+				}
+				errs[i] = v.verifyItem(&items[i], opts.Verify)
+			}
+		}()
+	}
+	wg.Wait()
+	return errs
+}
+
+// verifyItem verifies a single batch item. If the item's check
+// function panics, the panic is recovered and returned as the
+// item's error, so that it does not bring down the whole process
+// or leave the other items unverified.
+func (v *verifier) verifyItem(item *BatchItem, opts VerifyOptions) (err error) {
+	if item.Macaroon == nil {
+		return fmt.Errorf("no macaroon in batch item")
+	}
+	v.reset(item.Check, item.Discharges, opts)
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic verifying batch item: %v", r)
+		}
+		v.clear()
+	}()
+	return v.verifyPrimary(item.Macaroon, item.RootKey, nil)
+}
@@ -0,0 +1,114 @@
+package macaroon_test
+
+import (
+	"fmt"
+
+	gc "gopkg.in/check.v1"
+
+	"github.com/rogpeppe/macaroon"
+)
+
+type batchSuite struct{}
+
+var _ = gc.Suite(&batchSuite{})
+
+// batchItems returns n batch items, every third of
+// which fails verification in a different way.
+func batchItems(n int) []macaroon.BatchItem {
+	items := make([]macaroon.BatchItem, n)
+	for i := range items {
+		rootKey, primary, discharges := makeMacaroons(recursiveThirdPartyCaveatMacaroons)
+		item := macaroon.BatchItem{
+			Macaroon:   primary,
+			RootKey:    rootKey,
+			Discharges: discharges,
+			Check: func(string) error {
+				return nil
+			},
+		}
+		switch i % 6 {
+		case 1:
+			item.RootKey = []byte("wrong key")
+		case 3:
+			item.Discharges = nil
+		case 5:
+			cond := fmt.Sprintf("item %d", i)
+			item.Macaroon.AddFirstPartyCaveat(cond)
+			item.Check = func(c string) error {
+				if c == cond {
+					return fmt.Errorf("condition %q not met", c)
+				}
+				return nil
+			}
+		}
+		items[i] = item
+	}
+	return items
+}
+
+func (*batchSuite) TestVerifyBatch(c *gc.C) {
+	items := batchItems(60)
+	expect := make([]error, len(items))
+	for i, item := range items {
+		expect[i] = item.Macaroon.Verify(item.RootKey, item.Check, item.Discharges)
+		if i%2 == 0 {
+			c.Assert(expect[i], gc.IsNil)
+		} else {
+			c.Assert(expect[i], gc.NotNil)
+		}
+	}
+	for _, concurrency := range []int{0, 1, 4, 100} {
+		c.Logf("concurrency %d", concurrency)
+		errs := macaroon.VerifyBatch(items, macaroon.BatchOptions{
+			Concurrency: concurrency,
+		})
+		c.Assert(errs, gc.DeepEquals, expect)
+	}
+}
+
+func (*batchSuite) TestVerifyBatchOptions(c *gc.C) {
+	items := batchItems(2)
+	errs := macaroon.VerifyBatch(items, macaroon.BatchOptions{
+		Verify: macaroon.VerifyOptions{
+			MaxCaveats: 1,
+		},
+	})
+	c.Assert(errs, gc.HasLen, 2)
+	for _, err := range errs {
+		c.Assert(err, gc.FitsTypeOf, (*macaroon.CaveatCountError)(nil))
+	}
+}
+
+func (*batchSuite) TestVerifyBatchEmpty(c *gc.C) {
+	errs := macaroon.VerifyBatch(nil, macaroon.BatchOptions{})
+	c.Assert(errs, gc.HasLen, 0)
+}
+
+func (*batchSuite) TestVerifyBatchNoMacaroon(c *gc.C) {
+	items := batchItems(2)
+	items[1].Macaroon = nil
+	errs := macaroon.VerifyBatch(items, macaroon.BatchOptions{})
+	c.Assert(errs[0], gc.IsNil)
+	c.Assert(errs[1], gc.ErrorMatches, "no macaroon in batch item")
+}
+
+func (*batchSuite) TestVerifyBatchCheckPanics(c *gc.C) {
+	items := batchItems(4)
+	items[2].Check = func(string) error {
+		panic("check failure")
+	}
+	for _, concurrency := range []int{1, 4} {
+		c.Logf("concurrency %d", concurrency)
+		errs := macaroon.VerifyBatch(items, macaroon.BatchOptions{
+			Concurrency: concurrency,
+		})
+		c.Assert(errs, gc.HasLen, 4)
+		c.Assert(errs[0], gc.IsNil)
+		c.Assert(errs[1], gc.NotNil)
+		c.Assert(errs[2], gc.ErrorMatches, "panic verifying batch item: check failure")
+		c.Assert(errs[3], gc.NotNil)
+	}
+	// The verifiers are still usable after a panic.
+	errs := macaroon.VerifyBatch(items[:1], macaroon.BatchOptions{})
+	c.Assert(errs[0], gc.IsNil)
+}
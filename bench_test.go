@@ -3,6 +3,7 @@ package macaroon_test
 import (
 	"crypto/rand"
 	"encoding/base64"
+	"fmt"
 	"testing"
 
 	"github.com/rogpeppe/macaroon"
@@ -17,8 +18,14 @@ func randomBytes(n int) []byte {
 	return b
 }
 
+// testKey returns s padded with spaces to the minimum
+// root key length.
+func testKey(s string) []byte {
+	return []byte(fmt.Sprintf("%-32s", s))
+}
+
 func BenchmarkNew(b *testing.B) {
-	rootKey := randomBytes(24)
+	rootKey := randomBytes(32)
 	id := base64.StdEncoding.EncodeToString(randomBytes(100))
 	loc := base64.StdEncoding.EncodeToString(randomBytes(40))
 	b.ResetTimer()
@@ -28,7 +35,7 @@ func BenchmarkNew(b *testing.B) {
 }
 
 func BenchmarkAddCaveat(b *testing.B) {
-	rootKey := randomBytes(24)
+	rootKey := randomBytes(32)
 	id := base64.StdEncoding.EncodeToString(randomBytes(100))
 	loc := base64.StdEncoding.EncodeToString(randomBytes(40))
 	b.ResetTimer()
@@ -45,6 +52,7 @@ func benchmarkVerify(b *testing.B, mspecs []macaroonSpec) {
 	check := func(string) error {
 		return nil
 	}
+	b.ReportAllocs()
 	b.ResetTimer()
 	for i := b.N - 1; i >= 0; i-- {
 		err := primary.Verify(rootKey, check, discharges)
@@ -68,8 +76,36 @@ func BenchmarkVerifySmall(b *testing.B) {
 	}})
 }
 
+func BenchmarkVerifyNoCaveats(b *testing.B) {
+	benchmarkVerify(b, []macaroonSpec{primarySpec()})
+}
+
+func BenchmarkVerifyManyCaveats(b *testing.B) {
+	var caveats []caveat
+	for i := 0; i < 100; i++ {
+		caveats = append(caveats, caveat{
+			condition: fmt.Sprintf("condition %d", i),
+		})
+	}
+	benchmarkVerify(b, []macaroonSpec{primarySpec(caveats...)})
+}
+
+func BenchmarkVerifyManyDischarges(b *testing.B) {
+	specs := []macaroonSpec{primarySpec()}
+	for i := 0; i < 50; i++ {
+		cond := fmt.Sprintf("d%d", i)
+		specs[0].caveats = append(specs[0].caveats, thirdParty(cond))
+		specs = append(specs, discharge(cond))
+	}
+	benchmarkVerify(b, specs)
+}
+
+func BenchmarkVerifyDeepDischarges(b *testing.B) {
+	benchmarkVerify(b, chainSpecs(10))
+}
+
 func BenchmarkMarshalJSON(b *testing.B) {
-	rootKey := randomBytes(24)
+	rootKey := randomBytes(32)
 	id := base64.StdEncoding.EncodeToString(randomBytes(100))
 	loc := base64.StdEncoding.EncodeToString(randomBytes(40))
 	m := MustNew(rootKey, id, loc)
@@ -91,7 +127,7 @@ func MustNew(rootKey []byte, id, loc string) *macaroon.Macaroon {
 }
 
 func BenchmarkUnmarshalJSON(b *testing.B) {
-	rootKey := randomBytes(24)
+	rootKey := randomBytes(32)
 	id := base64.StdEncoding.EncodeToString(randomBytes(100))
 	loc := base64.StdEncoding.EncodeToString(randomBytes(40))
 	m := MustNew(rootKey, id, loc)
@@ -107,3 +143,27 @@ func BenchmarkUnmarshalJSON(b *testing.B) {
 		}
 	}
 }
+
+func BenchmarkVerifyBatch(b *testing.B) {
+	items := make([]macaroon.BatchItem, 100)
+	for i := range items {
+		rootKey, primary, discharges := makeMacaroons(recursiveThirdPartyCaveatMacaroons)
+		items[i] = macaroon.BatchItem{
+			Macaroon:   primary,
+			RootKey:    rootKey,
+			Discharges: discharges,
+			Check: func(string) error {
+				return nil
+			},
+		}
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := b.N - 1; i >= 0; i-- {
+		for _, err := range macaroon.VerifyBatch(items, macaroon.BatchOptions{}) {
+			if err != nil {
+				b.Fatalf("verification failed: %v", err)
+			}
+		}
+	}
+}
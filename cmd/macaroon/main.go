@@ -0,0 +1,646 @@
+// The macaroon command mints, attenuates, inspects and verifies
+// macaroons from the command line.
+//
+// Macaroons are read from a file or standard input in any of the
+// supported formats - JSON, binary or base64-encoded binary text -
+// and written in the format chosen with the -format flag. A token
+// may hold a single macaroon or a slice of macaroons, in which
+// case the first is the primary macaroon and the rest are its
+// discharges.
+//
+// Root keys are read from the file named by the -key flag of the
+// mint and verify subcommands. A single trailing newline is not
+// part of the key, so the file may be written with a text editor.
+//
+// Key pairs used for third party caveats are stored as JSON
+// objects holding the hex-encoded public and private keys,
+// as printed by the genkey subcommand.
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/rogpeppe/macaroon"
+	"github.com/rogpeppe/macaroon/bakery"
+	"github.com/rogpeppe/macaroon/bakery/checkers"
+)
+
+// command holds a macaroon subcommand.
+type command struct {
+	// args describes the arguments to the command.
+	args string
+
+	// help holds a one-line description of the command.
+	help string
+
+	// run runs the command. The flag set has already been
+	// created; run should define its flags and parse args.
+	run func(ctxt *context, fs *flag.FlagSet, args []string) error
+}
+
+var commands = map[string]command{
+	"genkey": {
+		help: "generate a key pair for third party caveats",
+		run:  genkeyCmd,
+	},
+	"mint": {
+		args: "[caveat...]",
+		help: "mint a new macaroon with the given first party caveats",
+		run:  mintCmd,
+	},
+	"caveat": {
+		args: "caveat...",
+		help: "add first party caveats to a macaroon",
+		run:  caveatCmd,
+	},
+	"third-party": {
+		args: "condition",
+		help: "add a third party caveat to a macaroon",
+		run:  thirdPartyCmd,
+	},
+	"discharge": {
+		args: "[caveat...]",
+		help: "discharge the third party caveats addressed to a key pair",
+		run:  dischargeCmd,
+	},
+	"bind": {
+		args: "file...",
+		help: "bind discharge macaroons to a primary macaroon",
+		run:  bindCmd,
+	},
+	"inspect": {
+		help: "describe the contents of a macaroon",
+		run:  inspectCmd,
+	},
+	"verify": {
+		help: "verify a macaroon and its discharges",
+		run:  verifyCmd,
+	},
+}
+
+// context holds the environment that a command runs in.
+type context struct {
+	stdin  io.Reader
+	stdout io.Writer
+	stderr io.Writer
+}
+
+func main() {
+	ctxt := &context{
+		stdin:  os.Stdin,
+		stdout: os.Stdout,
+		stderr: os.Stderr,
+	}
+	os.Exit(run(ctxt, os.Args[1:]))
+}
+
+// run runs the command specified by args
+// and returns the process exit code.
+func run(ctxt *context, args []string) int {
+	if len(args) == 0 {
+		usage(ctxt.stderr)
+		return 2
+	}
+	cmd, ok := commands[args[0]]
+	if !ok {
+		fmt.Fprintf(ctxt.stderr, "macaroon: unknown command %q\n", args[0])
+		usage(ctxt.stderr)
+		return 2
+	}
+	fs := flag.NewFlagSet(args[0], flag.ContinueOnError)
+	fs.SetOutput(ctxt.stderr)
+	fs.Usage = func() {
+		fmt.Fprintf(ctxt.stderr, "usage: macaroon %s [flags] %s\n", args[0], cmd.args)
+		fs.PrintDefaults()
+	}
+	if err := cmd.run(ctxt, fs, args[1:]); err != nil {
+		if err == flag.ErrHelp {
+			return 2
+		}
+		fmt.Fprintf(ctxt.stderr, "macaroon %s: %v\n", args[0], err)
+		return 1
+	}
+	return 0
+}
+
+func usage(w io.Writer) {
+	fmt.Fprintf(w, "usage: macaroon command [flags] [args]\n\ncommands:\n")
+	var names []string
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(w, "\t%-12s %s\n", name, commands[name].help)
+	}
+}
+
+// tokenFlags holds the flags common to commands that
+// read and write macaroons.
+type tokenFlags struct {
+	in     string
+	format string
+}
+
+func (f *tokenFlags) register(fs *flag.FlagSet, in, out bool) {
+	if in {
+		fs.StringVar(&f.in, "in", "-", "file holding the macaroon (- for standard input)")
+	}
+	if out {
+		fs.StringVar(&f.format, "format", "text", "output format (text, json or binary)")
+	}
+}
+
+func (f *tokenFlags) check() error {
+	switch f.format {
+	case "", "text", "json", "binary":
+		return nil
+	}
+	return fmt.Errorf("unknown output format %q", f.format)
+}
+
+func genkeyCmd(ctxt *context, fs *flag.FlagSet, args []string) error {
+	if err := parseFlags(fs, args, 0, 0); err != nil {
+		return err
+	}
+	key, err := bakery.GenerateKey()
+	if err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(keyPairJSON{
+		Public:  hex.EncodeToString(key.Public[:]),
+		Private: hex.EncodeToString(key.Private[:]),
+	}, "", "\t")
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(ctxt.stdout, "%s\n", data)
+	return nil
+}
+
+func mintCmd(ctxt *context, fs *flag.FlagSet, args []string) error {
+	var tf tokenFlags
+	tf.register(fs, false, true)
+	keyFile := fs.String("key", "", "file holding the root key")
+	id := fs.String("id", "", "macaroon id (random if empty)")
+	loc := fs.String("loc", "", "macaroon location")
+	if err := parseFlags(fs, args, 0, -1); err != nil {
+		return err
+	}
+	if err := tf.check(); err != nil {
+		return err
+	}
+	rootKey, err := readRootKey(*keyFile)
+	if err != nil {
+		return err
+	}
+	if *id == "" {
+		*id, err = randomId()
+		if err != nil {
+			return err
+		}
+	}
+	m, err := macaroon.New(rootKey, *id, *loc)
+	if err != nil {
+		return err
+	}
+	if err := addFirstPartyCaveats(m, fs.Args()); err != nil {
+		return err
+	}
+	return writeToken(ctxt, tf.format, macaroon.Slice{m})
+}
+
+func caveatCmd(ctxt *context, fs *flag.FlagSet, args []string) error {
+	var tf tokenFlags
+	tf.register(fs, true, true)
+	if err := parseFlags(fs, args, 1, -1); err != nil {
+		return err
+	}
+	m, err := readMacaroon(ctxt, &tf)
+	if err != nil {
+		return err
+	}
+	if err := addFirstPartyCaveats(m, fs.Args()); err != nil {
+		return err
+	}
+	return writeToken(ctxt, tf.format, macaroon.Slice{m})
+}
+
+func thirdPartyCmd(ctxt *context, fs *flag.FlagSet, args []string) error {
+	var tf tokenFlags
+	tf.register(fs, true, true)
+	keyFile := fs.String("key", "", "file holding the key pair of the first party")
+	pubKey := fs.String("pubkey", "", "hex-encoded public key of the third party")
+	loc := fs.String("loc", "", "location of the third party")
+	if err := parseFlags(fs, args, 1, 1); err != nil {
+		return err
+	}
+	if *loc == "" {
+		return fmt.Errorf("no third party location specified")
+	}
+	var key *bakery.KeyPair
+	if *keyFile != "" {
+		var err error
+		key, err = readKeyPair(*keyFile)
+		if err != nil {
+			return err
+		}
+	}
+	pub, err := parsePublicKey(*pubKey)
+	if err != nil {
+		return err
+	}
+	m, err := readMacaroon(ctxt, &tf)
+	if err != nil {
+		return err
+	}
+	svc, err := bakery.NewService(bakery.NewServiceParams{
+		Location: m.Location(),
+		Key:      key,
+		Locator: bakery.PublicKeyLocatorMap{
+			*loc: pub,
+		},
+	})
+	if err != nil {
+		return err
+	}
+	if err := svc.AddCaveat(m, checkers.ThirdParty(*loc, fs.Arg(0))); err != nil {
+		return err
+	}
+	return writeToken(ctxt, tf.format, macaroon.Slice{m})
+}
+
+func dischargeCmd(ctxt *context, fs *flag.FlagSet, args []string) error {
+	var tf tokenFlags
+	tf.register(fs, true, true)
+	keyFile := fs.String("key", "", "file holding the key pair of the third party")
+	loc := fs.String("loc", "", "location of the third party")
+	if err := parseFlags(fs, args, 0, -1); err != nil {
+		return err
+	}
+	if *keyFile == "" {
+		return fmt.Errorf("no key pair specified")
+	}
+	if *loc == "" {
+		return fmt.Errorf("no third party location specified")
+	}
+	if err := tf.check(); err != nil {
+		return err
+	}
+	key, err := readKeyPair(*keyFile)
+	if err != nil {
+		return err
+	}
+	ms, err := readToken(ctxt, tf.in)
+	if err != nil {
+		return err
+	}
+	svc, err := bakery.NewService(bakery.NewServiceParams{
+		Location: *loc,
+		Key:      key,
+	})
+	if err != nil {
+		return err
+	}
+	var caveats []bakery.Caveat
+	for _, cond := range fs.Args() {
+		caveats = append(caveats, checkers.FirstParty(cond))
+	}
+	// All conditions are accepted; the operator is
+	// told which ones have been discharged.
+	checker := bakery.ThirdPartyCheckerFunc(func(_, cond string) ([]bakery.Caveat, error) {
+		fmt.Fprintf(ctxt.stderr, "discharging %q\n", cond)
+		return caveats, nil
+	})
+	var discharges macaroon.Slice
+	for _, m := range ms {
+		for _, cav := range m.Caveats() {
+			if !cav.IsThirdParty() || cav.Location != *loc {
+				continue
+			}
+			dm, err := svc.Discharge(checker, cav.Id)
+			if err != nil {
+				return err
+			}
+			discharges = append(discharges, dm)
+		}
+	}
+	if len(discharges) == 0 {
+		return fmt.Errorf("no third party caveats found for location %q", *loc)
+	}
+	return writeToken(ctxt, tf.format, discharges)
+}
+
+func bindCmd(ctxt *context, fs *flag.FlagSet, args []string) error {
+	var tf tokenFlags
+	tf.register(fs, false, true)
+	if err := parseFlags(fs, args, 1, -1); err != nil {
+		return err
+	}
+	if err := tf.check(); err != nil {
+		return err
+	}
+	var all macaroon.Slice
+	for _, file := range fs.Args() {
+		ms, err := readToken(ctxt, file)
+		if err != nil {
+			return err
+		}
+		all = append(all, ms...)
+	}
+	all.Bind()
+	return writeToken(ctxt, tf.format, all)
+}
+
+func inspectCmd(ctxt *context, fs *flag.FlagSet, args []string) error {
+	var tf tokenFlags
+	tf.register(fs, true, false)
+	asJSON := fs.Bool("json", false, "print the macaroons as indented JSON")
+	asDOT := fs.Bool("dot", false, "print the macaroons as a Graphviz DOT graph")
+	if err := parseFlags(fs, args, 0, 0); err != nil {
+		return err
+	}
+	if *asJSON && *asDOT {
+		return fmt.Errorf("cannot specify both -json and -dot")
+	}
+	ms, err := readToken(ctxt, tf.in)
+	if err != nil {
+		return err
+	}
+	if *asDOT {
+		fmt.Fprint(ctxt.stdout, ms.DOT())
+		return nil
+	}
+	if !*asJSON {
+		fmt.Fprint(ctxt.stdout, ms.Inspect())
+		return nil
+	}
+	data, err := json.MarshalIndent(ms, "", "\t")
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(ctxt.stdout, "%s\n", data)
+	return nil
+}
+
+func verifyCmd(ctxt *context, fs *flag.FlagSet, args []string) error {
+	var tf tokenFlags
+	tf.register(fs, true, false)
+	keyFile := fs.String("key", "", "file holding the root key")
+	verbose := fs.Bool("v", false, "print a trace of the verification")
+	var allowed stringsFlag
+	fs.Var(&allowed, "c", "first party caveat condition to allow (may be repeated)")
+	if err := parseFlags(fs, args, 0, 0); err != nil {
+		return err
+	}
+	rootKey, err := readRootKey(*keyFile)
+	if err != nil {
+		return err
+	}
+	ms, err := readToken(ctxt, tf.in)
+	if err != nil {
+		return err
+	}
+	checker := checkers.PushFirstPartyChecker(allowed.checker(), checkers.Std)
+	t, err := ms[0].VerifyWithTrace(rootKey, checker.CheckFirstPartyCaveat, ms[1:], macaroon.VerifyOptions{})
+	if *verbose {
+		fmt.Fprint(ctxt.stdout, t)
+	}
+	if err != nil {
+		return fmt.Errorf("verification failed: %v", err)
+	}
+	fmt.Fprintln(ctxt.stdout, "ok")
+	return nil
+}
+
+// parseFlags parses the given arguments and checks that
+// the number of remaining arguments is between min and
+// max. If max is negative, there is no maximum.
+func parseFlags(fs *flag.FlagSet, args []string, min, max int) error {
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	n := fs.NArg()
+	if n < min || (max >= 0 && n > max) {
+		fs.Usage()
+		return flag.ErrHelp
+	}
+	return nil
+}
+
+// stringsFlag implements flag.Value by accumulating
+// all the values it is set to.
+type stringsFlag []string
+
+func (f *stringsFlag) String() string {
+	return strings.Join(*f, ", ")
+}
+
+func (f *stringsFlag) Set(s string) error {
+	*f = append(*f, s)
+	return nil
+}
+
+// checker returns a checker that accepts exactly
+// the conditions in f.
+func (f stringsFlag) checker() bakery.FirstPartyChecker {
+	return bakery.FirstPartyCheckerFunc(func(cond string) error {
+		for _, allowed := range f {
+			if cond == allowed {
+				return nil
+			}
+		}
+		return &bakery.CaveatNotRecognizedError{Caveat: cond}
+	})
+}
+
+func addFirstPartyCaveats(m *macaroon.Macaroon, conds []string) error {
+	for _, cond := range conds {
+		if err := m.AddFirstPartyCaveat(cond); err != nil {
+			return fmt.Errorf("cannot add caveat %q: %v", cond, err)
+		}
+	}
+	return nil
+}
+
+func readFile(ctxt *context, file string) ([]byte, error) {
+	if file == "-" {
+		return ioutil.ReadAll(ctxt.stdin)
+	}
+	return ioutil.ReadFile(file)
+}
+
+func readRootKey(file string) ([]byte, error) {
+	if file == "" {
+		return nil, fmt.Errorf("no root key file specified")
+	}
+	rootKey, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read root key: %v", err)
+	}
+	rootKey = bytes.TrimSuffix(rootKey, []byte("\n"))
+	rootKey = bytes.TrimSuffix(rootKey, []byte("\r"))
+	if len(rootKey) == 0 {
+		return nil, fmt.Errorf("empty root key in %q", file)
+	}
+	return rootKey, nil
+}
+
+// readMacaroon reads a token that must hold a single
+// macaroon. It is used by commands that add caveats,
+// which would invalidate any bound discharge macaroons.
+func readMacaroon(ctxt *context, tf *tokenFlags) (*macaroon.Macaroon, error) {
+	if err := tf.check(); err != nil {
+		return nil, err
+	}
+	ms, err := readToken(ctxt, tf.in)
+	if err != nil {
+		return nil, err
+	}
+	if len(ms) != 1 {
+		return nil, fmt.Errorf("expected a single macaroon, got %d", len(ms))
+	}
+	return ms[0], nil
+}
+
+// readToken reads macaroons from the given file,
+// or standard input if the file is "-".
+func readToken(ctxt *context, file string) (macaroon.Slice, error) {
+	data, err := readFile(ctxt, file)
+	if err != nil {
+		return nil, err
+	}
+	ms, err := parseToken(data)
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse macaroon from %q: %v", file, err)
+	}
+	if len(ms) == 0 {
+		return nil, fmt.Errorf("no macaroons found in %q", file)
+	}
+	return ms, nil
+}
+
+// parseToken parses macaroons in any of the supported
+// formats. The V1 binary format always contains space
+// characters and the V2 format starts with a non-printable
+// byte, so neither can be mistaken for base64 text.
+func parseToken(data []byte) (macaroon.Slice, error) {
+	text := bytes.TrimSpace(data)
+	if len(text) == 0 {
+		return nil, fmt.Errorf("empty macaroon data")
+	}
+	var ms macaroon.Slice
+	switch text[0] {
+	case '{':
+		var m macaroon.Macaroon
+		if err := m.UnmarshalJSON(text); err != nil {
+			return nil, err
+		}
+		return macaroon.Slice{&m}, nil
+	case '[':
+		if err := ms.UnmarshalJSON(text); err != nil {
+			return nil, err
+		}
+		return ms, nil
+	}
+	if err := ms.UnmarshalText(text); err == nil {
+		return ms, nil
+	}
+	if err := ms.UnmarshalBinary(data); err != nil {
+		return nil, err
+	}
+	return ms, nil
+}
+
+// writeToken writes ms to standard output in the given
+// format. A slice holding a single macaroon is written
+// as that macaroon.
+func writeToken(ctxt *context, format string, ms macaroon.Slice) error {
+	var data []byte
+	var err error
+	switch format {
+	case "json":
+		if len(ms) == 1 {
+			data, err = ms[0].MarshalJSON()
+		} else {
+			data, err = ms.MarshalJSON()
+		}
+		data = append(data, '\n')
+	case "binary":
+		data, err = ms.MarshalBinary()
+	default:
+		data, err = ms.MarshalText()
+		data = append(data, '\n')
+	}
+	if err != nil {
+		return fmt.Errorf("cannot marshal macaroon: %v", err)
+	}
+	_, err = ctxt.stdout.Write(data)
+	return err
+}
+
+// keyPairJSON holds the JSON format of a key pair file.
+type keyPairJSON struct {
+	Public  string `json:"public"`
+	Private string `json:"private"`
+}
+
+func readKeyPair(file string) (*bakery.KeyPair, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read key pair: %v", err)
+	}
+	var kj keyPairJSON
+	if err := json.Unmarshal(data, &kj); err != nil {
+		return nil, fmt.Errorf("cannot unmarshal key pair from %q: %v", file, err)
+	}
+	var key bakery.KeyPair
+	if err := decodeKey(key.Public[:], kj.Public); err != nil {
+		return nil, fmt.Errorf("bad public key in %q: %v", file, err)
+	}
+	if err := decodeKey(key.Private[:], kj.Private); err != nil {
+		return nil, fmt.Errorf("bad private key in %q: %v", file, err)
+	}
+	return &key, nil
+}
+
+func parsePublicKey(s string) (*bakery.PublicKey, error) {
+	if s == "" {
+		return nil, fmt.Errorf("no third party public key specified")
+	}
+	var pub bakery.PublicKey
+	if err := decodeKey(pub[:], s); err != nil {
+		return nil, fmt.Errorf("bad public key: %v", err)
+	}
+	return &pub, nil
+}
+
+func decodeKey(dst []byte, s string) error {
+	data, err := hex.DecodeString(s)
+	if err != nil {
+		return err
+	}
+	if len(data) != len(dst) {
+		return fmt.Errorf("key has length %d, expected %d", len(data), len(dst))
+	}
+	copy(dst, data)
+	return nil
+}
+
+func randomId() (string, error) {
+	id := make([]byte, 24)
+	if _, err := rand.Read(id); err != nil {
+		return "", fmt.Errorf("cannot generate id: %v", err)
+	}
+	return hex.EncodeToString(id), nil
+}
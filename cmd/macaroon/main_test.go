@@ -0,0 +1,200 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	gc "gopkg.in/check.v1"
+
+	"github.com/rogpeppe/macaroon"
+)
+
+func TestPackage(t *testing.T) {
+	gc.TestingT(t)
+}
+
+type mainSuite struct {
+	dir string
+}
+
+var _ = gc.Suite(&mainSuite{})
+
+func (s *mainSuite) SetUpTest(c *gc.C) {
+	dir, err := ioutil.TempDir("", "macaroon-cmd-test")
+	c.Assert(err, gc.IsNil)
+	s.dir = dir
+}
+
+func (s *mainSuite) TearDownTest(c *gc.C) {
+	os.RemoveAll(s.dir)
+}
+
+// runCmd runs the macaroon command with the given standard input
+// and arguments, and returns its exit code, standard output
+// and standard error.
+func runCmd(stdin string, args ...string) (int, string, string) {
+	var stdout, stderr bytes.Buffer
+	code := run(&context{
+		stdin:  strings.NewReader(stdin),
+		stdout: &stdout,
+		stderr: &stderr,
+	}, args)
+	return code, stdout.String(), stderr.String()
+}
+
+// mustRun is like runCmd but fails the test if the
+// command does not succeed. It returns the command's
+// standard output.
+func mustRun(c *gc.C, stdin string, args ...string) string {
+	code, stdout, stderr := runCmd(stdin, args...)
+	c.Assert(code, gc.Equals, 0, gc.Commentf("stderr: %s", stderr))
+	return stdout
+}
+
+func (s *mainSuite) writeFile(c *gc.C, name, data string) string {
+	path := filepath.Join(s.dir, name)
+	err := ioutil.WriteFile(path, []byte(data), 0600)
+	c.Assert(err, gc.IsNil)
+	return path
+}
+
+func (s *mainSuite) TestFirstPartyFlow(c *gc.C) {
+	keyFile := s.writeFile(c, "rootkey", "a secret root key of at least 32 bytes")
+	m := mustRun(c, "", "mint", "-key", keyFile, "-id", "some id", "-loc", "somewhere", "a")
+	m = mustRun(c, m, "caveat", "b", "c")
+
+	out := mustRun(c, m, "verify", "-key", keyFile, "-c", "a", "-c", "b", "-c", "c")
+	c.Assert(out, gc.Equals, "ok\n")
+
+	code, _, stderr := runCmd(m, "verify", "-key", keyFile, "-c", "a", "-c", "b")
+	c.Assert(code, gc.Equals, 1)
+	c.Assert(stderr, gc.Equals, "macaroon verify: verification failed: caveat \"c\" not recognized\n")
+
+	otherKey := s.writeFile(c, "otherkey", "another secret root key of at least 32 bytes")
+	code, _, stderr = runCmd(m, "verify", "-key", otherKey, "-c", "a", "-c", "b", "-c", "c")
+	c.Assert(code, gc.Equals, 1)
+	c.Assert(stderr, gc.Matches, "macaroon verify: verification failed: signature mismatch.*\n")
+
+	out = mustRun(c, m, "inspect")
+	c.Assert(out, gc.Matches, `location somewhere
+identifier some id
+cid a
+cid b
+cid c
+signature [0-9a-f]+
+`)
+
+	out = mustRun(c, m, "inspect", "-dot")
+	c.Assert(out, gc.Equals, `digraph macaroons {
+	node [shape=box];
+	m0 [label="location somewhere\lidentifier some id\lcid a\lcid b\lcid c\l", style=bold];
+}
+`)
+}
+
+func (s *mainSuite) TestRootKeyTrailingNewline(c *gc.C) {
+	keyFile := s.writeFile(c, "rootkey", "a secret root key of at least 32 bytes")
+	m := mustRun(c, "", "mint", "-key", keyFile, "a")
+
+	// A trailing newline is not part of the key.
+	for _, suffix := range []string{"\n", "\r\n"} {
+		nlKeyFile := s.writeFile(c, "nlrootkey", "a secret root key of at least 32 bytes"+suffix)
+		out := mustRun(c, m, "verify", "-key", nlKeyFile, "-c", "a")
+		c.Assert(out, gc.Equals, "ok\n")
+	}
+
+	// But any other trailing space is.
+	spKeyFile := s.writeFile(c, "sprootkey", "a secret root key of at least 32 bytes ")
+	code, _, stderr := runCmd(m, "verify", "-key", spKeyFile, "-c", "a")
+	c.Assert(code, gc.Equals, 1)
+	c.Assert(stderr, gc.Matches, "macaroon verify: verification failed: signature mismatch.*\n")
+
+	emptyKeyFile := s.writeFile(c, "emptyrootkey", "\n")
+	code, _, stderr = runCmd("", "mint", "-key", emptyKeyFile, "a")
+	c.Assert(code, gc.Equals, 1)
+	c.Assert(stderr, gc.Matches, `macaroon mint: empty root key in ".*"\n`)
+}
+
+func (s *mainSuite) TestThirdPartyFlow(c *gc.C) {
+	keyFile := s.writeFile(c, "rootkey", "a secret root key of at least 32 bytes")
+	keyPairData := mustRun(c, "", "genkey")
+	var kp keyPairJSON
+	err := json.Unmarshal([]byte(keyPairData), &kp)
+	c.Assert(err, gc.IsNil)
+	keyPairFile := s.writeFile(c, "keypair", keyPairData)
+
+	primary := mustRun(c, "", "mint", "-key", keyFile, "-loc", "target", "a")
+	primary = mustRun(c, primary, "third-party", "-loc", "auth", "-pubkey", kp.Public, "is-authorized")
+	primaryFile := s.writeFile(c, "primary", primary)
+
+	code, dischargeText, stderr := runCmd(primary, "discharge", "-key", keyPairFile, "-loc", "auth", "b")
+	c.Assert(code, gc.Equals, 0, gc.Commentf("stderr: %s", stderr))
+	c.Assert(stderr, gc.Equals, "discharging \"is-authorized\"\n")
+	dischargeFile := s.writeFile(c, "discharge", dischargeText)
+
+	// Without a discharge the verification fails.
+	code, _, stderr = runCmd(primary, "verify", "-key", keyFile, "-c", "a", "-c", "b")
+	c.Assert(code, gc.Equals, 1)
+	c.Assert(stderr, gc.Matches, "macaroon verify: verification failed: cannot find discharge macaroon.*\n")
+
+	bound := mustRun(c, "", "bind", "-format", "json", primaryFile, dischargeFile)
+	var ms macaroon.Slice
+	err = ms.UnmarshalJSON([]byte(bound))
+	c.Assert(err, gc.IsNil)
+	c.Assert(ms, gc.HasLen, 2)
+
+	out := mustRun(c, bound, "verify", "-key", keyFile, "-c", "a", "-c", "b")
+	c.Assert(out, gc.Equals, "ok\n")
+
+	// The discharge macaroon's caveat must be satisfied.
+	code, _, stderr = runCmd(bound, "verify", "-key", keyFile, "-c", "a")
+	c.Assert(code, gc.Equals, 1)
+	c.Assert(stderr, gc.Equals, "macaroon verify: verification failed: caveat \"b\" not recognized\n")
+
+	out = mustRun(c, bound, "verify", "-v", "-key", keyFile, "-c", "a", "-c", "b")
+	c.Assert(out, gc.Matches, `(?s).*third party caveat .* at "auth".*first party caveat "b": ok.*ok\n`)
+
+	// Caveats cannot be added to a bound slice.
+	code, _, stderr = runCmd(bound, "caveat", "c")
+	c.Assert(code, gc.Equals, 1)
+	c.Assert(stderr, gc.Equals, "macaroon caveat: expected a single macaroon, got 2\n")
+}
+
+func (s *mainSuite) TestInputFormats(c *gc.C) {
+	keyFile := s.writeFile(c, "rootkey", "a secret root key of at least 32 bytes")
+	text := mustRun(c, "", "mint", "-key", keyFile, "-id", "id", "a")
+	for _, format := range []string{"text", "json", "binary"} {
+		c.Logf("format %s", format)
+		data := mustRun(c, text, "caveat", "-format", format, "b")
+		file := s.writeFile(c, "token", data)
+		out := mustRun(c, "", "verify", "-in", file, "-key", keyFile, "-c", "a", "-c", "b")
+		c.Assert(out, gc.Equals, "ok\n")
+	}
+}
+
+func (s *mainSuite) TestUsageErrors(c *gc.C) {
+	code, _, stderr := runCmd("")
+	c.Assert(code, gc.Equals, 2)
+	c.Assert(stderr, gc.Matches, "usage: macaroon command.*\n(.*\n)*")
+
+	code, _, stderr = runCmd("", "unknown")
+	c.Assert(code, gc.Equals, 2)
+	c.Assert(stderr, gc.Matches, "macaroon: unknown command \"unknown\"\n(.*\n)*")
+
+	code, _, stderr = runCmd("", "caveat")
+	c.Assert(code, gc.Equals, 2)
+	c.Assert(stderr, gc.Matches, `usage: macaroon caveat \[flags\] caveat...\n(.*\n)*`)
+
+	code, _, stderr = runCmd("", "mint")
+	c.Assert(code, gc.Equals, 1)
+	c.Assert(stderr, gc.Equals, "macaroon mint: no root key file specified\n")
+
+	code, _, stderr = runCmd("not a macaroon", "inspect")
+	c.Assert(code, gc.Equals, 1)
+	c.Assert(stderr, gc.Matches, `macaroon inspect: cannot parse macaroon from "-": .*\n`)
+}
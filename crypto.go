@@ -1,33 +1,43 @@
 package macaroon
 
 import (
-	"crypto/hmac"
 	"crypto/sha256"
+	"crypto/sha512"
 	"fmt"
 	"hash"
 	"io"
 
-	"code.google.com/p/go.crypto/nacl/secretbox"
+	"golang.org/x/crypto/blake2b"
+	"golang.org/x/crypto/nacl/secretbox"
 )
 
-func keyedHash(key, text []byte) []byte {
-	h := keyedHasher(key)
-	h.Write([]byte(text))
-	return h.Sum(nil)
+// keyedHash returns the keyed hash of text
+// computed with the given algorithm.
+func keyedHash(alg Algorithm, key, text []byte) []byte {
+	return newHasher(alg).keyedHash(make([]byte, keyLen), key, text)
 }
 
-func keyedHasher(key []byte) hash.Hash {
-	return hmac.New(sha256.New, key)
+// keyedHash2 hashes two texts with the given key in
+// the same way as libmacaroons: each text is hashed
+// separately and the concatenation of the two
+// results is hashed again.
+func keyedHash2(alg Algorithm, key, text1, text2 []byte) []byte {
+	return newHasher(alg).keyedHash2(make([]byte, keyLen), key, text1, text2)
 }
 
-func makeKey(key []byte) *[keyLen]byte {
-	if len(key) < keyLen {
-		var h [keyLen]byte
-		copy(h[:], key)
-		return &h
-	}
-	h := sha256.Sum256(key)
-	return &h
+var keyGenerator = []byte("macaroons-key-generator")
+
+// zeroKey holds the key used to bind a discharge
+// macaroon to its primary macaroon. It must not
+// be changed.
+var zeroKey [keyLen]byte
+
+// deriveKey derives the key that starts a macaroon's
+// signature chain from the given root key, so that
+// root keys of any length can be used. This is the same
+// derivation used by libmacaroons.
+func deriveKey(alg Algorithm, rootKey []byte) []byte {
+	return keyedHash(alg, keyGenerator, rootKey)
 }
 
 const (
@@ -44,24 +54,189 @@ func newNonce(r io.Reader) (*[nonceLen]byte, error) {
 	return &nonce, nil
 }
 
+// encrypt encrypts text with the given key, which
+// must be keyLen bytes long, using a nonce read from r.
 func encrypt(key, text []byte, r io.Reader) ([]byte, error) {
+	if len(key) != keyLen {
+		return nil, fmt.Errorf("invalid key length %d", len(key))
+	}
+	var k [keyLen]byte
+	copy(k[:], key)
 	nonce, err := newNonce(r)
 	if err != nil {
 		return nil, err
 	}
 	out := make([]byte, 0, len(nonce)+secretbox.Overhead+len(text))
 	out = append(out, nonce[:]...)
-	return secretbox.Seal(out, text, nonce, makeKey(key)), nil
+	return secretbox.Seal(out, text, nonce, &k), nil
 }
 
+// decrypt decrypts ciphertext produced by encrypt.
 func decrypt(key, ciphertext []byte) ([]byte, error) {
+	if len(key) != keyLen {
+		return nil, fmt.Errorf("invalid key length %d", len(key))
+	}
 	if len(ciphertext) < nonceLen+secretbox.Overhead {
 		return nil, fmt.Errorf("message too short")
 	}
+	var k [keyLen]byte
+	copy(k[:], key)
 	var nonce [nonceLen]byte
 	copy(nonce[:], ciphertext)
 	ciphertext = ciphertext[nonceLen:]
-	text, ok := secretbox.Open(nil, ciphertext, &nonce, makeKey(key))
+	text, ok := secretbox.Open(nil, ciphertext, &nonce, &k)
+	if !ok {
+		return nil, fmt.Errorf("decryption failure")
+	}
+	return text, nil
+}
+
+// hasher computes the keyed hashes used for macaroon signatures
+// with a given algorithm. It reuses its hash state and buffers,
+// so that no allocation is needed once it has been created,
+// except by BLAKE2b, which needs a new hash state for each key.
+// The zero value is not usable; use newHasher.
+// A hasher must not be used concurrently.
+type hasher struct {
+	alg Algorithm
+
+	// hmac is used for the HMAC algorithms.
+	hmac hmacState
+
+	buf  [sha512.Size]byte
+	pair [2 * keyLen]byte
+}
+
+func newHasher(alg Algorithm) *hasher {
+	hr := &hasher{
+		alg: alg,
+	}
+	switch alg {
+	case HMACSHA256:
+		hr.hmac.init(sha256.New)
+	case HMACSHA512:
+		hr.hmac.init(sha512.New)
+	case BLAKE2b:
+	default:
+		panic(fmt.Errorf("unknown algorithm %v", alg))
+	}
+	return hr
+}
+
+// keyedHash computes the keyed hash of text with the given
+// key and stores it in dst, which must have room for
+// keyLen bytes. It returns the hash, which shares
+// storage with dst. The key and text may overlap dst.
+func (hr *hasher) keyedHash(dst, key, text []byte) []byte {
+	if hr.alg == BLAKE2b {
+		h := newBLAKE2b(keyLen, key)
+		h.Write(text)
+		return h.Sum(dst[:0])
+	}
+	hr.hmac.setKey(key)
+	sum := hr.hmac.sum(hr.buf[:0], text)
+	// HMACSHA512 is truncated to the same size as
+	// the other algorithms.
+	return append(dst[:0], sum[:keyLen]...)
+}
+
+// newBLAKE2b returns a BLAKE2b hash that produces
+// digests of the given size, keyed with the given key.
+// Macaroon signatures use keyLen-byte digests.
+func newBLAKE2b(size int, key []byte) hash.Hash {
+	h, err := blake2b.New(size, key)
+	if err != nil {
+		// BLAKE2b keys are limited to 64 bytes, but
+		// macaroon signatures are never keyed with
+		// anything longer than keyLen bytes.
+		panic(err)
+	}
+	return h
+}
+
+// hmacState computes HMACs with a standard hash function. It
+// computes the same values as crypto/hmac, but crypto/hmac
+// cannot be given a new key without allocating, and macaroon
+// verification needs a new key (the previous signature) for
+// almost every hash. Instead, setKey writes the padded key to
+// the inner and outer hash states, and sum completes them.
+type hmacState struct {
+	inner, outer hash.Hash
+	pad          [sha512.BlockSize]byte
+	buf          [sha512.Size]byte
+}
+
+func (hs *hmacState) init(h func() hash.Hash) {
+	hs.inner = h()
+	hs.outer = h()
+}
+
+// setKey prepares hs to compute the HMAC
+// of some text with the given key.
+func (hs *hmacState) setKey(key []byte) {
+	blockSize := hs.inner.BlockSize()
+	if len(key) > blockSize {
+		// Long keys are hashed first, as in RFC 2104.
+		hs.outer.Reset()
+		hs.outer.Write(key)
+		key = hs.outer.Sum(hs.buf[:0])
+	}
+	writePadded := func(h hash.Hash, x byte) {
+		pad := hs.pad[:blockSize]
+		for i := range pad {
+			pad[i] = x
+		}
+		for i, b := range key {
+			pad[i] ^= b
+		}
+		h.Reset()
+		h.Write(pad)
+	}
+	writePadded(hs.inner, 0x36)
+	writePadded(hs.outer, 0x5c)
+}
+
+// sum appends the HMAC of text with the key
+// given to setKey to dst and returns the result.
+// It must be called only once for each call to setKey.
+func (hs *hmacState) sum(dst, text []byte) []byte {
+	hs.inner.Write(text)
+	hs.outer.Write(hs.inner.Sum(hs.buf[:0]))
+	return hs.outer.Sum(dst)
+}
+
+// keyedHash2 is like keyedHash but computes
+// the same hash as the keyedHash2 function.
+func (hr *hasher) keyedHash2(dst, key, text1, text2 []byte) []byte {
+	hr.keyedHash(hr.pair[:keyLen], key, text1)
+	hr.keyedHash(hr.pair[keyLen:], key, text2)
+	return hr.keyedHash(dst, key, hr.pair[:])
+}
+
+// caveatSignature returns the signature that results
+// from adding a caveat with the given caveat id and
+// verification id to a macaroon with the given signature,
+// storing it in dst. This follows libmacaroons, which
+// hashes first party caveats directly but hashes the
+// verification id and caveat id of third party
+// caveats separately.
+func (hr *hasher) caveatSignature(dst, sig, caveatId, verificationId []byte) []byte {
+	if len(verificationId) == 0 {
+		return hr.keyedHash(dst, sig, caveatId)
+	}
+	return hr.keyedHash2(dst, sig, verificationId, caveatId)
+}
+
+// decryptKey is like decrypt, except that the key must be
+// exactly keyLen bytes long and the plaintext, which is
+// expected to be a key, is stored in dst if it fits.
+// The nonce buffer is used to hold the nonce.
+func decryptKey(dst *[keyLen]byte, nonce *[nonceLen]byte, key *[keyLen]byte, ciphertext []byte) ([]byte, error) {
+	if len(ciphertext) < nonceLen+secretbox.Overhead {
+		return nil, fmt.Errorf("message too short")
+	}
+	copy(nonce[:], ciphertext)
+	text, ok := secretbox.Open(dst[:0], ciphertext[nonceLen:], nonce, key)
 	if !ok {
 		return nil, fmt.Errorf("decryption failure")
 	}
@@ -1,10 +1,16 @@
 package macaroon
 
 import (
+	"crypto/hmac"
 	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
 	"fmt"
+	"hash"
 
-	"code.google.com/p/go.crypto/nacl/secretbox"
+	"golang.org/x/crypto/blake2b"
+	"golang.org/x/crypto/nacl/secretbox"
 	gc "gopkg.in/check.v1"
 )
 
@@ -13,7 +19,7 @@ type cryptoSuite struct{}
 var _ = gc.Suite(&cryptoSuite{})
 
 func (*cryptoSuite) TestEncDec(c *gc.C) {
-	key := []byte("a key")
+	key := randomBytes(keyLen)
 	text := []byte("some text")
 	b, err := encrypt(key, text, rand.Reader)
 	c.Assert(err, gc.IsNil)
@@ -42,17 +48,140 @@ func (*cryptoSuite) TestBadRandom(c *gc.C) {
 	_, err := newNonce(&ErrorReader{})
 	c.Assert(err, gc.ErrorMatches, "^cannot generate random bytes:.*")
 
-	_, err = encrypt([]byte("a key"), []byte("some text"), &ErrorReader{})
+	_, err = encrypt(randomBytes(keyLen), []byte("some text"), &ErrorReader{})
 	c.Assert(err, gc.ErrorMatches, "^cannot generate random bytes:.*")
 }
 
+func (*cryptoSuite) TestBadKeyLength(c *gc.C) {
+	_, err := encrypt([]byte("a key"), []byte("some text"), rand.Reader)
+	c.Assert(err, gc.ErrorMatches, "invalid key length 5")
+
+	_, err = decrypt([]byte("a key"), randomBytes(100))
+	c.Assert(err, gc.ErrorMatches, "invalid key length 5")
+}
+
 func (*cryptoSuite) TestBadCiphertext(c *gc.C) {
+	key := randomBytes(keyLen)
 	buf := randomBytes(nonceLen + secretbox.Overhead)
 	for i := range buf {
-		_, err := decrypt([]byte("a key"), buf[0:i])
+		_, err := decrypt(key, buf[0:i])
 		c.Assert(err, gc.ErrorMatches, "message too short")
 	}
-	_, err := decrypt([]byte("a key"), buf)
+	_, err := decrypt(key, buf)
+	c.Assert(err, gc.ErrorMatches, "decryption failure")
+}
+
+var hmacAlgorithms = []struct {
+	alg Algorithm
+	h   func() hash.Hash
+}{{
+	alg: HMACSHA256,
+	h:   sha256.New,
+}, {
+	alg: HMACSHA512,
+	h:   sha512.New,
+}}
+
+func (*cryptoSuite) TestHMACAlgorithms(c *gc.C) {
+	keys := [][]byte{
+		nil,
+		[]byte("a key"),
+		randomBytes(keyLen),
+		randomBytes(sha256.BlockSize),
+		randomBytes(sha512.BlockSize),
+		randomBytes(200),
+	}
+	texts := [][]byte{nil, []byte("text"), randomBytes(50), randomBytes(1000)}
+	for _, test := range hmacAlgorithms {
+		c.Logf("algorithm %v", test.alg)
+		// The same hasher is used throughout to check
+		// that no state is kept between hashes.
+		hr := newHasher(test.alg)
+		for _, key := range keys {
+			for _, text := range texts {
+				h := hmac.New(test.h, key)
+				h.Write(text)
+				expect := h.Sum(nil)[:keyLen]
+				c.Assert(keyedHash(test.alg, key, text), gc.DeepEquals, expect)
+				var dst [keyLen]byte
+				c.Assert(hr.keyedHash(dst[:], key, text), gc.DeepEquals, expect)
+			}
+		}
+	}
+}
+
+var blake2bTests = []struct {
+	key    []byte
+	text   string
+	expect string
+}{{
+	text:   "",
+	expect: "0e5751c026e543b2e8ab2eb06099daa1d1e5df47778f7787faab45cdf12fe3a8",
+}, {
+	text:   "abc",
+	expect: "bddd813c634239723171ef3fee98579b94964e3bb1cb3e427262c8c068d52319",
+}}
+
+func (*cryptoSuite) TestBLAKE2b(c *gc.C) {
+	for i, test := range blake2bTests {
+		c.Logf("test %d", i)
+		h := newBLAKE2b(keyLen, test.key)
+		h.Write([]byte(test.text))
+		c.Assert(hex.EncodeToString(h.Sum(nil)), gc.Equals, test.expect)
+	}
+}
+
+func (*cryptoSuite) TestHasher(c *gc.C) {
+	keys := [][]byte{nil, []byte("a key"), randomBytes(keyLen), randomBytes(blake2b.Size)}
+	for alg := Algorithm(0); alg < numAlgorithms; alg++ {
+		c.Logf("algorithm %v", alg)
+		hr := newHasher(alg)
+		for _, key := range keys {
+			text1, text2 := randomBytes(50), []byte("text")
+			var dst [keyLen]byte
+			h1 := keyedHash(alg, key, text1)
+			c.Assert(h1, gc.HasLen, keyLen)
+			c.Assert(hr.keyedHash(dst[:], key, text1), gc.DeepEquals, h1)
+			h2 := keyedHash(alg, key, text2)
+			expect := keyedHash(alg, key, append(append([]byte(nil), h1...), h2...))
+			c.Assert(hr.keyedHash2(dst[:], key, text1, text2), gc.DeepEquals, expect)
+			c.Assert(keyedHash2(alg, key, text1, text2), gc.DeepEquals, expect)
+
+			// The result may overwrite the key.
+			sig := append([]byte(nil), keyedHash(alg, key, nil)...)
+			expect = caveatSignature(alg, sig, text1, text2)
+			c.Assert(hr.caveatSignature(sig, sig, text1, text2), gc.DeepEquals, expect)
+			c.Assert(sig, gc.DeepEquals, expect)
+		}
+	}
+}
+
+func (*cryptoSuite) TestAlgorithmsDiffer(c *gc.C) {
+	key, text := randomBytes(keyLen), []byte("text")
+	hashes := make(map[string]Algorithm)
+	for alg := Algorithm(0); alg < numAlgorithms; alg++ {
+		h := string(keyedHash(alg, key, text))
+		if alg1, ok := hashes[h]; ok {
+			c.Fatalf("%v and %v produce the same hash", alg, alg1)
+		}
+		hashes[h] = alg
+	}
+}
+
+func (*cryptoSuite) TestDecryptKey(c *gc.C) {
+	var key, dst [keyLen]byte
+	var nonce [nonceLen]byte
+	copy(key[:], randomBytes(keyLen))
+	text := randomBytes(keyLen)
+	b, err := encrypt(key[:], text, rand.Reader)
+	c.Assert(err, gc.IsNil)
+	t, err := decryptKey(&dst, &nonce, &key, b)
+	c.Assert(err, gc.IsNil)
+	c.Assert(t, gc.DeepEquals, text)
+	_, err = decryptKey(&dst, &nonce, &key, b[:nonceLen])
+	c.Assert(err, gc.ErrorMatches, "message too short")
+	b[len(b)-1] ^= 1
+	_, err = decryptKey(&dst, &nonce, &key, b)
 	c.Assert(err, gc.ErrorMatches, "decryption failure")
 }
 
@@ -0,0 +1,127 @@
+package macaroon
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+)
+
+// DOT returns a description of the macaroons in the slice as a
+// directed graph in the Graphviz DOT language, suitable for
+// rendering with the dot command. As with Inspect, the first
+// macaroon is taken to be the primary macaroon.
+//
+// Each macaroon is shown as a node holding its location,
+// identifier and caveats. The primary macaroon is drawn in bold.
+// An edge labeled with the caveat's index leads from each third
+// party caveat to each discharge macaroon with a matching id.
+// A third party caveat without a discharge macaroon leads to a
+// red dashed node describing the missing discharge, and discharge
+// macaroons that are not reachable from the primary macaroon
+// are drawn dotted.
+func (s Slice) DOT() string {
+	var buf bytes.Buffer
+	buf.WriteString("digraph macaroons {\n")
+	buf.WriteString("\tnode [shape=box];\n")
+	reachable := s.reachable()
+	for i, m := range s {
+		lines := []string{
+			fieldText(fieldLocation, m.dataBytes(m.location)),
+			fieldText(fieldIdentifier, m.dataBytes(m.id)),
+		}
+		if m.alg != HMACSHA256 {
+			lines = append(lines, fieldAlgorithm+" "+m.alg.String())
+		}
+		for _, cav := range m.caveats {
+			lines = append(lines, fieldText(fieldCaveatId, m.dataBytes(cav.caveatId)))
+			if cav.isThirdParty() {
+				lines = append(lines, fieldText(fieldCaveatLocation, m.dataBytes(cav.location)))
+			}
+		}
+		style := ""
+		switch {
+		case i == 0:
+			style = ", style=bold"
+		case !reachable[i]:
+			style = ", style=dotted"
+		}
+		fmt.Fprintf(&buf, "\tm%d [label=%s%s];\n", i, dotLabel(lines), style)
+	}
+	for i, m := range s {
+		for j, cav := range m.caveats {
+			if !cav.isThirdParty() {
+				continue
+			}
+			discharges := s.discharges(m.dataBytes(cav.caveatId))
+			for _, k := range discharges {
+				fmt.Fprintf(&buf, "\tm%d -> m%d [label=\"caveat %d\"];\n", i, k, j)
+			}
+			if len(discharges) > 0 {
+				continue
+			}
+			missing := fmt.Sprintf("m%d_%d", i, j)
+			lines := []string{
+				"missing discharge",
+				fieldText(fieldCaveatId, m.dataBytes(cav.caveatId)),
+				fieldText(fieldCaveatLocation, m.dataBytes(cav.location)),
+			}
+			fmt.Fprintf(&buf, "\t%s [label=%s, style=dashed, color=red];\n", missing, dotLabel(lines))
+			fmt.Fprintf(&buf, "\tm%d -> %s [label=\"caveat %d\", style=dashed, color=red];\n", i, missing, j)
+		}
+	}
+	buf.WriteString("}\n")
+	return buf.String()
+}
+
+// discharges returns the indexes of the discharge
+// macaroons in s with the given id.
+func (s Slice) discharges(id []byte) []int {
+	var indexes []int
+	for i := 1; i < len(s); i++ {
+		if bytes.Equal(s[i].dataBytes(s[i].id), id) {
+			indexes = append(indexes, i)
+		}
+	}
+	return indexes
+}
+
+// reachable reports, for each macaroon in s,
+// whether it is the primary macaroon or
+// discharges a caveat in a reachable macaroon.
+func (s Slice) reachable() []bool {
+	reachable := make([]bool, len(s))
+	var visit func(i int)
+	visit = func(i int) {
+		if reachable[i] {
+			return
+		}
+		reachable[i] = true
+		m := s[i]
+		for _, cav := range m.caveats {
+			if cav.isThirdParty() {
+				for _, j := range s.discharges(m.dataBytes(cav.caveatId)) {
+					visit(j)
+				}
+			}
+		}
+	}
+	if len(s) > 0 {
+		visit(0)
+	}
+	return reachable
+}
+
+// dotLabel returns the given lines as a quoted DOT
+// label, with each line left-justified.
+func dotLabel(lines []string) string {
+	var buf bytes.Buffer
+	buf.WriteByte('"')
+	for _, line := range lines {
+		buf.WriteString(dotEscaper.Replace(line))
+		buf.WriteString(`\l`)
+	}
+	buf.WriteByte('"')
+	return buf.String()
+}
+
+var dotEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`)
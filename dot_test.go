@@ -0,0 +1,49 @@
+package macaroon_test
+
+import (
+	gc "gopkg.in/check.v1"
+
+	"github.com/rogpeppe/macaroon"
+)
+
+type dotSuite struct{}
+
+var _ = gc.Suite(&dotSuite{})
+
+func (*dotSuite) TestDOT(c *gc.C) {
+	ms := libmacaroonsExample(c)
+	c.Assert(ms.DOT(), gc.Equals, `
+digraph macaroons {
+	node [shape=box];
+	m0 [label="location http://mybank/\lidentifier we used our other secret key\lcid account = 3735928559\lcid this was how we remind auth of key/pred\lcl http://auth.mybank/\l", style=bold];
+	m1 [label="location http://auth.mybank/\lidentifier this was how we remind auth of key/pred\lcid time < 2020-01-01T00:00\l"];
+	m0 -> m1 [label="caveat 1"];
+}
+`[1:])
+}
+
+func (*dotSuite) TestDOTMissingAndUnused(c *gc.C) {
+	_, primary, discharges := makeMacaroons([]macaroonSpec{
+		primarySpec(thirdParty("a"), thirdParty("b")),
+		discharge("a", thirdParty("a")),
+		discharge("c"),
+	})
+	primary.AddFirstPartyCaveat(`with "quotes" \ and` + "\x00")
+	ms := append(macaroon.Slice{primary}, discharges...)
+	c.Assert(ms.DOT(), gc.Equals, `
+digraph macaroons {
+	node [shape=box];
+	m0 [label="location \lidentifier root-id\lcid a\lcl a-location\lcid b\lcl b-location\lcid \"with \\\"quotes\\\" \\\\ and\\x00\"\l", style=bold];
+	m1 [label="location a-location\lidentifier a\lcid a\lcl a-location\l"];
+	m2 [label="location c-location\lidentifier c\l", style=dotted];
+	m0 -> m1 [label="caveat 0"];
+	m0_1 [label="missing discharge\lcid b\lcl b-location\l", style=dashed, color=red];
+	m0 -> m0_1 [label="caveat 1", style=dashed, color=red];
+	m1 -> m1 [label="caveat 0"];
+}
+`[1:])
+}
+
+func (*dotSuite) TestDOTEmpty(c *gc.C) {
+	c.Assert(macaroon.Slice{}.DOT(), gc.Equals, "digraph macaroons {\n\tnode [shape=box];\n}\n")
+}
@@ -14,8 +14,8 @@ import (
 
 	"code.google.com/p/go.net/publicsuffix"
 	"gopkg.in/errgo.v1"
-	"gopkg.in/macaroon.v1"
 
+	"github.com/rogpeppe/macaroon"
 	"github.com/rogpeppe/macaroon/bakery"
 )
 
@@ -106,17 +106,13 @@ func (ctxt *clientContext) do1(req *http.Request) (*http.Response, error) {
 		return nil, errgo.New("no macaroon found in response")
 	}
 	mac := resp.Info.Macaroon
-	macaroons, err := bakery.DischargeAll(mac, ctxt.obtainThirdPartyDischarge)
+	discharges, err := bakery.DischargeAll(mac, ctxt.obtainThirdPartyDischarge)
 	if err != nil {
 		return nil, err
 	}
+	macaroons := append(macaroon.Slice{mac}, discharges...)
 	// Bind the discharge macaroons to the original macaroon.
-	for _, m := range macaroons {
-		m.Bind(mac.Signature())
-	}
-	// TODO(rog) perhaps we should add all the macaroons as a single
-	// cookie, with the principal macaroon first.
-	macaroons = append(macaroons, mac)
+	macaroons.Bind()
 	if err := ctxt.addCookies(req, macaroons); err != nil {
 		return nil, errgo.Notef(err, "cannot add cookie")
 	}
@@ -125,7 +121,11 @@ func (ctxt *clientContext) do1(req *http.Request) (*http.Response, error) {
 	return hresp, err
 }
 
-func (ctxt *clientContext) addCookies(req *http.Request, ms []*macaroon.Macaroon) error {
+// addCookies adds a cookie for each of the given macaroons
+// to the client's cookie jar. Each macaroon is sent in its own
+// cookie, so that services that do not understand cookies
+// holding a macaroon.Slice can still use them.
+func (ctxt *clientContext) addCookies(req *http.Request, ms macaroon.Slice) error {
 	var cookies []*http.Cookie
 	for _, m := range ms {
 		data, err := m.MarshalJSON()
@@ -133,7 +133,7 @@ func (ctxt *clientContext) addCookies(req *http.Request, ms []*macaroon.Macaroon
 			return errgo.Notef(err, "cannot marshal macaroon")
 		}
 		cookies = append(cookies, &http.Cookie{
-			Name:  fmt.Sprintf("macaroon-%x", m.Signature()),
+			Name:  fmt.Sprintf("macaroon-%x", m.Fingerprint()),
 			Value: base64.StdEncoding.EncodeToString(data),
 			// TODO(rog) other fields
 		})
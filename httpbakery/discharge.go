@@ -10,8 +10,8 @@ import (
 	"path"
 
 	"gopkg.in/errgo.v1"
-	"gopkg.in/macaroon.v1"
 
+	"github.com/rogpeppe/macaroon"
 	"github.com/rogpeppe/macaroon/bakery"
 )
 
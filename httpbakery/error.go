@@ -5,7 +5,8 @@ import (
 
 	"github.com/juju/utils/jsonhttp"
 	"gopkg.in/errgo.v1"
-	"gopkg.in/macaroon.v1"
+
+	"github.com/rogpeppe/macaroon"
 )
 
 // ErrorCode holds an error code that classifies
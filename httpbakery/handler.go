@@ -5,7 +5,7 @@ import (
 	"log"
 	"net/http"
 
-	"gopkg.in/macaroon.v1"
+	"github.com/rogpeppe/macaroon"
 )
 
 type dischargeRequestedResponse struct {
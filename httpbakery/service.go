@@ -1,9 +1,18 @@
 // The httpbakery package layers on top of the bakery
 // package - it provides an HTTP-based implementation
 // of a macaroon client and server.
+//
+// Macaroons are sent to a service in cookies with names starting
+// "macaroon-". Each cookie holds the base64-encoded JSON
+// serialization of a single macaroon, which is the form sent by
+// Do and understood by all versions of this package. A service also
+// accepts cookies holding the JSON serialization of a macaroon.Slice
+// (a macaroon followed by its discharges), but clients should not
+// send those to services that may not have been upgraded.
 package httpbakery
 
 import (
+	"crypto/sha256"
 	"encoding/base64"
 	"fmt"
 	"log"
@@ -13,8 +22,8 @@ import (
 	"strings"
 
 	"code.google.com/p/go.net/publicsuffix"
-	"gopkg.in/macaroon.v1"
 
+	"github.com/rogpeppe/macaroon"
 	"github.com/rogpeppe/macaroon/bakery"
 )
 
@@ -77,11 +86,29 @@ func NewService(p bakery.NewServiceParams) (*Service, error) {
 	return &Service{Service: svc}, nil
 }
 
+// unmarshalCookieMacaroons unmarshals the JSON-encoded
+// contents of a macaroon cookie. A cookie holds either a
+// single macaroon, as sent by Do, or a macaroon.Slice
+// holding a macaroon and its discharges.
+func unmarshalCookieMacaroons(data []byte) (macaroon.Slice, error) {
+	var ms macaroon.Slice
+	if err := ms.UnmarshalJSON(data); err == nil {
+		return ms, nil
+	}
+	var m macaroon.Macaroon
+	if err := m.UnmarshalJSON(data); err != nil {
+		return nil, err
+	}
+	return macaroon.Slice{&m}, nil
+}
+
 // NewRequest returns a new request, converting cookies from the
 // HTTP request into macaroons in the bakery request when they're
-// found. Mmm.
+// found. Mmm. Macaroons found in more than one cookie are
+// only added once.
 func (svc *Service) NewRequest(httpReq *http.Request, checker bakery.FirstPartyChecker) *bakery.Request {
 	req := svc.Service.NewRequest(checker)
+	seen := make(map[[sha256.Size]byte]bool)
 	for _, cookie := range httpReq.Cookies() {
 		if !strings.HasPrefix(cookie.Name, "macaroon-") {
 			continue
@@ -91,12 +118,19 @@ func (svc *Service) NewRequest(httpReq *http.Request, checker bakery.FirstPartyC
 			log.Printf("cannot base64-decode cookie; ignoring: %v", err)
 			continue
 		}
-		var m macaroon.Macaroon
-		if err := m.UnmarshalJSON(data); err != nil {
-			log.Printf("cannot unmarshal macaroon from cookie; ignoring: %v", err)
+		ms, err := unmarshalCookieMacaroons(data)
+		if err != nil {
+			log.Printf("cannot unmarshal macaroons from cookie; ignoring: %v", err)
 			continue
 		}
-		req.AddClientMacaroon(&m)
+		for _, m := range ms {
+			fp := m.Fingerprint()
+			if seen[fp] {
+				continue
+			}
+			seen[fp] = true
+			req.AddClientMacaroon(m)
+		}
 	}
 	return req
 }
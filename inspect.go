@@ -0,0 +1,112 @@
+package macaroon
+
+import (
+	"bytes"
+	"fmt"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Inspect returns a human-readable description of the macaroon
+// in the style of libmacaroons' macaroon_inspect. Each field is
+// printed on a separate line, prefixed by its field name. The
+// verification ids of third party caveats are shown by length
+// only. Fields that do not hold printable text are quoted.
+// The algorithm is shown only if it is not the default.
+func (m *Macaroon) Inspect() string {
+	var buf bytes.Buffer
+	m.inspect(&buf, "", nil)
+	return buf.String()
+}
+
+// inspect writes the description of m to buf, with each
+// line prefixed by indent. If caveatFunc is non-nil,
+// it is called after each caveat has been written.
+func (m *Macaroon) inspect(buf *bytes.Buffer, indent string, caveatFunc func(cav caveat, indent string)) {
+	writeField(buf, indent, fieldLocation, m.dataBytes(m.location))
+	writeField(buf, indent, fieldIdentifier, m.dataBytes(m.id))
+	if m.alg != HMACSHA256 {
+		fmt.Fprintf(buf, "%s%s %v\n", indent, fieldAlgorithm, m.alg)
+	}
+	for _, cav := range m.caveats {
+		writeField(buf, indent, fieldCaveatId, m.dataBytes(cav.caveatId))
+		if cav.isThirdParty() {
+			fmt.Fprintf(buf, "%s%s (%d bytes)\n", indent, fieldVerificationId, cav.verificationId.len)
+			writeField(buf, indent, fieldCaveatLocation, m.dataBytes(cav.location))
+		}
+		if caveatFunc != nil {
+			caveatFunc(cav, indent)
+		}
+	}
+	fmt.Fprintf(buf, "%s%s %x\n", indent, fieldSignature, m.sig)
+}
+
+func writeField(buf *bytes.Buffer, indent, field string, data []byte) {
+	fmt.Fprintf(buf, "%s%s\n", indent, fieldText(field, data))
+}
+
+// fieldText returns the description of a field
+// holding the given data.
+func fieldText(field string, data []byte) string {
+	if isPrintable(data) {
+		return field + " " + string(data)
+	}
+	return fmt.Sprintf("%s %q", field, data)
+}
+
+// isPrintable reports whether data holds printable
+// UTF-8 text that can be shown without quoting.
+func isPrintable(data []byte) bool {
+	if !utf8.Valid(data) {
+		return false
+	}
+	for _, r := range string(data) {
+		if !unicode.IsPrint(r) {
+			return false
+		}
+	}
+	return true
+}
+
+// Inspect returns a human-readable description of the macaroons
+// in the slice, shown as a tree. The first macaroon is taken to
+// be the primary macaroon. The description of each discharge
+// macaroon is indented below the third party caveat that it
+// discharges. A discharge macaroon that has already been shown
+// is not shown again. Any macaroons that do not discharge a caveat
+// in the tree are shown after it, separated by blank lines.
+func (s Slice) Inspect() string {
+	var buf bytes.Buffer
+	shown := make([]bool, len(s))
+	var inspect func(i int, indent string)
+	inspect = func(i int, indent string) {
+		m := s[i]
+		shown[i] = true
+		m.inspect(&buf, indent, func(cav caveat, indent string) {
+			if !cav.isThirdParty() {
+				return
+			}
+			for j := 1; j < len(s); j++ {
+				dm := s[j]
+				if !bytes.Equal(dm.dataBytes(dm.id), m.dataBytes(cav.caveatId)) {
+					continue
+				}
+				if shown[j] {
+					fmt.Fprintf(&buf, "%s\t(discharge %d shown above)\n", indent, j)
+					continue
+				}
+				inspect(j, indent+"\t")
+			}
+		})
+	}
+	for i := range s {
+		if shown[i] {
+			continue
+		}
+		if i > 0 {
+			buf.WriteByte('\n')
+		}
+		inspect(i, "")
+	}
+	return buf.String()
+}
@@ -0,0 +1,118 @@
+package macaroon_test
+
+import (
+	gc "gopkg.in/check.v1"
+
+	"github.com/rogpeppe/macaroon"
+)
+
+type inspectSuite struct{}
+
+var _ = gc.Suite(&inspectSuite{})
+
+// libmacaroonsExample returns the macaroon and discharge
+// macaroon from the second example in the libmacaroons README.
+func libmacaroonsExample(c *gc.C) macaroon.Slice {
+	rootKey := []byte("this is a different super-secret key; never use the same secret twice")
+	m := MustNew(rootKey, "we used our other secret key", "http://mybank/")
+	err := m.AddFirstPartyCaveat("account = 3735928559")
+	c.Assert(err, gc.IsNil)
+	caveatKey := []byte("4; guaranteed random by a fair toss of the dice")
+	caveatId := "this was how we remind auth of key/pred"
+	m.SetRand(zeroReader{})
+	err = m.AddThirdPartyCaveat(caveatKey, caveatId, "http://auth.mybank/")
+	c.Assert(err, gc.IsNil)
+	dm := MustNew(caveatKey, caveatId, "http://auth.mybank/")
+	err = dm.AddFirstPartyCaveat("time < 2020-01-01T00:00")
+	c.Assert(err, gc.IsNil)
+	ms := macaroon.Slice{m, dm}
+	ms.Bind()
+	return ms
+}
+
+func (*inspectSuite) TestInspect(c *gc.C) {
+	ms := libmacaroonsExample(c)
+	c.Assert(ms[0].Inspect(), gc.Equals, `
+location http://mybank/
+identifier we used our other secret key
+cid account = 3735928559
+cid this was how we remind auth of key/pred
+vid (72 bytes)
+cl http://auth.mybank/
+signature d27db2fd1f22760e4c3dae8137e2d8fc1df6c0741c18aed4b97256bf78d1f55c
+`[1:])
+}
+
+func (*inspectSuite) TestInspectNonPrintable(c *gc.C) {
+	m := MustNew(testKey("key"), "id\x00\xff", "")
+	m.AddFirstPartyCaveat("line1\nline2")
+	c.Assert(m.Inspect(), gc.Matches, `
+location 
+identifier "id\\x00\\xff"
+cid "line1\\nline2"
+signature [0-9a-f]{64}
+`[1:])
+}
+
+func (*inspectSuite) TestInspectAlgorithm(c *gc.C) {
+	m := MustNewWithAlgorithm(macaroon.BLAKE2b, randomBytes(32), "id", "loc")
+	c.Assert(m.Inspect(), gc.Matches, `
+location loc
+identifier id
+algorithm blake2b
+signature [0-9a-f]{64}
+`[1:])
+}
+
+func (*inspectSuite) TestSliceInspect(c *gc.C) {
+	ms := libmacaroonsExample(c)
+	c.Assert(ms.Inspect(), gc.Equals, `
+location http://mybank/
+identifier we used our other secret key
+cid account = 3735928559
+cid this was how we remind auth of key/pred
+vid (72 bytes)
+cl http://auth.mybank/
+	location http://auth.mybank/
+	identifier this was how we remind auth of key/pred
+	cid time < 2020-01-01T00:00
+	signature d115ef1c133b1126978d5ab27f69d99ba9d0468cd6c1b7e47b8c1c59019cb019
+signature d27db2fd1f22760e4c3dae8137e2d8fc1df6c0741c18aed4b97256bf78d1f55c
+`[1:])
+}
+
+func (*inspectSuite) TestSliceInspectUnusedAndRepeated(c *gc.C) {
+	_, primary, discharges := makeMacaroons([]macaroonSpec{
+		primarySpec(thirdParty("a"), thirdParty("a")),
+		discharge("a", thirdParty("a")),
+		discharge("b"),
+	})
+	ms := append(macaroon.Slice{primary}, discharges...)
+	c.Assert(ms.Inspect(), gc.Matches, `
+location 
+identifier root-id
+cid a
+vid \(72 bytes\)
+cl a-location
+	location a-location
+	identifier a
+	cid a
+	vid \(72 bytes\)
+	cl a-location
+		\(discharge 1 shown above\)
+	signature [0-9a-f]+
+cid a
+vid \(72 bytes\)
+cl a-location
+	\(discharge 1 shown above\)
+signature [0-9a-f]+
+
+location b-location
+identifier b
+signature [0-9a-f]+
+`[1:])
+}
+
+func (*inspectSuite) TestSliceInspectEmpty(c *gc.C) {
+	c.Assert(macaroon.Slice{}.Inspect(), gc.Equals, "")
+}
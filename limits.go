@@ -0,0 +1,149 @@
+package macaroon
+
+import (
+	"encoding/base64"
+	"fmt"
+)
+
+// Default limits used when unmarshaling macaroons. The default
+// maximum number of caveats is DefaultMaxCaveats.
+const (
+	// DefaultMaxSize holds the default maximum size
+	// of the data holding a marshaled macaroon or slice.
+	DefaultMaxSize = 1 << 20
+
+	// DefaultMaxFieldLen holds the default maximum
+	// length of any field in a marshaled macaroon.
+	DefaultMaxFieldLen = 1 << 18
+)
+
+// UnmarshalLimits holds limits on the data accepted when
+// unmarshaling macaroons. A zero field specifies the default
+// limit.
+type UnmarshalLimits struct {
+	// MaxSize holds the maximum size in bytes
+	// of the marshaled data.
+	MaxSize int
+
+	// MaxCaveats holds the maximum number of
+	// caveats in a single macaroon.
+	MaxCaveats int
+
+	// MaxFieldLen holds the maximum length of
+	// the data in any field of a macaroon.
+	MaxFieldLen int
+}
+
+func (l UnmarshalLimits) withDefaults() UnmarshalLimits {
+	if l.MaxSize == 0 {
+		l.MaxSize = DefaultMaxSize
+	}
+	if l.MaxCaveats == 0 {
+		l.MaxCaveats = DefaultMaxCaveats
+	}
+	if l.MaxFieldLen == 0 {
+		l.MaxFieldLen = DefaultMaxFieldLen
+	}
+	return l
+}
+
+func (l *UnmarshalLimits) checkSize(size int) error {
+	if size > l.MaxSize {
+		return &LimitError{
+			Limit: "MaxSize",
+			Max:   l.MaxSize,
+		}
+	}
+	return nil
+}
+
+// checkTextSize checks that the given base64 text
+// cannot decode to more than the maximum size.
+// The size of the decoded data is checked
+// exactly when it is unmarshaled.
+func (l *UnmarshalLimits) checkTextSize(text []byte) error {
+	if len(text) > base64.StdEncoding.EncodedLen(l.MaxSize) {
+		return l.checkSize(base64.RawStdEncoding.DecodedLen(len(text)))
+	}
+	return nil
+}
+
+func (l *UnmarshalLimits) checkCaveats(n int) error {
+	if n > l.MaxCaveats {
+		return &LimitError{
+			Limit: "MaxCaveats",
+			Max:   l.MaxCaveats,
+		}
+	}
+	return nil
+}
+
+func (l *UnmarshalLimits) checkField(field string, data []byte) error {
+	if len(data) > l.MaxFieldLen {
+		return &LimitError{
+			Limit: "MaxFieldLen",
+			Max:   l.MaxFieldLen,
+			Field: field,
+		}
+	}
+	return nil
+}
+
+// LimitError is returned when unmarshaling data
+// that exceeds one of the UnmarshalLimits.
+type LimitError struct {
+	// Limit holds the name of the UnmarshalLimits
+	// field holding the limit that was exceeded.
+	Limit string
+
+	// Max holds the value of the limit.
+	Max int
+
+	// Field holds the name of the macaroon field
+	// that exceeded the MaxFieldLen limit.
+	Field string
+}
+
+func (e *LimitError) Error() string {
+	switch e.Limit {
+	case "MaxSize":
+		return fmt.Sprintf("macaroon data too large (maximum %d bytes)", e.Max)
+	case "MaxCaveats":
+		return fmt.Sprintf("too many caveats in macaroon (maximum %d)", e.Max)
+	case "MaxFieldLen":
+		return fmt.Sprintf("macaroon field %q too long (maximum %d bytes)", e.Field, e.Max)
+	}
+	return fmt.Sprintf("macaroon exceeds limit %s (%d)", e.Limit, e.Max)
+}
+
+// FormatError is returned when unmarshaling
+// malformed macaroon data.
+type FormatError struct {
+	// Reason describes the problem with the data.
+	Reason string
+}
+
+func (e *FormatError) Error() string {
+	return e.Reason
+}
+
+// unmarshalError returns err as an error suitable
+// for returning from an unmarshal function, prefixed
+// with the given context if it is non-empty.
+// Limit errors are returned unchanged; all other errors
+// are treated as format errors.
+func unmarshalError(context string, err error) error {
+	switch err := err.(type) {
+	case *LimitError:
+		return err
+	case *FormatError:
+		if context == "" {
+			return err
+		}
+	}
+	reason := err.Error()
+	if context != "" {
+		reason = context + ": " + reason
+	}
+	return &FormatError{Reason: reason}
+}
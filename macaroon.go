@@ -2,11 +2,28 @@
 //
 // The macaroon package is deprecated at this import path.
 // Please use gopkg.in/macaroon.v1 instead.
+//
+// The macaroon package implements macaroons as described in
+// the paper "Macaroons: Cookies with Contextual Caveats for
+// Decentralized Authorization in the Cloud"
+// (http://theory.stanford.edu/~ataly/Papers/macaroons.pdf)
+//
+// Signatures are calculated in the same way as libmacaroons. This is
+// incompatible with earlier versions of this package: macaroons minted
+// by an earlier version fail to verify with a *SignatureMismatchError,
+// and earlier versions cannot verify macaroons minted by this one, so
+// services that upgrade must mint new macaroons and discharge
+// macaroons for their clients.
+//
+// The version 1 binary format has changed in the same way: each
+// field now ends with a newline character, as in libmacaroons.
+// Data marshaled by an earlier version is rejected by
+// UnmarshalBinary with a *FormatError, and earlier versions
+// cannot unmarshal data marshaled by this one.
 package macaroon
 
 import (
 	"bytes"
-	"crypto/hmac"
 	"crypto/rand"
 	"crypto/sha256"
 	"fmt"
@@ -19,56 +36,145 @@ import (
 // Macaroons are mutable objects - use Clone as appropriate
 // to avoid unwanted mutation.
 type Macaroon struct {
-	// data holds the binary-marshalled form
-	// of the macaroon data.
+	// data holds the raw data of all the macaroon's fields.
+	// For efficiency, the fields are all stored in this
+	// single byte slice, which is reasonable because
+	// we only ever append to macaroons.
 	data []byte
 
-	location packet
-	id       packet
+	location dataRef
+	id       dataRef
 	caveats  []caveat
 	sig      []byte
+	version  Version
+	alg      Algorithm
+
+	// rand holds the source of randomness used when
+	// adding third party caveats. If it is nil,
+	// crypto/rand.Reader is used.
+	rand io.Reader
+}
+
+// dataRef holds a reference into Macaroon.data.
+type dataRef struct {
+	start int
+	len   int
 }
 
 // caveat holds a first person or third party caveat.
 type caveat struct {
-	location       packet
-	caveatId       packet
-	verificationId packet
+	location       dataRef
+	caveatId       dataRef
+	verificationId dataRef
 }
 
+// Caveat holds a caveat as found in a macaroon.
 type Caveat struct {
-	Id       string
+	// Id holds the caveat id. For a first party
+	// caveat, this is the caveat's condition.
+	// It may hold arbitrary bytes.
+	Id string
+
+	// Location holds the location hint of a third
+	// party caveat. It is not verified as part
+	// of the macaroon.
 	Location string
+
+	// VerificationId holds the verification id of a third
+	// party caveat - the caveat's root key encrypted with
+	// the macaroon's signature at the point the caveat was
+	// added. It is empty for a first party caveat.
+	VerificationId []byte
+}
+
+// IsThirdParty reports whether the caveat must be satisfied
+// by a discharge macaroon from some third party.
+func (cav Caveat) IsThirdParty() bool {
+	return len(cav.VerificationId) > 0
 }
 
 // isThirdParty reports whether the caveat must be satisfied
 // by some third party (if not, it's a first person caveat).
 func (cav *caveat) isThirdParty() bool {
-	return cav.verificationId.len() > 0
+	return cav.verificationId.len > 0
 }
 
 // New returns a new macaroon with the given root key,
-// identifier and location.
+// identifier and location. It uses the default algorithm,
+// HMACSHA256. The root key must be at least
+// HMACSHA256.MinRootKeyLen bytes long.
 func New(rootKey []byte, id, loc string) (*Macaroon, error) {
-	var m Macaroon
-	if err := m.init(id, loc); err != nil {
+	return NewBytes(rootKey, []byte(id), loc)
+}
+
+// NewBytes is like New except that the identifier is
+// specified as a byte slice, which may hold arbitrary data.
+func NewBytes(rootKey, id []byte, loc string) (*Macaroon, error) {
+	return NewWithAlgorithm(HMACSHA256, rootKey, id, loc)
+}
+
+// NewWithAlgorithm is like NewBytes except that the
+// macaroon's signatures are computed with the given
+// algorithm. It returns a *RootKeyLengthError if the
+// root key is too short for the algorithm.
+func NewWithAlgorithm(alg Algorithm, rootKey, id []byte, loc string) (*Macaroon, error) {
+	if err := alg.checkRootKey(rootKey); err != nil {
 		return nil, err
 	}
-	m.sig = keyedHash(rootKey, m.dataBytes(m.id))
-	return &m, nil
+	return newMacaroon(alg, rootKey, id, loc), nil
 }
 
-func (m *Macaroon) init(id, loc string) error {
-	var ok bool
-	m.location, ok = m.appendPacket(fieldLocation, []byte(loc))
-	if !ok {
-		return fmt.Errorf("macaroon location too big")
+// NewWithLegacyRootKey is like NewBytes except that it accepts
+// any non-empty root key, as earlier versions of this package
+// did, rather than requiring at least HMACSHA256.MinRootKeyLen
+// bytes. It should only be used when the root key cannot be
+// changed, for example to discharge a third party caveat added
+// by an earlier version. New root keys should always be long
+// enough to use with NewBytes.
+func NewWithLegacyRootKey(rootKey, id []byte, loc string) (*Macaroon, error) {
+	if len(rootKey) == 0 {
+		return nil, &RootKeyLengthError{
+			Algorithm: HMACSHA256,
+			Min:       1,
+		}
 	}
-	m.id, ok = m.appendPacket(fieldIdentifier, []byte(id))
-	if !ok {
-		return fmt.Errorf("macaroon identifier too big")
+	return newMacaroon(HMACSHA256, rootKey, id, loc), nil
+}
+
+func newMacaroon(alg Algorithm, rootKey, id []byte, loc string) *Macaroon {
+	var m Macaroon
+	m.init(id, loc, alg)
+	m.sig = keyedHash(alg, deriveKey(alg, rootKey), m.dataBytes(m.id))
+	return &m
+}
+
+func (m *Macaroon) init(id []byte, loc string, alg Algorithm) {
+	m.data = nil
+	m.caveats = nil
+	m.location = m.appendData([]byte(loc))
+	m.id = m.appendData(id)
+	m.version = V1
+	m.alg = alg
+}
+
+// appendData appends the given data to m.data and
+// returns a reference to it.
+func (m *Macaroon) appendData(data []byte) dataRef {
+	r := dataRef{
+		start: len(m.data),
+		len:   len(data),
 	}
-	return nil
+	m.data = append(m.data, data...)
+	return r
+}
+
+// dataBytes returns the data referred to by r.
+func (m *Macaroon) dataBytes(r dataRef) []byte {
+	return m.data[r.start : r.start+r.len]
+}
+
+func (m *Macaroon) dataStr(r dataRef) string {
+	return string(m.dataBytes(r))
 }
 
 // Clone returns a copy of the receiving macaroon.
@@ -82,6 +188,41 @@ func (m *Macaroon) Clone() *Macaroon {
 	return &m1
 }
 
+// Equal reports whether m and m1 hold the same algorithm,
+// location, id, caveats and signature. The binary format version
+// is not taken into account.
+func (m *Macaroon) Equal(m1 *Macaroon) bool {
+	if m == nil || m1 == nil {
+		return m == m1
+	}
+	if !bytes.Equal(m.dataBytes(m.location), m1.dataBytes(m1.location)) ||
+		!bytes.Equal(m.dataBytes(m.id), m1.dataBytes(m1.id)) ||
+		!bytes.Equal(m.sig, m1.sig) ||
+		m.alg != m1.alg ||
+		len(m.caveats) != len(m1.caveats) {
+		return false
+	}
+	for i, cav := range m.caveats {
+		cav1 := m1.caveats[i]
+		if !bytes.Equal(m.dataBytes(cav.caveatId), m1.dataBytes(cav1.caveatId)) ||
+			!bytes.Equal(m.dataBytes(cav.verificationId), m1.dataBytes(cav1.verificationId)) ||
+			!bytes.Equal(m.dataBytes(cav.location), m1.dataBytes(cav1.location)) {
+			return false
+		}
+	}
+	return true
+}
+
+// Fingerprint returns a SHA-256 hash of the canonical
+// binary encoding of the macaroon, which is the V2
+// format regardless of the macaroon's version.
+// Two macaroons have the same fingerprint if and
+// only if they are Equal, so it is suitable for use
+// as a key when caching or deduplicating macaroons.
+func (m *Macaroon) Fingerprint() [sha256.Size]byte {
+	return sha256.Sum256(m.appendBinaryV2(nil))
+}
+
 // Location returns the macaroon's location hint. This is
 // not verified as part of the macaroon.
 func (m *Macaroon) Location() string {
@@ -94,103 +235,176 @@ func (m *Macaroon) Id() string {
 	return m.dataStr(m.id)
 }
 
+// IdBytes returns the id of the macaroon as a byte slice.
+func (m *Macaroon) IdBytes() []byte {
+	return append([]byte(nil), m.dataBytes(m.id)...)
+}
+
+// Algorithm returns the algorithm used to compute
+// the macaroon's signatures.
+func (m *Macaroon) Algorithm() Algorithm {
+	return m.alg
+}
+
 // Signature returns the macaroon's signature.
 func (m *Macaroon) Signature() []byte {
 	return append([]byte(nil), m.sig...)
 }
 
-// Caveats returns the macaroon's caveats.
-// This method will probably change, and it's important not to change the returned caveat.
+// Caveats returns the macaroon's caveats. The returned
+// caveats do not share any data with the macaroon.
 func (m *Macaroon) Caveats() []Caveat {
 	caveats := make([]Caveat, len(m.caveats))
 	for i, cav := range m.caveats {
-		caveats[i] = Caveat{
-			Id:       m.dataStr(cav.caveatId),
-			Location: m.dataStr(cav.location),
-		}
+		caveats[i] = m.exportCaveat(cav)
 	}
 	return caveats
 }
 
-// appendCaveat appends a caveat without modifying the macaroon's signature.
-func (m *Macaroon) appendCaveat(caveatId string, verificationId []byte, loc string) (*caveat, error) {
-	var cav caveat
-	var ok bool
-	if caveatId != "" {
-		cav.caveatId, ok = m.appendPacket(fieldCaveatId, []byte(caveatId))
-		if !ok {
-			return nil, fmt.Errorf("caveat identifier too big")
-		}
+// exportCaveat returns the external form of cav.
+func (m *Macaroon) exportCaveat(cav caveat) Caveat {
+	return Caveat{
+		Id:             m.dataStr(cav.caveatId),
+		Location:       m.dataStr(cav.location),
+		VerificationId: append([]byte(nil), m.dataBytes(cav.verificationId)...),
 	}
-	if len(verificationId) > 0 {
-		cav.verificationId, ok = m.appendPacket(fieldVerificationId, verificationId)
-		if !ok {
-			return nil, fmt.Errorf("caveat verification id too big")
-		}
-	}
-	if loc != "" {
-		cav.location, ok = m.appendPacket(fieldCaveatLocation, []byte(loc))
-		if !ok {
-			return nil, fmt.Errorf("caveat location too big")
-		}
-	}
-	m.caveats = append(m.caveats, cav)
-	return &m.caveats[len(m.caveats)-1], nil
 }
 
-func (m *Macaroon) addCaveat(caveatId string, verificationId []byte, loc string) error {
-	cav, err := m.appendCaveat(caveatId, verificationId, loc)
-	if err != nil {
-		return err
-	}
-	sig := keyedHasher(m.sig)
-	sig.Write(m.dataBytes(cav.verificationId))
-	sig.Write(m.dataBytes(cav.caveatId))
-	m.sig = sig.Sum(m.sig[:0])
+// appendCaveat appends a caveat without modifying the macaroon's signature.
+func (m *Macaroon) appendCaveat(caveatId, verificationId []byte, loc string) *caveat {
+	m.caveats = append(m.caveats, caveat{
+		caveatId:       m.appendData(caveatId),
+		verificationId: m.appendData(verificationId),
+		location:       m.appendData([]byte(loc)),
+	})
+	return &m.caveats[len(m.caveats)-1]
+}
+
+func (m *Macaroon) addCaveat(caveatId, verificationId []byte, loc string) error {
+	cav := m.appendCaveat(caveatId, verificationId, loc)
+	m.sig = caveatSignature(m.alg, m.sig, m.dataBytes(cav.caveatId), m.dataBytes(cav.verificationId))
 	return nil
 }
 
+// caveatSignature returns the signature that results
+// from adding a caveat with the given caveat id and
+// verification id to a macaroon with the given signature.
+// This follows libmacaroons, which hashes first party
+// caveats directly but hashes the verification id and
+// caveat id of third party caveats separately.
+func caveatSignature(alg Algorithm, sig, caveatId, verificationId []byte) []byte {
+	return newHasher(alg).caveatSignature(make([]byte, keyLen), sig, caveatId, verificationId)
+}
+
 // Bind prepares the macaroon for being used to discharge the
 // macaroon with the given rootSig. This must be
 // used before it is used in the discharges argument to Verify.
+// The discharge macaroon must use the same algorithm as
+// the macaroon it discharges.
 func (m *Macaroon) Bind(rootSig []byte) {
-	m.sig = bindForRequest(rootSig, m.sig)
+	m.sig = bindForRequest(m.alg, rootSig, m.sig)
 }
 
 // AddFirstPartyCaveat adds a caveat that will be verified
 // by the target service.
 func (m *Macaroon) AddFirstPartyCaveat(caveatId string) error {
+	return m.addCaveat([]byte(caveatId), nil, "")
+}
+
+// AddFirstPartyCaveatBytes is like AddFirstPartyCaveat except
+// that the caveat id is specified as a byte slice.
+func (m *Macaroon) AddFirstPartyCaveatBytes(caveatId []byte) error {
 	return m.addCaveat(caveatId, nil, "")
 }
 
+// Attenuate returns a new macaroon that holds m's caveats
+// followed by first party caveats with the given conditions.
+// Unlike AddFirstPartyCaveat, it does not change m, and the
+// returned macaroon shares no mutable state with m, so it is
+// safe to use even when m is shared.
+func (m *Macaroon) Attenuate(conditions ...string) (*Macaroon, error) {
+	m1 := m.Clone()
+	for _, cond := range conditions {
+		if err := m1.addCaveat([]byte(cond), nil, ""); err != nil {
+			return nil, err
+		}
+	}
+	return m1, nil
+}
+
 // AddThirdPartyCaveat adds a third-party caveat to the macaroon,
 // using the given shared root key, caveat id and location hint.
 // The caveat id should encode the root key in some
 // way, either by encrypting it with a key known to the third party
 // or by holding a reference to it stored in the third party's
 // storage.
+//
+// The root key is encrypted using a random nonce read
+// from the macaroon's source of randomness; see SetRand.
+// The discharge macaroon must be created with the same
+// root key and with the same algorithm as m; a
+// *RootKeyLengthError is returned if the root key is
+// too short for the algorithm.
 func (m *Macaroon) AddThirdPartyCaveat(rootKey []byte, caveatId string, loc string) error {
-	return m.addThirdPartyCaveatWithRand(rootKey, caveatId, loc, rand.Reader)
+	return m.addThirdPartyCaveat(rootKey, []byte(caveatId), loc, m.randReader())
+}
+
+// AddThirdPartyCaveatBytes is like AddThirdPartyCaveat except
+// that the caveat id is specified as a byte slice.
+func (m *Macaroon) AddThirdPartyCaveatBytes(rootKey, caveatId []byte, loc string) error {
+	return m.addThirdPartyCaveat(rootKey, caveatId, loc, m.randReader())
+}
+
+// AddThirdPartyCaveatWithRand is like AddThirdPartyCaveat except
+// that the nonce is read from r rather than from the macaroon's
+// source of randomness, which is left unchanged. If r is nil,
+// crypto/rand.Reader is used.
+func (m *Macaroon) AddThirdPartyCaveatWithRand(rootKey []byte, caveatId string, loc string, r io.Reader) error {
+	if r == nil {
+		r = rand.Reader
+	}
+	return m.addThirdPartyCaveat(rootKey, []byte(caveatId), loc, r)
+}
+
+// SetRand sets the source of randomness used when adding
+// third party caveats to the macaroon. If r is nil,
+// crypto/rand.Reader is used, which is the default.
+//
+// Using a deterministic source makes it possible to
+// produce reproducible macaroons, for example for test
+// vectors. This should never be done in production, as
+// it compromises the security of third party caveats.
+//
+// The source of randomness is shared by clones of the
+// macaroon, but it is not marshaled, and it is reset
+// when the macaroon is unmarshaled.
+func (m *Macaroon) SetRand(r io.Reader) {
+	m.rand = r
 }
 
-func (m *Macaroon) addThirdPartyCaveatWithRand(rootKey []byte, caveatId string, loc string, r io.Reader) error {
-	verificationId, err := encrypt(m.sig, rootKey, r)
+func (m *Macaroon) randReader() io.Reader {
+	if m.rand == nil {
+		return rand.Reader
+	}
+	return m.rand
+}
+
+func (m *Macaroon) addThirdPartyCaveat(rootKey, caveatId []byte, loc string, r io.Reader) error {
+	if err := m.alg.checkRootKey(rootKey); err != nil {
+		return err
+	}
+	verificationId, err := encrypt(m.sig, deriveKey(m.alg, rootKey), r)
 	if err != nil {
 		return err
 	}
 	return m.addCaveat(caveatId, verificationId, loc)
 }
 
-// bndForRequest binds the given macaroon
-// to the given signature of its parent macaroon.
-func bindForRequest(rootSig, dischargeSig []byte) []byte {
-	if bytes.Equal(rootSig, dischargeSig) {
-		return rootSig
-	}
-	sig := sha256.New()
-	sig.Write(rootSig)
-	sig.Write(dischargeSig)
-	return sig.Sum(nil)
+// bindForRequest binds the given macaroon
+// to the given signature of its parent macaroon,
+// in the same way as libmacaroons' prepare_for_request.
+func bindForRequest(alg Algorithm, rootSig, dischargeSig []byte) []byte {
+	return keyedHash2(alg, zeroKey[:], rootSig, dischargeSig)
 }
 
 // Verify verifies that the receiving macaroon is valid.
@@ -201,71 +415,62 @@ func bindForRequest(rootSig, dischargeSig []byte) []byte {
 //
 // The discharge macaroons should be provided in discharges.
 //
-// Verify returns true if the verification succeeds; if returns
-// (false, nil) if the verification fails, and (false, err) if
-// the verification cannot be asserted (but may not be false).
+// Verify returns nil if the verification succeeds. It uses
+// the default verification limits; see VerifyOptions
+// for details.
+//
+// If verification fails, the error will be one of the
+// error types defined in this package, allowing the
+// caller to decide what might resolve the failure:
+//
+// - *CaveatError: a first party caveat was not satisfied.
+// If InDischarge is false, a new macaroon may be needed; otherwise
+// a new discharge macaroon may help.
+//
+// - *DischargeNotFoundError: a discharge macaroon
+// should be acquired for the caveat.
+//
+// - *SignatureMismatchError: the macaroon or one of its
+// discharges is not valid and should be discarded.
+//
+// - *AlgorithmMismatchError: a discharge macaroon does not use
+// the same algorithm as the macaroon, or the macaroon does not use
+// the algorithm required by VerifyOptions.
 //
-// TODO(rog) is there a possible DOS attack that can cause this
-// function to infinitely recurse?
+// - one of the error types returned when the verification
+// limits are exceeded; see VerifyOptions.
 func (m *Macaroon) Verify(rootKey []byte, check func(caveat string) error, discharges []*Macaroon) error {
-	// TODO(rog) consider distinguishing between classes of
-	// check error - some errors may be resolved by minting
-	// a new macaroon; others may not.
-	return m.verify(m.sig, rootKey, check, discharges)
+	return m.VerifyWithOptions(rootKey, check, discharges, VerifyOptions{})
 }
 
-func (m *Macaroon) verify(rootSig []byte, rootKey []byte, check func(caveat string) error, discharges []*Macaroon) error {
-	if len(rootSig) == 0 {
-		rootSig = m.sig
+// Bind prepares the macaroons in the slice for use in a request
+// by binding each discharge macaroon (all but the first) to the
+// primary macaroon (the first). It should only be called once,
+// after all the discharges have been acquired.
+func (s Slice) Bind() {
+	if len(s) == 0 {
+		return
 	}
-	caveatSig := keyedHash(rootKey, m.dataBytes(m.id))
-	for i, cav := range m.caveats {
-		if cav.isThirdParty() {
-			cavKey, err := decrypt(caveatSig, m.dataBytes(cav.verificationId))
-			if err != nil {
-				return fmt.Errorf("failed to decrypt caveat %d signature: %v", i, err)
-			}
-			// We choose an arbitrary error from one of the
-			// possible discharge macaroon verifications
-			// if there's more than one discharge macaroon
-			// with the required id.
-			var verifyErr error
-			found := false
-			for _, dm := range discharges {
-				if !bytes.Equal(dm.dataBytes(dm.id), m.dataBytes(cav.caveatId)) {
-					continue
-				}
-				found = true
-				verifyErr = dm.verify(rootSig, cavKey, check, discharges)
-				if verifyErr == nil {
-					break
-				}
-			}
-			if !found {
-				return fmt.Errorf("cannot find discharge macaroon for caveat %q", m.dataBytes(cav.caveatId))
-			}
-			if verifyErr != nil {
-				return verifyErr
-			}
-		} else {
-			if err := check(string(m.dataBytes(cav.caveatId))); err != nil {
-				return err
-			}
-		}
-		sig := keyedHasher(caveatSig)
-		sig.Write(m.dataBytes(cav.verificationId))
-		sig.Write(m.dataBytes(cav.caveatId))
-		caveatSig = sig.Sum(caveatSig[:0])
+	rootSig := s[0].Signature()
+	for _, m := range s[1:] {
+		m.Bind(rootSig)
 	}
-	// TODO perhaps we should actually do this check before doing
-	// all the potentially expensive caveat checks.
-	boundSig := bindForRequest(rootSig, caveatSig)
-	if !hmac.Equal(boundSig, m.sig) {
-		return fmt.Errorf("signature mismatch after caveat verification")
+}
+
+// Verify verifies the primary macaroon in the slice (the first)
+// using the remaining macaroons as its discharges. See
+// Macaroon.Verify for details.
+func (s Slice) Verify(rootKey []byte, check func(caveat string) error) error {
+	if len(s) == 0 {
+		return fmt.Errorf("no macaroons in slice")
 	}
-	return nil
+	return s[0].Verify(rootKey, check, s[1:])
 }
 
+// Verifier is implemented by types that can verify macaroons.
+// Verify reports whether the macaroon m, minted with the
+// given root key, is valid. If it is not, the returned
+// error describes why.
 type Verifier interface {
 	Verify(m *Macaroon, rootKey []byte) (bool, error)
 }
@@ -1,11 +1,15 @@
 package macaroon_test
 
 import (
+	"bytes"
 	"crypto/rand"
 	"encoding/base64"
 	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"io"
+	mathrand "math/rand"
+	"strings"
 	"testing"
 
 	gc "gopkg.in/check.v1"
@@ -26,7 +30,7 @@ func never(string) error {
 }
 
 func (*macaroonSuite) TestNoCaveats(c *gc.C) {
-	rootKey := []byte("secret")
+	rootKey := testKey("secret")
 	m := MustNew(rootKey, "some id", "a location")
 	c.Assert(m.Location(), gc.Equals, "a location")
 	c.Assert(m.Id(), gc.Equals, "some id")
@@ -36,7 +40,7 @@ func (*macaroonSuite) TestNoCaveats(c *gc.C) {
 }
 
 func (*macaroonSuite) TestFirstPartyCaveat(c *gc.C) {
-	rootKey := []byte("secret")
+	rootKey := testKey("secret")
 	m := MustNew(rootKey, "some id", "a location")
 
 	caveats := map[string]bool{
@@ -63,16 +67,22 @@ func (*macaroonSuite) TestFirstPartyCaveat(c *gc.C) {
 
 	m.AddFirstPartyCaveat("not met")
 	err = m.Verify(rootKey, check, nil)
-	c.Assert(err, gc.Equals, expectErr)
+	c.Assert(err, gc.DeepEquals, &macaroon.CaveatError{
+		MacaroonId: "some id",
+		Index:      2,
+		Condition:  "not met",
+		Err:        expectErr,
+	})
+	c.Assert(err.(*macaroon.CaveatError).Err, gc.Equals, expectErr)
 
 	c.Assert(tested["not met"], gc.Equals, true)
 }
 
 func (*macaroonSuite) TestThirdPartyCaveat(c *gc.C) {
-	rootKey := []byte("secret")
+	rootKey := testKey("secret")
 	m := MustNew(rootKey, "some id", "a location")
 
-	dischargeRootKey := []byte("shared root key")
+	dischargeRootKey := testKey("shared root key")
 	thirdPartyCaveatId := "3rd party caveat"
 	err := m.AddThirdPartyCaveat(dischargeRootKey, thirdPartyCaveatId, "remote.com")
 	c.Assert(err, gc.IsNil)
@@ -83,13 +93,124 @@ func (*macaroonSuite) TestThirdPartyCaveat(c *gc.C) {
 	c.Assert(err, gc.IsNil)
 }
 
+type zeroReader struct{}
+
+func (zeroReader) Read(buf []byte) (int, error) {
+	for i := range buf {
+		buf[i] = 0
+	}
+	return len(buf), nil
+}
+
+func (*macaroonSuite) TestLibmacaroonsFirstPartySignatures(c *gc.C) {
+	// Signatures taken from the first example in the
+	// libmacaroons README.
+	rootKey := []byte("this is our super secret key; only we should know it")
+	m := MustNew(rootKey, "we used our secret key", "http://mybank/")
+	c.Assert(hex.EncodeToString(m.Signature()), gc.Equals,
+		"e3d9e02908526c4c0039ae15114115d97fdd68bf2ba379b342aaf0f617d0552f")
+
+	caveats := []struct {
+		condition string
+		sig       string
+	}{{
+		condition: "account = 3735928559",
+		sig:       "1efe4763f290dbce0c1d08477367e11f4eee456a64933cf662d79772dbb82128",
+	}, {
+		condition: "time < 2020-01-01T00:00",
+		sig:       "b5f06c8c8ef92f6c82c6ff282cd1f8bd1849301d09a2db634ba182536a611c49",
+	}, {
+		condition: "email = alice@example.org",
+		sig:       "ddf553e46083e55b8d71ab822be3d8fcf21d6bf19c40d617bb9fb438934474b6",
+	}}
+	for _, cav := range caveats {
+		err := m.AddFirstPartyCaveat(cav.condition)
+		c.Assert(err, gc.IsNil)
+		c.Assert(hex.EncodeToString(m.Signature()), gc.Equals, cav.sig)
+	}
+	err := m.Verify(rootKey, func(string) error { return nil }, nil)
+	c.Assert(err, gc.IsNil)
+}
+
+func (*macaroonSuite) TestLibmacaroonsThirdPartySignatures(c *gc.C) {
+	// Signatures taken from the second example in the
+	// libmacaroons README. The example uses a zero nonce
+	// when encrypting the third party caveat's root key.
+	rootKey := []byte("this is a different super-secret key; never use the same secret twice")
+	m := MustNew(rootKey, "we used our other secret key", "http://mybank/")
+	err := m.AddFirstPartyCaveat("account = 3735928559")
+	c.Assert(err, gc.IsNil)
+	c.Assert(hex.EncodeToString(m.Signature()), gc.Equals,
+		"1434e674ad84fdfdc9bc1aa00785325c8b6d57341fc7ce200ba4680c80786dda")
+
+	caveatKey := []byte("4; guaranteed random by a fair toss of the dice")
+	caveatId := "this was how we remind auth of key/pred"
+	m.SetRand(zeroReader{})
+	err = m.AddThirdPartyCaveat(caveatKey, caveatId, "http://auth.mybank/")
+	c.Assert(err, gc.IsNil)
+	c.Assert(hex.EncodeToString(m.Signature()), gc.Equals,
+		"d27db2fd1f22760e4c3dae8137e2d8fc1df6c0741c18aed4b97256bf78d1f55c")
+
+	dm := MustNew(caveatKey, caveatId, "http://auth.mybank/")
+	err = dm.AddFirstPartyCaveat("time < 2020-01-01T00:00")
+	c.Assert(err, gc.IsNil)
+	c.Assert(hex.EncodeToString(dm.Signature()), gc.Equals,
+		"2ed1049876e9d5840950274b579b0770317df54d338d9d3039c7c67d0d91d63c")
+
+	dm.Bind(m.Signature())
+	c.Assert(hex.EncodeToString(dm.Signature()), gc.Equals,
+		"d115ef1c133b1126978d5ab27f69d99ba9d0468cd6c1b7e47b8c1c59019cb019")
+
+	err = m.Verify(rootKey, func(string) error { return nil }, []*macaroon.Macaroon{dm})
+	c.Assert(err, gc.IsNil)
+}
+
 func (*macaroonSuite) TestThirdPartyCaveatBadRandom(c *gc.C) {
-	rootKey := []byte("secret")
+	rootKey := testKey("secret")
 	m := MustNew(rootKey, "some id", "a location")
-	dischargeRootKey := []byte("shared root key")
+	dischargeRootKey := testKey("shared root key")
 	thirdPartyCaveatId := "3rd party caveat"
 
-	err := macaroon.AddThirdPartyCaveatWithRand(m, dischargeRootKey, thirdPartyCaveatId, "remote.com", &macaroon.ErrorReader{})
+	m.SetRand(&macaroon.ErrorReader{})
+	err := m.AddThirdPartyCaveat(dischargeRootKey, thirdPartyCaveatId, "remote.com")
+	c.Assert(err, gc.ErrorMatches, "cannot generate random bytes: fail")
+}
+
+func (*macaroonSuite) TestSetRand(c *gc.C) {
+	newMacaroon := func(r io.Reader) []byte {
+		m := MustNew(testKey("secret"), "some id", "a location")
+		m.SetRand(r)
+		err := m.AddThirdPartyCaveat(testKey("shared root key"), "3rd party caveat", "remote.com")
+		c.Assert(err, gc.IsNil)
+		// Clones share the source of randomness.
+		m = m.Clone()
+		err = m.AddThirdPartyCaveat(testKey("other root key"), "another caveat", "remote.com")
+		c.Assert(err, gc.IsNil)
+		data, err := m.MarshalBinary()
+		c.Assert(err, gc.IsNil)
+		return data
+	}
+	c.Assert(newMacaroon(nil), gc.Not(gc.DeepEquals), newMacaroon(nil))
+
+	data := newMacaroon(mathrand.New(mathrand.NewSource(99)))
+	c.Assert(newMacaroon(mathrand.New(mathrand.NewSource(99))), gc.DeepEquals, data)
+	c.Assert(newMacaroon(mathrand.New(mathrand.NewSource(100))), gc.Not(gc.DeepEquals), data)
+}
+
+func (*macaroonSuite) TestAddThirdPartyCaveatWithRand(c *gc.C) {
+	newMacaroon := func(r io.Reader) *macaroon.Macaroon {
+		m := MustNew(testKey("secret"), "some id", "a location")
+		m.SetRand(&macaroon.ErrorReader{})
+		err := m.AddThirdPartyCaveatWithRand(testKey("shared root key"), "3rd party caveat", "remote.com", r)
+		c.Assert(err, gc.IsNil)
+		return m
+	}
+	m := newMacaroon(mathrand.New(mathrand.NewSource(99)))
+	c.Assert(newMacaroon(mathrand.New(mathrand.NewSource(99))).Signature(), gc.DeepEquals, m.Signature())
+	c.Assert(newMacaroon(nil).Signature(), gc.Not(gc.DeepEquals), m.Signature())
+
+	// The macaroon's own source of randomness is unchanged.
+	err := m.AddThirdPartyCaveat(testKey("other root key"), "another caveat", "remote.com")
 	c.Assert(err, gc.ErrorMatches, "cannot generate random bytes: fail")
 }
 
@@ -417,7 +538,7 @@ func (*macaroonSuite) TestVerify(c *gc.C) {
 }
 
 func (*macaroonSuite) TestMarshalJSON(c *gc.C) {
-	rootKey := []byte("secret")
+	rootKey := testKey("secret")
 	m0 := MustNew(rootKey, "some id", "a location")
 	m0.AddFirstPartyCaveat("account = 3735928559")
 	m0JSON, err := json.Marshal(m0)
@@ -435,16 +556,14 @@ func (*macaroonSuite) TestMarshalJSON(c *gc.C) {
 
 func (*macaroonSuite) TestJSONRoundTrip(c *gc.C) {
 	// jsonData produced from the second example in libmacaroons
-	// example README, but with the signature tweaked to
-	// match our current behaviour.
-	// TODO fix that behaviour so that our signatures match.
-	jsonData := `{"caveats":[{"cid":"account = 3735928559"},{"cid":"this was how we remind auth of key\/pred","vid":"AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA027FAuBYhtHwJ58FX6UlVNFtFsGxQHS7uD\/w\/dedwv4Jjw7UorCREw5rXbRqIKhr","cl":"http:\/\/auth.mybank\/"}],"location":"http:\/\/mybank\/","identifier":"we used our other secret key","signature":"6e315b0b391e8c6cc6f8d88fc22933a13430fb289b2fb613cf70f746bbe7d27d"}`
+	// example README.
+	jsonData := `{"caveats":[{"cid":"account = 3735928559"},{"cid":"this was how we remind auth of key\/pred","vid":"AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA027FAuBYhtHwJ58FX6UlVNFtFsGxQHS7uD\/w\/dedwv4Jjw7UorCREw5rXbRqIKhr","cl":"http:\/\/auth.mybank\/"}],"location":"http:\/\/mybank\/","identifier":"we used our other secret key","signature":"d27db2fd1f22760e4c3dae8137e2d8fc1df6c0741c18aed4b97256bf78d1f55c"}`
 
 	var m macaroon.Macaroon
 	err := json.Unmarshal([]byte(jsonData), &m)
 	c.Assert(err, gc.IsNil)
 	c.Assert(hex.EncodeToString(m.Signature()), gc.Equals,
-		"6e315b0b391e8c6cc6f8d88fc22933a13430fb289b2fb613cf70f746bbe7d27d")
+		"d27db2fd1f22760e4c3dae8137e2d8fc1df6c0741c18aed4b97256bf78d1f55c")
 	data, err := m.MarshalJSON()
 	c.Assert(err, gc.IsNil)
 
@@ -481,10 +600,10 @@ func makeMacaroons(mspecs []macaroonSpec) (
 ) {
 	var macaroons []*macaroon.Macaroon
 	for _, mspec := range mspecs {
-		m := MustNew([]byte(mspec.rootKey), mspec.id, mspec.location)
+		m := MustNew(testKey(mspec.rootKey), mspec.id, mspec.location)
 		for _, cav := range mspec.caveats {
 			if cav.location != "" {
-				err := m.AddThirdPartyCaveat([]byte(cav.rootKey), cav.condition, cav.location)
+				err := m.AddThirdPartyCaveat(testKey(cav.rootKey), cav.condition, cav.location)
 				if err != nil {
 					panic(err)
 				}
@@ -499,7 +618,7 @@ func makeMacaroons(mspecs []macaroonSpec) (
 	for _, m := range discharges {
 		m.Bind(primary.Signature())
 	}
-	return []byte(mspecs[0].rootKey), primary, discharges
+	return testKey(mspecs[0].rootKey), primary, discharges
 }
 
 func assertEqualMacaroons(c *gc.C, m0, m1 *macaroon.Macaroon) {
@@ -517,13 +636,13 @@ func assertEqualMacaroons(c *gc.C, m0, m1 *macaroon.Macaroon) {
 func (*macaroonSuite) TestBinaryRoundTrip(c *gc.C) {
 	// Test the binary marshalling and unmarshalling of a macaroon with
 	// first and third party caveats.
-	rootKey := []byte("secret")
+	rootKey := testKey("secret")
 	m0 := MustNew(rootKey, "some id", "a location")
 	err := m0.AddFirstPartyCaveat("first caveat")
 	c.Assert(err, gc.IsNil)
 	err = m0.AddFirstPartyCaveat("second caveat")
 	c.Assert(err, gc.IsNil)
-	err = m0.AddThirdPartyCaveat([]byte("shared root key"), "3rd party caveat", "remote.com")
+	err = m0.AddThirdPartyCaveat(testKey("shared root key"), "3rd party caveat", "remote.com")
 	c.Assert(err, gc.IsNil)
 	data, err := m0.MarshalBinary()
 	c.Assert(err, gc.IsNil)
@@ -541,28 +660,1004 @@ func (*macaroonSuite) TestBinaryMarshalingAgainstLibmacaroon(c *gc.C) {
 	var m0 macaroon.Macaroon
 	err = m0.UnmarshalBinary(data)
 	c.Assert(err, gc.IsNil)
-	jsonData := []byte(`{"caveats":[{"cid":"identifier\n","vid":"AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAuIvUMAoGy/8GRhby0KbMoSzr9L+lYyKNiib+Zos/u5K6gqbeRIZqy/KWDvca4U/NCg==","cl":"third party\n"}],"location":"somewhere\n","identifier":"id\n","signature":"dc15e42035f482200f3eb8240cb6e2306632ff3b02daa3dbe235381bf76886400a"}`)
+	jsonData := []byte(`{"caveats":[{"cid":"identifier","vid":"AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAuIvUMAoGy/8GRhby0KbMoSzr9L+lYyKNiib+Zos/u5K6gqbeRIZqy/KWDvca4U/N","cl":"third party"}],"location":"somewhere","identifier":"id","signature":"dc15e42035f482200f3eb8240cb6e2306632ff3b02daa3dbe235381bf7688640"}`)
 	var m1 macaroon.Macaroon
 	err = m1.UnmarshalJSON(jsonData)
 	c.Assert(err, gc.IsNil)
 	assertEqualMacaroons(c, &m0, &m1)
 }
 
-func (*macaroonSuite) TestMacaroonFieldsTooBig(c *gc.C) {
-	rootKey := []byte("secret")
+func (*macaroonSuite) TestMacaroonFieldsTooBigForV1(c *gc.C) {
+	rootKey := testKey("secret")
 	toobig := make([]byte, macaroon.MaxPacketLen)
 	_, err := rand.Reader.Read(toobig)
 	c.Assert(err, gc.IsNil)
-	_, err = macaroon.New(rootKey, string(toobig), "a location")
-	c.Assert(err, gc.ErrorMatches, "macaroon identifier too big")
-	_, err = macaroon.New(rootKey, "some id", string(toobig))
-	c.Assert(err, gc.ErrorMatches, "macaroon location too big")
 
+	m0 := MustNew(rootKey, string(toobig), "a location")
+	_, err = m0.MarshalBinary()
+	c.Assert(err, gc.ErrorMatches, `field "identifier" too big for v1 format`)
+
+	m0 = MustNew(rootKey, "some id", string(toobig))
+	_, err = m0.MarshalBinary()
+	c.Assert(err, gc.ErrorMatches, `field "location" too big for v1 format`)
+
+	m0 = MustNew(rootKey, "some id", "a location")
+	err = m0.AddThirdPartyCaveat(testKey("shared root key"), string(toobig), "remote.com")
+	c.Assert(err, gc.IsNil)
+	_, err = m0.MarshalBinary()
+	c.Assert(err, gc.ErrorMatches, `field "cid" too big for v1 format`)
+
+	// The verification id of a caveat added with AddThirdPartyCaveat
+	// is always small, so use an unmarshaled macaroon to check
+	// that a verification id that is too big is rejected.
+	jsonData := fmt.Sprintf(`{"caveats":[{"cid":"3rd party caveat","vid":%q,"cl":"remote.com"}],"location":"a location","identifier":"some id","signature":"%x"}`,
+		base64.StdEncoding.EncodeToString(toobig), m0.Signature())
+	m0 = new(macaroon.Macaroon)
+	err = m0.UnmarshalJSON([]byte(jsonData))
+	c.Assert(err, gc.IsNil)
+	_, err = m0.MarshalBinary()
+	c.Assert(err, gc.ErrorMatches, `field "vid" too big for v1 format`)
+
+	m0 = MustNew(rootKey, "some id", "a location")
+	err = m0.AddThirdPartyCaveat(testKey("shared root key"), "3rd party caveat", string(toobig))
+	c.Assert(err, gc.IsNil)
+	_, err = m0.MarshalBinary()
+	c.Assert(err, gc.ErrorMatches, `field "cl" too big for v1 format`)
+}
+
+func (*macaroonSuite) TestLargeFieldsV2(c *gc.C) {
+	rootKey := testKey("secret")
+	big := string(randomBytes(100000))
+	m0 := MustNew(rootKey, big, big)
+	err := m0.AddFirstPartyCaveat(big)
+	c.Assert(err, gc.IsNil)
+	err = m0.AddThirdPartyCaveat(testKey("shared root key"), big, big)
+	c.Assert(err, gc.IsNil)
+	m0.SetVersion(macaroon.V2)
+	data, err := m0.MarshalBinary()
+	c.Assert(err, gc.IsNil)
+
+	var m1 macaroon.Macaroon
+	err = m1.UnmarshalBinary(data)
+	c.Assert(err, gc.IsNil)
+	c.Assert(m1.Version(), gc.Equals, macaroon.V2)
+	c.Assert(m1.Id(), gc.Equals, big)
+	c.Assert(m1.Location(), gc.Equals, big)
+	assertEqualMacaroons(c, m0, &m1)
+}
+
+func (*macaroonSuite) TestBinaryRoundTripV2(c *gc.C) {
+	rootKey := testKey("secret")
 	m0 := MustNew(rootKey, "some id", "a location")
-	err = m0.AddThirdPartyCaveat(toobig, "3rd party caveat", "remote.com")
-	c.Assert(err, gc.ErrorMatches, "caveat verification id too big")
-	err = m0.AddThirdPartyCaveat([]byte("shared root key"), string(toobig), "remote.com")
-	c.Assert(err, gc.ErrorMatches, "caveat identifier too big")
-	err = m0.AddThirdPartyCaveat([]byte("shared root key"), "3rd party caveat", string(toobig))
-	c.Assert(err, gc.ErrorMatches, "caveat location too big")
+	err := m0.AddFirstPartyCaveat("first caveat")
+	c.Assert(err, gc.IsNil)
+	err = m0.AddThirdPartyCaveat(testKey("shared root key"), "3rd party caveat", "remote.com")
+	c.Assert(err, gc.IsNil)
+	err = m0.AddFirstPartyCaveat("second caveat")
+	c.Assert(err, gc.IsNil)
+	c.Assert(m0.Version(), gc.Equals, macaroon.V1)
+	m0.SetVersion(macaroon.V2)
+	data, err := m0.MarshalBinary()
+	c.Assert(err, gc.IsNil)
+	c.Assert(data[0], gc.Equals, byte(2))
+
+	var m1 macaroon.Macaroon
+	err = m1.UnmarshalBinary(data)
+	c.Assert(err, gc.IsNil)
+	c.Assert(m1.Version(), gc.Equals, macaroon.V2)
+	assertEqualMacaroons(c, m0, &m1)
+	c.Assert(m1.Caveats(), gc.HasLen, 3)
+
+	err = m1.Verify(rootKey, func(string) error { return nil }, []*macaroon.Macaroon{
+		bound(MustNew(testKey("shared root key"), "3rd party caveat", ""), m1.Signature()),
+	})
+	c.Assert(err, gc.IsNil)
+
+	// Unmarshaling a version 1 macaroon gives a version 1 macaroon.
+	m1.SetVersion(macaroon.V1)
+	data, err = m1.MarshalBinary()
+	c.Assert(err, gc.IsNil)
+	var m2 macaroon.Macaroon
+	err = m2.UnmarshalBinary(data)
+	c.Assert(err, gc.IsNil)
+	c.Assert(m2.Version(), gc.Equals, macaroon.V1)
+	assertEqualMacaroons(c, m0, &m2)
+}
+
+func bound(m *macaroon.Macaroon, rootSig []byte) *macaroon.Macaroon {
+	m.Bind(rootSig)
+	return m
+}
+
+func (*macaroonSuite) TestMarshalBinaryV2Format(c *gc.C) {
+	m := MustNew(testKey("secret"), "id", "loc")
+	err := m.AddFirstPartyCaveat("cav")
+	c.Assert(err, gc.IsNil)
+	m.SetVersion(macaroon.V2)
+	data, err := m.MarshalBinary()
+	c.Assert(err, gc.IsNil)
+	expect := "\x02" +
+		"\x01\x03loc" +
+		"\x02\x02id" +
+		"\x00" +
+		"\x02\x03cav" +
+		"\x00" +
+		"\x00" +
+		"\x06\x20" + string(m.Signature())
+	c.Assert(string(data), gc.Equals, expect)
+}
+
+func (*macaroonSuite) TestUnmarshalBinaryOldV1Format(c *gc.C) {
+	// Earlier versions of this package did not terminate
+	// version 1 packets with a newline character. Such data
+	// is no longer accepted.
+	oldPacket := func(field, data string) string {
+		return fmt.Sprintf("%04x%s %s", 4+len(field)+1+len(data), field, data)
+	}
+	data := oldPacket("location", "loc") +
+		oldPacket("identifier", "id") +
+		oldPacket("signature", strings.Repeat("x", 32))
+	var m macaroon.Macaroon
+	err := m.UnmarshalBinary([]byte(data))
+	c.Assert(err, gc.FitsTypeOf, (*macaroon.FormatError)(nil))
+	c.Assert(err, gc.ErrorMatches, "no terminating newline in packet")
+}
+
+func (*macaroonSuite) TestMarshalBinaryUnknownVersion(c *gc.C) {
+	m := MustNew(testKey("secret"), "id", "loc")
+	m.SetVersion(99)
+	_, err := m.MarshalBinary()
+	c.Assert(err, gc.ErrorMatches, "unknown macaroon version v99")
+}
+
+var unmarshalBinaryV2ErrorTests = []struct {
+	about     string
+	data      string
+	expectErr string
+}{{
+	about:     "empty data",
+	data:      "",
+	expectErr: "empty macaroon data",
+}, {
+	about:     "no identifier",
+	data:      "\x02\x01\x03loc\x00",
+	expectErr: "invalid macaroon header",
+}, {
+	about:     "truncated header",
+	data:      "\x02\x02\x02id",
+	expectErr: "unexpected end of data",
+}, {
+	about:     "caveat without identifier",
+	data:      "\x02\x02\x02id\x00\x01\x03loc\x00",
+	expectErr: "no identifier in caveat",
+}, {
+	about:     "caveat with unknown field",
+	data:      "\x02\x02\x02id\x00\x02\x03cav\x05\x00\x00",
+	expectErr: "unexpected field type 5 in caveat",
+}, {
+	about:     "fields out of order",
+	data:      "\x02\x02\x02id\x01\x03loc\x00",
+	expectErr: "fields out of order",
+}, {
+	about:     "no signature",
+	data:      "\x02\x02\x02id\x00\x00\x02\x01x",
+	expectErr: "unexpected field type 2; expected signature",
+}, {
+	about:     "field length too big",
+	data:      "\x02\x02\x7fid\x00\x00",
+	expectErr: "field length too big",
+}}
+
+func (*macaroonSuite) TestUnmarshalBinaryV2Errors(c *gc.C) {
+	for i, test := range unmarshalBinaryV2ErrorTests {
+		c.Logf("test %d: %s", i, test.about)
+		var m macaroon.Macaroon
+		err := m.UnmarshalBinary([]byte(test.data))
+		c.Assert(err, gc.ErrorMatches, test.expectErr)
+	}
+}
+
+func (*macaroonSuite) TestMarshalText(c *gc.C) {
+	// The macaroon from the first example in the
+	// libmacaroons README.
+	rootKey := []byte("this is our super secret key; only we should know it")
+	m0 := MustNew(rootKey, "we used our secret key", "http://mybank/")
+	for _, cav := range []string{"account = 3735928559", "time < 2020-01-01T00:00", "email = alice@example.org"} {
+		err := m0.AddFirstPartyCaveat(cav)
+		c.Assert(err, gc.IsNil)
+	}
+	text, err := m0.MarshalText()
+	c.Assert(err, gc.IsNil)
+	c.Assert(string(text), gc.Equals, "MDAxY2xvY2F0aW9uIGh0dHA6Ly9teWJhbmsvCjAwMjZpZGVudGlmaWVyIHdlIHVzZWQgb3VyIHNlY3JldCBrZXkKMDAxZGNpZCBhY2NvdW50ID0gMzczNTkyODU1OQowMDIwY2lkIHRpbWUgPCAyMDIwLTAxLTAxVDAwOjAwCjAwMjJjaWQgZW1haWwgPSBhbGljZUBleGFtcGxlLm9yZwowMDJmc2lnbmF0dXJlIN31U-Rgg-VbjXGrgivj2PzyHWvxnEDWF7uftDiTRHS2Cg")
+
+	var m1 macaroon.Macaroon
+	err = m1.UnmarshalText(text)
+	c.Assert(err, gc.IsNil)
+	assertEqualMacaroons(c, m0, &m1)
+	err = m1.Verify(rootKey, func(string) error { return nil }, nil)
+	c.Assert(err, gc.IsNil)
+}
+
+func (*macaroonSuite) TestUnmarshalTextStdEncoding(c *gc.C) {
+	// Some implementations produce padded base64 using
+	// the standard alphabet.
+	text := "MDAxN2xvY2F0aW9uIHNvbWV3aGVyZQowMDEyaWRlbnRpZmllciBpZAowMDEzY2lkIGlkZW50aWZpZXIKMDA1MXZpZCAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAC4i9QwCgbL/wZGFvLQpsyhLOv0v6VjIo2KJv5miz+7krqCpt5EhmrL8pYO9xrhT80KMDAxM2NsIHRoaXJkIHBhcnR5CjAwMmZzaWduYXR1cmUg3BXkIDX0giAPPrgkDLbiMGYy/zsC2qPb4jU4G/dohkAK"
+	var m macaroon.Macaroon
+	err := m.UnmarshalText([]byte(text))
+	c.Assert(err, gc.IsNil)
+	c.Assert(m.Location(), gc.Equals, "somewhere")
+	c.Assert(m.Id(), gc.Equals, "id")
+	caveats := m.Caveats()
+	c.Assert(caveats, gc.HasLen, 1)
+	c.Assert(caveats[0].Id, gc.Equals, "identifier")
+	c.Assert(caveats[0].Location, gc.Equals, "third party")
+	c.Assert(caveats[0].VerificationId, gc.HasLen, 72)
+}
+
+func (*macaroonSuite) TestUnmarshalTextPaddingOnlyAtEnd(c *gc.C) {
+	m := MustNew(testKey("secret"), "id", "loc")
+	text, err := m.MarshalText()
+	c.Assert(err, gc.IsNil)
+	padded := base64.StdEncoding.EncodeToString(mustMarshalBinary(c, m))
+	var m1 macaroon.Macaroon
+	err = m1.UnmarshalText([]byte(padded))
+	c.Assert(err, gc.IsNil)
+	assertEqualMacaroons(c, m, &m1)
+
+	bad := string(text[:4]) + "=" + string(text[4:])
+	err = m1.UnmarshalText([]byte(bad))
+	c.Assert(err, gc.ErrorMatches, "cannot decode macaroon: illegal base64 padding")
+}
+
+func mustMarshalBinary(c *gc.C, m *macaroon.Macaroon) []byte {
+	data, err := m.MarshalBinary()
+	c.Assert(err, gc.IsNil)
+	return data
+}
+
+func (*macaroonSuite) TestCaveats(c *gc.C) {
+	m := MustNew(testKey("secret"), "some id", "a location")
+	err := m.AddFirstPartyCaveat("first caveat")
+	c.Assert(err, gc.IsNil)
+	m.SetRand(zeroReader{})
+	err = m.AddThirdPartyCaveat(testKey("shared root key"), "3rd party caveat", "remote.com")
+	c.Assert(err, gc.IsNil)
+	err = m.AddThirdPartyCaveat(testKey("shared root key"), "no location", "")
+	c.Assert(err, gc.IsNil)
+
+	caveats := m.Caveats()
+	c.Assert(caveats, gc.HasLen, 3)
+	c.Assert(caveats[0], gc.DeepEquals, macaroon.Caveat{
+		Id: "first caveat",
+	})
+	c.Assert(caveats[0].IsThirdParty(), gc.Equals, false)
+
+	c.Assert(caveats[1].Id, gc.Equals, "3rd party caveat")
+	c.Assert(caveats[1].Location, gc.Equals, "remote.com")
+	c.Assert(caveats[1].VerificationId, gc.HasLen, 72)
+	c.Assert(caveats[1].VerificationId[0:24], gc.DeepEquals, make([]byte, 24))
+	c.Assert(caveats[1].IsThirdParty(), gc.Equals, true)
+
+	// A third party caveat need not have a location.
+	c.Assert(caveats[2].Location, gc.Equals, "")
+	c.Assert(caveats[2].IsThirdParty(), gc.Equals, true)
+
+	// Changing the returned caveats does not change the macaroon.
+	sig := m.Signature()
+	caveats[1].VerificationId[30] ^= 1
+	c.Assert(m.Caveats()[1].VerificationId, gc.Not(gc.DeepEquals), caveats[1].VerificationId)
+	err = m.Verify(testKey("secret"), func(string) error { return nil }, []*macaroon.Macaroon{
+		bound(MustNew(testKey("shared root key"), "3rd party caveat", ""), sig),
+		bound(MustNew(testKey("shared root key"), "no location", ""), sig),
+	})
+	c.Assert(err, gc.IsNil)
+}
+
+func (*macaroonSuite) TestUnmarshalTextBadBase64(c *gc.C) {
+	var m macaroon.Macaroon
+	err := m.UnmarshalText([]byte("!!!"))
+	c.Assert(err, gc.ErrorMatches, "cannot decode macaroon: .*")
+}
+
+func (*macaroonSuite) TestSliceRoundTrip(c *gc.C) {
+	rootKey, primary, discharges := makeMacaroons(recursiveThirdPartyCaveatMacaroons)
+	ms0 := append(macaroon.Slice{primary}, discharges...)
+	// Check that the slice may contain macaroons of
+	// different versions.
+	discharges[1].SetVersion(macaroon.V2)
+
+	data, err := ms0.MarshalBinary()
+	c.Assert(err, gc.IsNil)
+	var ms1 macaroon.Slice
+	err = ms1.UnmarshalBinary(data)
+	c.Assert(err, gc.IsNil)
+	c.Assert(ms1, gc.HasLen, len(ms0))
+	for i := range ms0 {
+		assertEqualMacaroons(c, ms0[i], ms1[i])
+	}
+
+	text, err := ms0.MarshalText()
+	c.Assert(err, gc.IsNil)
+	var ms2 macaroon.Slice
+	err = ms2.UnmarshalText(text)
+	c.Assert(err, gc.IsNil)
+	c.Assert(ms2, gc.HasLen, len(ms0))
+	for i := range ms0 {
+		assertEqualMacaroons(c, ms0[i], ms2[i])
+	}
+	err = ms2[0].Verify(rootKey, func(string) error { return nil }, ms2[1:])
+	c.Assert(err, gc.IsNil)
+}
+
+func (*macaroonSuite) TestSliceUnmarshalBinaryError(c *gc.C) {
+	m := MustNew(testKey("secret"), "some id", "a location")
+	data, err := m.MarshalBinary()
+	c.Assert(err, gc.IsNil)
+	data = append(data, "0014field some data\n"...)
+	var ms macaroon.Slice
+	err = ms.UnmarshalBinary(data)
+	c.Assert(err, gc.ErrorMatches, `cannot unmarshal macaroon 1: unexpected field "field"; expected location`)
+}
+
+func (*macaroonSuite) TestSliceJSONRoundTrip(c *gc.C) {
+	rootKey, primary, discharges := makeMacaroons(recursiveThirdPartyCaveatMacaroons)
+	ms0 := append(macaroon.Slice{primary}, discharges...)
+
+	data, err := json.Marshal(ms0)
+	c.Assert(err, gc.IsNil)
+	var raw []interface{}
+	err = json.Unmarshal(data, &raw)
+	c.Assert(err, gc.IsNil)
+	c.Assert(raw, gc.HasLen, len(ms0))
+
+	var ms1 macaroon.Slice
+	err = json.Unmarshal(data, &ms1)
+	c.Assert(err, gc.IsNil)
+	c.Assert(ms1, gc.HasLen, len(ms0))
+	for i := range ms0 {
+		assertEqualMacaroons(c, ms0[i], ms1[i])
+	}
+	err = ms1.Verify(rootKey, func(string) error { return nil })
+	c.Assert(err, gc.IsNil)
+}
+
+func (*macaroonSuite) TestSliceMarshalJSONEmpty(c *gc.C) {
+	data, err := json.Marshal(macaroon.Slice(nil))
+	c.Assert(err, gc.IsNil)
+	c.Assert(string(data), gc.Equals, "[]")
+}
+
+func (*macaroonSuite) TestSliceUnmarshalJSONNull(c *gc.C) {
+	var ms macaroon.Slice
+	err := json.Unmarshal([]byte(`[null]`), &ms)
+	c.Assert(err, gc.ErrorMatches, "null macaroon at index 0")
+}
+
+func (*macaroonSuite) TestSliceBindAndVerify(c *gc.C) {
+	rootKey := testKey("secret")
+	m := MustNew(rootKey, "some id", "a location")
+	err := m.AddThirdPartyCaveat(testKey("shared root key"), "3rd party caveat", "remote.com")
+	c.Assert(err, gc.IsNil)
+	dm := MustNew(testKey("shared root key"), "3rd party caveat", "remote.com")
+	ms := macaroon.Slice{m, dm}
+
+	// The discharge macaroon has not been bound yet.
+	err = ms.Verify(rootKey, func(string) error { return nil })
+	c.Assert(err, gc.ErrorMatches, "signature mismatch after caveat verification")
+
+	ms.Bind()
+	err = ms.Verify(rootKey, func(string) error { return nil })
+	c.Assert(err, gc.IsNil)
+
+	err = ms.Verify([]byte("wrong key"), func(string) error { return nil })
+	c.Assert(err, gc.ErrorMatches, "failed to decrypt caveat 0 signature")
+}
+
+func (*macaroonSuite) TestSliceVerifyEmpty(c *gc.C) {
+	err := macaroon.Slice{}.Verify(testKey("secret"), func(string) error { return nil })
+	c.Assert(err, gc.ErrorMatches, "no macaroons in slice")
+	macaroon.Slice{}.Bind()
+}
+
+func (*macaroonSuite) TestBinaryIds(c *gc.C) {
+	rootKey := testKey("secret")
+	id := []byte("\xff\x00binary id\xfe")
+	m0, err := macaroon.NewBytes(rootKey, id, "a location")
+	c.Assert(err, gc.IsNil)
+	c.Assert(m0.IdBytes(), gc.DeepEquals, id)
+	c.Assert(m0.Id(), gc.Equals, string(id))
+
+	m1 := MustNew(rootKey, string(id), "a location")
+	c.Assert(m1.Signature(), gc.DeepEquals, m0.Signature())
+
+	cid := []byte("\x80first party")
+	err = m0.AddFirstPartyCaveatBytes(cid)
+	c.Assert(err, gc.IsNil)
+	tpcid := []byte("\x81third party")
+	err = m0.AddThirdPartyCaveatBytes(testKey("shared root key"), tpcid, "remote.com")
+	c.Assert(err, gc.IsNil)
+	caveats := m0.Caveats()
+	c.Assert(caveats[0].Id, gc.Equals, string(cid))
+	c.Assert(caveats[1].Id, gc.Equals, string(tpcid))
+
+	dm, err := macaroon.NewBytes(testKey("shared root key"), tpcid, "remote.com")
+	c.Assert(err, gc.IsNil)
+	dm.Bind(m0.Signature())
+	check := func(cav string) error {
+		if cav != string(cid) {
+			return fmt.Errorf("unexpected caveat %q", cav)
+		}
+		return nil
+	}
+	err = m0.Verify(rootKey, check, []*macaroon.Macaroon{dm})
+	c.Assert(err, gc.IsNil)
+
+	// Check that the binary data survives a JSON round trip.
+	data, err := json.Marshal(m0)
+	c.Assert(err, gc.IsNil)
+	var m2 macaroon.Macaroon
+	err = json.Unmarshal(data, &m2)
+	c.Assert(err, gc.IsNil)
+	c.Assert(m2.IdBytes(), gc.DeepEquals, id)
+	c.Assert(m2.Caveats(), gc.DeepEquals, m0.Caveats())
+	err = m2.Verify(rootKey, check, []*macaroon.Macaroon{dm})
+	c.Assert(err, gc.IsNil)
+
+	// The base64 fields are used only for data that
+	// is not valid UTF-8.
+	var fields map[string]interface{}
+	err = json.Unmarshal(data, &fields)
+	c.Assert(err, gc.IsNil)
+	c.Assert(fields["identifier"], gc.IsNil)
+	c.Assert(fields["identifier64"], gc.Equals, base64.RawURLEncoding.EncodeToString(id))
+	cav0 := fields["caveats"].([]interface{})[0].(map[string]interface{})
+	c.Assert(cav0["cid"], gc.IsNil)
+	c.Assert(cav0["cid64"], gc.Equals, base64.RawURLEncoding.EncodeToString(cid))
+}
+
+var unmarshalJSONErrorTests = []struct {
+	about     string
+	json      string
+	expectErr string
+}{{
+	about:     "both identifier fields",
+	json:      `{"identifier": "a", "identifier64": "YQ", "signature": ""}`,
+	expectErr: "both identifier and identifier64 found",
+}, {
+	about:     "both cid fields",
+	json:      `{"identifier": "a", "signature": "", "caveats": [{"cid": "a", "cid64": "YQ"}]}`,
+	expectErr: "both cid and cid64 found",
+}, {
+	about:     "bad base64 identifier",
+	json:      `{"identifier64": "!", "signature": ""}`,
+	expectErr: "cannot decode identifier64: .*",
+}, {
+	about:     "base64 padding in the middle",
+	json:      `{"identifier64": "a=b=c", "signature": ""}`,
+	expectErr: "cannot decode identifier64: illegal base64 padding",
+}, {
+	about:     "base64 padding of wrong length",
+	json:      `{"identifier64": "YQ=", "signature": ""}`,
+	expectErr: "cannot decode identifier64: illegal base64 padding",
+}, {
+	about:     "bad signature",
+	json:      `{"identifier": "a", "signature": "xx"}`,
+	expectErr: `cannot decode macaroon signature "xx": .*`,
+}, {
+	about:     "short signature",
+	json:      `{"identifier": "a", "signature": "0102"}`,
+	expectErr: `signature has unexpected length 2`,
+}, {
+	about:     "caveat without identifier",
+	json:      `{"identifier": "a", "signature": "", "caveats": [{"cl": "somewhere"}]}`,
+	expectErr: `no identifier in caveat`,
+}, {
+	about:     "caveat with empty identifier",
+	json:      `{"identifier": "a", "signature": "", "caveats": [{"cid": ""}]}`,
+	expectErr: `no identifier in caveat`,
+}, {
+	about:     "unknown field",
+	json:      `{"identifier": "a", "signature": "", "expires": "never"}`,
+	expectErr: `cannot unmarshal json data: json: unknown field "expires"`,
+}, {
+	about:     "unknown caveat field",
+	json:      `{"identifier": "a", "signature": "", "caveats": [{"cid": "a", "vid64": ""}]}`,
+	expectErr: `cannot unmarshal json data: json: unknown field "vid64"`,
+}, {
+	about:     "trailing data",
+	json:      `{"identifier": "a", "signature": ""} {}`,
+	expectErr: `unexpected data after macaroon`,
+}}
+
+func (*macaroonSuite) TestUnmarshalJSONErrors(c *gc.C) {
+	for i, test := range unmarshalJSONErrorTests {
+		c.Logf("test %d: %s", i, test.about)
+		var m macaroon.Macaroon
+		err := m.UnmarshalJSON([]byte(test.json))
+		c.Assert(err, gc.ErrorMatches, test.expectErr)
+	}
+}
+
+// v1Packets returns the V1 binary encoding of the given
+// fields, each of which holds a field name and its data
+// separated by a space.
+func v1Packets(fields ...string) string {
+	var data []byte
+	for _, f := range fields {
+		data = append(data, fmt.Sprintf("%04x%s\n", len(f)+5, f)...)
+	}
+	return string(data)
+}
+
+var sig32 = strings.Repeat("s", 32)
+
+var unmarshalBinaryV1ErrorTests = []struct {
+	about     string
+	data      string
+	expectErr string
+}{{
+	about:     "vid without cid",
+	data:      v1Packets("location loc", "identifier id", "vid xxx", "signature "+sig32),
+	expectErr: `field "vid" found before "cid"`,
+}, {
+	about:     "cl without cid",
+	data:      v1Packets("location loc", "identifier id", "cl somewhere", "signature "+sig32),
+	expectErr: `field "cl" found before "cid"`,
+}, {
+	about:     "repeated vid",
+	data:      v1Packets("location loc", "identifier id", "cid c", "vid a", "vid b", "signature "+sig32),
+	expectErr: `repeated field "vid" in caveat`,
+}, {
+	about:     "repeated cl",
+	data:      v1Packets("location loc", "identifier id", "cid c", "cl a", "cl b", "signature "+sig32),
+	expectErr: `repeated field "cl" in caveat`,
+}, {
+	about:     "empty cid",
+	data:      v1Packets("location loc", "identifier id", "cid ", "signature "+sig32),
+	expectErr: `no identifier in caveat`,
+}, {
+	about:     "missing signature",
+	data:      v1Packets("location loc", "identifier id", "cid c"),
+	expectErr: `missing signature`,
+}, {
+	about:     "short signature",
+	data:      v1Packets("location loc", "identifier id", "signature sig"),
+	expectErr: `signature has unexpected length 3`,
+}, {
+	about:     "trailing data",
+	data:      v1Packets("location loc", "identifier id", "signature "+sig32) + "x",
+	expectErr: `unexpected data after signature`,
+}}
+
+func (*macaroonSuite) TestUnmarshalBinaryV1Errors(c *gc.C) {
+	for i, test := range unmarshalBinaryV1ErrorTests {
+		c.Logf("test %d: %s", i, test.about)
+		var m macaroon.Macaroon
+		err := m.UnmarshalBinary([]byte(test.data))
+		c.Assert(err, gc.ErrorMatches, test.expectErr)
+		c.Assert(err, gc.FitsTypeOf, (*macaroon.FormatError)(nil))
+	}
+}
+
+func (*macaroonSuite) TestUnmarshalBinaryV2EmptyCaveatId(c *gc.C) {
+	// Version, identifier, end of header, empty caveat
+	// identifier, end of caveat, end of caveats, signature.
+	data := "\x02\x02\x02id\x00\x02\x00\x00\x00\x06\x20" + sig32
+	var m macaroon.Macaroon
+	err := m.UnmarshalBinary([]byte(data))
+	c.Assert(err, gc.ErrorMatches, `no identifier in caveat`)
+	c.Assert(err, gc.FitsTypeOf, (*macaroon.FormatError)(nil))
+
+	// The same macaroon with a non-empty caveat identifier is accepted.
+	data = "\x02\x02\x02id\x00\x02\x01c\x00\x00\x06\x20" + sig32
+	err = m.UnmarshalBinary([]byte(data))
+	c.Assert(err, gc.IsNil)
+	c.Assert(m.Caveats(), gc.HasLen, 1)
+}
+
+func (*macaroonSuite) TestUnmarshalErrorLeavesMacaroonUnchanged(c *gc.C) {
+	m := MustNew(testKey("secret"), "some id", "a location")
+	data := v1Packets("location loc", "identifier id", "signature sig")
+	err := m.UnmarshalBinary([]byte(data))
+	c.Assert(err, gc.NotNil)
+	c.Assert(m.Id(), gc.Equals, "some id")
+	c.Assert(m.Location(), gc.Equals, "a location")
+}
+
+var unmarshalLimitsTests = []struct {
+	about       string
+	limits      macaroon.UnmarshalLimits
+	id          string
+	caveats     int
+	expectLimit string
+}{{
+	about:   "within limits",
+	limits:  macaroon.UnmarshalLimits{MaxSize: 1000, MaxCaveats: 3, MaxFieldLen: 10},
+	id:      "some id",
+	caveats: 3,
+}, {
+	about:       "too large",
+	limits:      macaroon.UnmarshalLimits{MaxSize: 100},
+	id:          "some id",
+	caveats:     10,
+	expectLimit: "MaxSize",
+}, {
+	about:       "too many caveats",
+	limits:      macaroon.UnmarshalLimits{MaxCaveats: 3},
+	id:          "some id",
+	caveats:     4,
+	expectLimit: "MaxCaveats",
+}, {
+	about:       "field too long",
+	limits:      macaroon.UnmarshalLimits{MaxFieldLen: 5},
+	id:          "some id",
+	expectLimit: "MaxFieldLen",
+}}
+
+func (*macaroonSuite) TestUnmarshalLimits(c *gc.C) {
+	for i, test := range unmarshalLimitsTests {
+		c.Logf("test %d: %s", i, test.about)
+		m := MustNew(testKey("secret"), test.id, "loc")
+		for j := 0; j < test.caveats; j++ {
+			err := m.AddFirstPartyCaveat(fmt.Sprint("cav", j))
+			c.Assert(err, gc.IsNil)
+		}
+		for _, vers := range []macaroon.Version{macaroon.V1, macaroon.V2} {
+			m.SetVersion(vers)
+			data, err := m.MarshalBinary()
+			c.Assert(err, gc.IsNil)
+			jsonData, err := m.MarshalJSON()
+			c.Assert(err, gc.IsNil)
+			checkErr := func(err error) {
+				if test.expectLimit == "" {
+					c.Assert(err, gc.IsNil)
+					return
+				}
+				c.Assert(err, gc.FitsTypeOf, (*macaroon.LimitError)(nil))
+				c.Assert(err.(*macaroon.LimitError).Limit, gc.Equals, test.expectLimit)
+			}
+			var m1 macaroon.Macaroon
+			checkErr(m1.UnmarshalBinaryWithLimits(data, test.limits))
+			checkErr(m1.UnmarshalJSONWithLimits(jsonData, test.limits))
+
+			var ms macaroon.Slice
+			err = ms.UnmarshalBinaryWithLimits(data, test.limits)
+			checkErr(err)
+			jsonData, err = macaroon.Slice{m}.MarshalJSON()
+			c.Assert(err, gc.IsNil)
+			limits := test.limits
+			if test.expectLimit == "MaxSize" {
+				// The JSON slice is larger than the binary form.
+				limits.MaxSize = len(jsonData) - 1
+			}
+			checkErr(ms.UnmarshalJSONWithLimits(jsonData, limits))
+		}
+	}
+}
+
+func (*macaroonSuite) TestUnmarshalLimitErrorMessages(c *gc.C) {
+	m := MustNew(testKey("secret"), "some id", "loc")
+	data, err := m.MarshalBinary()
+	c.Assert(err, gc.IsNil)
+	var m1 macaroon.Macaroon
+	err = m1.UnmarshalBinaryWithLimits(data, macaroon.UnmarshalLimits{MaxSize: 10})
+	c.Assert(err, gc.ErrorMatches, `macaroon data too large \(maximum 10 bytes\)`)
+	err = m1.UnmarshalBinaryWithLimits(data, macaroon.UnmarshalLimits{MaxFieldLen: 3})
+	c.Assert(err, gc.ErrorMatches, `macaroon field "identifier" too long \(maximum 3 bytes\)`)
+}
+
+func (*macaroonSuite) TestUnmarshalTextTooLarge(c *gc.C) {
+	var m macaroon.Macaroon
+	err := m.UnmarshalText(bytes.Repeat([]byte("a"), macaroon.DefaultMaxSize*2))
+	c.Assert(err, gc.FitsTypeOf, (*macaroon.LimitError)(nil))
+}
+
+func (*macaroonSuite) TestEqualAndFingerprint(c *gc.C) {
+	rootKey := testKey("secret")
+	m0 := MustNew(rootKey, "some id", "a location")
+	err := m0.AddFirstPartyCaveat("a caveat")
+	c.Assert(err, gc.IsNil)
+	m0.SetRand(zeroReader{})
+	err = m0.AddThirdPartyCaveat(testKey("shared root key"), "3rd party caveat", "remote.com")
+	c.Assert(err, gc.IsNil)
+
+	// A copy is equal regardless of its binary format version.
+	data, err := m0.MarshalBinary()
+	c.Assert(err, gc.IsNil)
+	var m1 macaroon.Macaroon
+	err = m1.UnmarshalBinary(data)
+	c.Assert(err, gc.IsNil)
+	m1.SetVersion(macaroon.V2)
+	c.Assert(m0.Equal(&m1), gc.Equals, true)
+	c.Assert(m1.Equal(m0), gc.Equals, true)
+	c.Assert(m0.Fingerprint(), gc.Equals, m1.Fingerprint())
+
+	// Changing any part of the macaroon changes
+	// its fingerprint.
+	other := []*macaroon.Macaroon{
+		MustNew(rootKey, "some id", "a location"),
+		MustNew(rootKey, "some id", "another location"),
+		MustNew(rootKey, "other id", "a location"),
+		MustNew(testKey("other key"), "some id", "a location"),
+	}
+	m2 := m0.Clone()
+	m2.AddFirstPartyCaveat("another caveat")
+	m3 := m0.Clone()
+	m3.Bind([]byte("root signature"))
+	m4, err := macaroon.NewWithAlgorithm(macaroon.BLAKE2b, bytes.Repeat(rootKey, 6), []byte("some id"), "a location")
+	c.Assert(err, gc.IsNil)
+	other = append(other, m2, m3, m4)
+	for i, m := range other {
+		c.Logf("test %d", i)
+		c.Assert(m0.Equal(m), gc.Equals, false)
+		c.Assert(m.Equal(m0), gc.Equals, false)
+		c.Assert(m0.Fingerprint(), gc.Not(gc.Equals), m.Fingerprint())
+	}
+
+	// Discharges with the same id and signature are
+	// distinguished by their caveats.
+	d0 := MustNew(rootKey, "d", "")
+	d1 := MustNew(rootKey, "d", "")
+	d1.AddFirstPartyCaveat("x")
+	c.Assert(d0.Equal(d1), gc.Equals, false)
+	c.Assert(d0.Fingerprint(), gc.Not(gc.Equals), d1.Fingerprint())
+
+	var nilm *macaroon.Macaroon
+	c.Assert(nilm.Equal(nil), gc.Equals, true)
+	c.Assert(nilm.Equal(m0), gc.Equals, false)
+	c.Assert(m0.Equal(nil), gc.Equals, false)
+}
+
+var algorithms = []macaroon.Algorithm{
+	macaroon.HMACSHA256,
+	macaroon.HMACSHA512,
+	macaroon.BLAKE2b,
+}
+
+func (*macaroonSuite) TestAlgorithms(c *gc.C) {
+	rootKey := randomBytes(32)
+	dischargeRootKey := randomBytes(32)
+	for _, alg := range algorithms {
+		c.Logf("algorithm %v", alg)
+		m, err := macaroon.NewWithAlgorithm(alg, rootKey, []byte("some id"), "a location")
+		c.Assert(err, gc.IsNil)
+		c.Assert(m.Algorithm(), gc.Equals, alg)
+		err = m.AddFirstPartyCaveat("a caveat")
+		c.Assert(err, gc.IsNil)
+		err = m.AddThirdPartyCaveat(dischargeRootKey, "3rd party caveat", "remote.com")
+		c.Assert(err, gc.IsNil)
+
+		d, err := macaroon.NewWithAlgorithm(alg, dischargeRootKey, []byte("3rd party caveat"), "remote.com")
+		c.Assert(err, gc.IsNil)
+		d.Bind(m.Signature())
+		check := func(cav string) error {
+			if cav == "a caveat" {
+				return nil
+			}
+			return fmt.Errorf("condition %q not met", cav)
+		}
+		err = m.Verify(rootKey, check, []*macaroon.Macaroon{d})
+		c.Assert(err, gc.IsNil)
+
+		// The algorithm survives marshaling in all formats.
+		for _, v := range []macaroon.Version{macaroon.V1, macaroon.V2} {
+			m.SetVersion(v)
+			data, err := m.MarshalBinary()
+			c.Assert(err, gc.IsNil)
+			var m1 macaroon.Macaroon
+			err = m1.UnmarshalBinary(data)
+			c.Assert(err, gc.IsNil)
+			c.Assert(m1.Algorithm(), gc.Equals, alg)
+			c.Assert(m1.Equal(m), gc.Equals, true)
+			err = m1.Verify(rootKey, check, []*macaroon.Macaroon{d})
+			c.Assert(err, gc.IsNil)
+		}
+		data, err := json.Marshal(m)
+		c.Assert(err, gc.IsNil)
+		var m1 macaroon.Macaroon
+		err = json.Unmarshal(data, &m1)
+		c.Assert(err, gc.IsNil)
+		c.Assert(m1.Algorithm(), gc.Equals, alg)
+		c.Assert(m1.Equal(m), gc.Equals, true)
+
+		// The signature depends on the algorithm.
+		sig := MustNewWithAlgorithm(alg, rootKey, "some id", "a location").Signature()
+		for _, alg1 := range algorithms {
+			if alg1 != alg {
+				m1 := MustNewWithAlgorithm(alg1, rootKey, "some id", "a location")
+				c.Assert(m1.Signature(), gc.Not(gc.DeepEquals), sig)
+			}
+		}
+	}
+}
+
+// signatureVectors holds fixed signatures for each algorithm,
+// so that any change to the signature format is caught.
+var signatureVectors = []struct {
+	alg          macaroon.Algorithm
+	sig          string
+	dischargeSig string
+}{{
+	alg:          macaroon.HMACSHA256,
+	sig:          "d60992fd99c8e8ee9d05c61d71268b2e6a76fa4890ff4af6abd8bbbb4dfde5cb",
+	dischargeSig: "e1df92b6874dfdee35e4221dff111f14b2d8806a86be6ba38e0b6861f12a646a",
+}, {
+	alg:          macaroon.HMACSHA512,
+	sig:          "b86d64363428385cbdaa04eadb3bf7f1b85099f52a80e5777cc9e7f65e82e6e2",
+	dischargeSig: "eef6ba3d193e9ac03444249a293de76b6bd86943a3c18688bab0e4a247ad868f",
+}, {
+	alg:          macaroon.BLAKE2b,
+	sig:          "8a148eda0a941b0d30da86fc96f4ceecf58ef96fee815373442e724bf36527e0",
+	dischargeSig: "14d32b2dbae602d42d046abff02064571faf091ac81b6132b5a6ffb47a24f393",
+}}
+
+func (*macaroonSuite) TestSignatureVectors(c *gc.C) {
+	rootKey := []byte("this is our super secret key; only we should know it")
+	for _, test := range signatureVectors {
+		c.Logf("algorithm %v", test.alg)
+		m := MustNewWithAlgorithm(test.alg, rootKey, "we used our secret key", "http://mybank/")
+		err := m.AddFirstPartyCaveat("account = 3735928559")
+		c.Assert(err, gc.IsNil)
+		err = m.AddFirstPartyCaveat("time < 2030-01-01T00:00")
+		c.Assert(err, gc.IsNil)
+		c.Check(hex.EncodeToString(m.Signature()), gc.Equals, test.sig)
+
+		dm := MustNewWithAlgorithm(test.alg, []byte("4; guaranteed random by a fair toss of the dice"), "other id", "http://auth.mybank/")
+		err = dm.AddFirstPartyCaveat("user = alice")
+		c.Assert(err, gc.IsNil)
+		dm.Bind(m.Signature())
+		c.Check(hex.EncodeToString(dm.Signature()), gc.Equals, test.dischargeSig)
+	}
+}
+
+func MustNewWithAlgorithm(alg macaroon.Algorithm, rootKey []byte, id, loc string) *macaroon.Macaroon {
+	m, err := macaroon.NewWithAlgorithm(alg, rootKey, []byte(id), loc)
+	if err != nil {
+		panic(err)
+	}
+	return m
+}
+
+func (*macaroonSuite) TestDefaultAlgorithmNotMarshaled(c *gc.C) {
+	m := MustNew(testKey("secret"), "some id", "a location")
+	c.Assert(m.Algorithm(), gc.Equals, macaroon.HMACSHA256)
+	data, err := json.Marshal(m)
+	c.Assert(err, gc.IsNil)
+	c.Assert(string(data), gc.Not(gc.Matches), `.*"algorithm".*`)
+	data, err = m.MarshalBinary()
+	c.Assert(err, gc.IsNil)
+	c.Assert(string(data), gc.Not(gc.Matches), `(?s).*algorithm.*`)
+
+	m = MustNewWithAlgorithm(macaroon.HMACSHA512, randomBytes(32), "some id", "a location")
+	data, err = json.Marshal(m)
+	c.Assert(err, gc.IsNil)
+	c.Assert(string(data), gc.Matches, `.*"algorithm":"hmac-sha512".*`)
+}
+
+func (*macaroonSuite) TestDischargeWithOtherAlgorithm(c *gc.C) {
+	rootKey := randomBytes(32)
+	dischargeRootKey := randomBytes(32)
+	m := MustNewWithAlgorithm(macaroon.HMACSHA512, rootKey, "some id", "a location")
+	err := m.AddThirdPartyCaveat(dischargeRootKey, "3rd party caveat", "remote.com")
+	c.Assert(err, gc.IsNil)
+	d := MustNewWithAlgorithm(macaroon.BLAKE2b, dischargeRootKey, "3rd party caveat", "remote.com")
+	d.Bind(m.Signature())
+	err = m.Verify(rootKey, never, []*macaroon.Macaroon{d})
+	c.Assert(err, gc.DeepEquals, &macaroon.AlgorithmMismatchError{
+		MacaroonId:  "3rd party caveat",
+		InDischarge: true,
+		Algorithm:   macaroon.BLAKE2b,
+		Expected:    macaroon.HMACSHA512,
+	})
+	c.Assert(err, gc.ErrorMatches, `macaroon "3rd party caveat" uses algorithm blake2b, not hmac-sha512`)
+}
+
+func (*macaroonSuite) TestVerifyRequireAlgorithm(c *gc.C) {
+	rootKey := randomBytes(32)
+	dischargeRootKey := randomBytes(32)
+	m := MustNewWithAlgorithm(macaroon.HMACSHA512, rootKey, "some id", "a location")
+	err := m.AddThirdPartyCaveat(dischargeRootKey, "3rd party caveat", "remote.com")
+	c.Assert(err, gc.IsNil)
+	d := MustNewWithAlgorithm(macaroon.HMACSHA512, dischargeRootKey, "3rd party caveat", "remote.com")
+	d.Bind(m.Signature())
+
+	err = m.VerifyWithOptions(rootKey, never, []*macaroon.Macaroon{d}, macaroon.VerifyOptions{
+		RequireAlgorithm: true,
+		Algorithm:        macaroon.HMACSHA512,
+	})
+	c.Assert(err, gc.IsNil)
+
+	// The zero Algorithm is HMACSHA256, so it is
+	// required only if RequireAlgorithm is set.
+	err = m.VerifyWithOptions(rootKey, never, []*macaroon.Macaroon{d}, macaroon.VerifyOptions{
+		Algorithm: macaroon.HMACSHA256,
+	})
+	c.Assert(err, gc.IsNil)
+
+	var checked []string
+	check := func(cond string) error {
+		checked = append(checked, cond)
+		return nil
+	}
+	err = m.VerifyWithOptions(rootKey, check, []*macaroon.Macaroon{d}, macaroon.VerifyOptions{
+		RequireAlgorithm: true,
+	})
+	c.Assert(err, gc.DeepEquals, &macaroon.AlgorithmMismatchError{
+		MacaroonId: "some id",
+		Algorithm:  macaroon.HMACSHA512,
+		Expected:   macaroon.HMACSHA256,
+	})
+	c.Assert(checked, gc.HasLen, 0)
+
+	t, err := m.VerifyWithTrace(rootKey, never, []*macaroon.Macaroon{d}, macaroon.VerifyOptions{
+		RequireAlgorithm: true,
+		Algorithm:        macaroon.BLAKE2b,
+	})
+	c.Assert(err, gc.FitsTypeOf, (*macaroon.AlgorithmMismatchError)(nil))
+	c.Assert(t.Id, gc.Equals, "some id")
+	c.Assert(t.SignatureOK, gc.Equals, false)
+	c.Assert(t.Err, gc.Equals, err)
+}
+
+func (*macaroonSuite) TestRootKeyTooShort(c *gc.C) {
+	_, err := macaroon.NewWithAlgorithm(macaroon.BLAKE2b, []byte("short"), []byte("id"), "")
+	c.Assert(err, gc.ErrorMatches, `root key too short for blake2b \(5 bytes; minimum 32\)`)
+	c.Assert(err, gc.FitsTypeOf, (*macaroon.RootKeyLengthError)(nil))
+
+	_, err = macaroon.New([]byte("secret"), "id", "")
+	c.Assert(err, gc.ErrorMatches, `root key too short for hmac-sha256 \(6 bytes; minimum 32\)`)
+
+	m, err := macaroon.NewWithLegacyRootKey([]byte("secret"), []byte("id"), "")
+	c.Assert(err, gc.IsNil)
+	err = m.Verify([]byte("secret"), func(string) error { return nil }, nil)
+	c.Assert(err, gc.IsNil)
+
+	_, err = macaroon.NewWithLegacyRootKey(nil, []byte("id"), "")
+	c.Assert(err, gc.ErrorMatches, `root key too short for hmac-sha256 \(0 bytes; minimum 1\)`)
+
+	m = MustNewWithAlgorithm(macaroon.HMACSHA512, randomBytes(32), "id", "")
+
+	err = m.AddThirdPartyCaveat([]byte("short"), "3rd party caveat", "remote.com")
+	c.Assert(err, gc.ErrorMatches, `root key too short for hmac-sha512 \(5 bytes; minimum 32\)`)
+	c.Assert(m.Caveats(), gc.HasLen, 0)
+
+	_, err = macaroon.NewWithAlgorithm(macaroon.Algorithm(99), randomBytes(32), []byte("id"), "")
+	c.Assert(err, gc.ErrorMatches, `unknown algorithm Algorithm\(99\)`)
+}
+
+var unmarshalAlgorithmErrorTests = []struct {
+	about       string
+	data        string
+	expectError string
+}{{
+	about:       "unknown V1 algorithm",
+	data:        v1Packets("location ", "identifier id", "algorithm foo", "signature "+sig32),
+	expectError: `unknown algorithm "foo"`,
+}, {
+	about:       "V1 algorithm after caveat",
+	data:        v1Packets("location ", "identifier id", "cid x", "algorithm blake2b", "signature "+sig32),
+	expectError: `unexpected field "algorithm"`,
+}, {
+	about:       "unknown V2 algorithm",
+	data:        "\x02\x02\x02id\x08\x03foo\x00\x00\x06\x20" + sig32,
+	expectError: `unknown algorithm "foo"`,
+}, {
+	about:       "unknown JSON algorithm",
+	data:        `{"location":"","identifier":"id","signature":"` + hex.EncodeToString([]byte(sig32)) + `","algorithm":"foo"}`,
+	expectError: `unknown algorithm "foo"`,
+}}
+
+func (*macaroonSuite) TestUnmarshalAlgorithmErrors(c *gc.C) {
+	for i, test := range unmarshalAlgorithmErrorTests {
+		c.Logf("test %d: %v", i, test.about)
+		var m macaroon.Macaroon
+		var err error
+		if strings.HasPrefix(test.data, "{") {
+			err = m.UnmarshalJSON([]byte(test.data))
+		} else {
+			err = m.UnmarshalBinary([]byte(test.data))
+		}
+		c.Assert(err, gc.ErrorMatches, test.expectError)
+		c.Assert(err, gc.FitsTypeOf, (*macaroon.FormatError)(nil))
+	}
 }
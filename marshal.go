@@ -1,10 +1,12 @@
 package macaroon
 
 import (
+	"bytes"
 	"encoding/base64"
 	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"unicode/utf8"
 )
 
 // field names, as defined in libmacaroons
@@ -15,6 +17,12 @@ const (
 	fieldCaveatId       = "cid"
 	fieldVerificationId = "vid"
 	fieldCaveatLocation = "cl"
+
+	// fieldAlgorithm is not defined by libmacaroons.
+	// It holds the name of the macaroon's algorithm and
+	// is omitted for the default algorithm, so that
+	// default macaroons remain compatible.
+	fieldAlgorithm = "algorithm"
 )
 
 var (
@@ -27,16 +35,23 @@ var (
 )
 
 // macaroonJSON defines the JSON format for macaroons.
+//
+// Identifiers and caveat ids that are not valid UTF-8 cannot be
+// represented as JSON strings, so they are stored base64-encoded
+// in the Identifier64 and CID64 fields instead.
 type macaroonJSON struct {
-	Caveats    []caveatJSON `json:"caveats"`
-	Location   string       `json:"location"`
-	Identifier string       `json:"identifier"`
-	Signature  string       `json:"signature"` // hex-encoded
+	Caveats      []caveatJSON `json:"caveats"`
+	Location     string       `json:"location"`
+	Identifier   string       `json:"identifier,omitempty"`
+	Identifier64 string       `json:"identifier64,omitempty"`
+	Signature    string       `json:"signature"` // hex-encoded
+	Algorithm    string       `json:"algorithm,omitempty"`
 }
 
 // caveatJSON defines the JSON format for caveats within a macaroon.
 type caveatJSON struct {
-	CID      string `json:"cid"`
+	CID      string `json:"cid,omitempty"`
+	CID64    string `json:"cid64,omitempty"`
 	VID      string `json:"vid,omitempty"`
 	Location string `json:"cl,omitempty"`
 }
@@ -44,17 +59,21 @@ type caveatJSON struct {
 // MarshalJSON implements json.Marshaler.
 func (m *Macaroon) MarshalJSON() ([]byte, error) {
 	mjson := macaroonJSON{
-		Location:   m.Location(),
-		Identifier: m.dataStr(m.id),
-		Signature:  hex.EncodeToString(m.sig),
-		Caveats:    make([]caveatJSON, len(m.caveats)),
+		Location:  m.Location(),
+		Signature: hex.EncodeToString(m.sig),
+		Caveats:   make([]caveatJSON, len(m.caveats)),
 	}
+	if m.alg != HMACSHA256 {
+		mjson.Algorithm = m.alg.String()
+	}
+	mjson.Identifier, mjson.Identifier64 = jsonBytes(m.dataBytes(m.id))
 	for i, cav := range m.caveats {
-		mjson.Caveats[i] = caveatJSON{
+		cavJSON := caveatJSON{
 			Location: m.dataStr(cav.location),
-			CID:      m.dataStr(cav.caveatId),
 			VID:      base64.StdEncoding.EncodeToString(m.dataBytes(cav.verificationId)),
 		}
+		cavJSON.CID, cavJSON.CID64 = jsonBytes(m.dataBytes(cav.caveatId))
+		mjson.Caveats[i] = cavJSON
 	}
 	data, err := json.Marshal(mjson)
 	if err != nil {
@@ -64,116 +83,683 @@ func (m *Macaroon) MarshalJSON() ([]byte, error) {
 }
 
 // UnmarshalJSON implements json.Unmarshaler.
+// It uses the default UnmarshalLimits.
 func (m *Macaroon) UnmarshalJSON(jsonData []byte) error {
+	return m.UnmarshalJSONWithLimits(jsonData, UnmarshalLimits{})
+}
+
+// UnmarshalJSONWithLimits is like UnmarshalJSON except that
+// it uses the given limits. If the data exceeds any of the
+// limits, it returns a *LimitError; if it is otherwise
+// malformed, it returns a *FormatError.
+func (m *Macaroon) UnmarshalJSONWithLimits(jsonData []byte, limits UnmarshalLimits) error {
+	limits = limits.withDefaults()
+	if err := limits.checkSize(len(jsonData)); err != nil {
+		return err
+	}
+	m1, err := parseJSON(jsonData, &limits)
+	if err != nil {
+		return unmarshalError("", err)
+	}
+	*m = *m1
+	return nil
+}
+
+// parseJSON parses a JSON-marshaled macaroon.
+// Unknown fields are rejected.
+func parseJSON(jsonData []byte, limits *UnmarshalLimits) (*Macaroon, error) {
 	var mjson macaroonJSON
-	err := json.Unmarshal(jsonData, &mjson)
+	dec := json.NewDecoder(bytes.NewReader(jsonData))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&mjson); err != nil {
+		return nil, fmt.Errorf("cannot unmarshal json data: %v", err)
+	}
+	if dec.More() {
+		return nil, fmt.Errorf("unexpected data after macaroon")
+	}
+	if err := limits.checkCaveats(len(mjson.Caveats)); err != nil {
+		return nil, err
+	}
+	id, err := jsonBytesValue(fieldIdentifier, mjson.Identifier, mjson.Identifier64)
 	if err != nil {
-		return fmt.Errorf("cannot unmarshal json data: %v", err)
+		return nil, err
 	}
-	if err := m.init(mjson.Identifier, mjson.Location); err != nil {
-		return err
+	if err := limits.checkField(fieldIdentifier, id); err != nil {
+		return nil, err
+	}
+	if err := limits.checkField(fieldLocation, []byte(mjson.Location)); err != nil {
+		return nil, err
+	}
+	alg := HMACSHA256
+	if mjson.Algorithm != "" {
+		alg, err = parseAlgorithm(mjson.Algorithm)
+		if err != nil {
+			return nil, err
+		}
 	}
+	var m Macaroon
+	m.init(id, mjson.Location, alg)
 	m.sig, err = hex.DecodeString(mjson.Signature)
 	if err != nil {
-		return fmt.Errorf("cannot decode macaroon signature %q: %v", m.sig, err)
+		return nil, fmt.Errorf("cannot decode macaroon signature %q: %v", mjson.Signature, err)
 	}
-	m.caveats = m.caveats[:0]
 	for _, cav := range mjson.Caveats {
+		cid, err := jsonBytesValue(fieldCaveatId, cav.CID, cav.CID64)
+		if err != nil {
+			return nil, err
+		}
 		vid, err := base64.StdEncoding.DecodeString(cav.VID)
 		if err != nil {
-			return fmt.Errorf("cannot decode verification id %q: %v", cav.VID, err)
+			return nil, fmt.Errorf("cannot decode verification id %q: %v", cav.VID, err)
+		}
+		if len(cid) == 0 {
+			return nil, fmt.Errorf("no identifier in caveat")
 		}
-		if _, err := m.appendCaveat(cav.CID, vid, cav.Location); err != nil {
-			return err
+		if err := limits.checkField(fieldCaveatId, cid); err != nil {
+			return nil, err
 		}
+		if err := limits.checkField(fieldVerificationId, vid); err != nil {
+			return nil, err
+		}
+		if err := limits.checkField(fieldCaveatLocation, []byte(cav.Location)); err != nil {
+			return nil, err
+		}
+		m.appendCaveat(cid, vid, cav.Location)
+	}
+	if err := checkSignature(m.sig); err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
+
+// checkSignature checks that sig has the length
+// of a valid macaroon signature.
+func checkSignature(sig []byte) error {
+	if len(sig) != keyLen {
+		return fmt.Errorf("signature has unexpected length %d", len(sig))
 	}
 	return nil
 }
 
+// jsonBytes returns the values of the plain and base64
+// JSON fields used to hold data. Data that is valid UTF-8
+// is held in the plain field.
+func jsonBytes(data []byte) (plain, b64 string) {
+	if utf8.Valid(data) {
+		return string(data), ""
+	}
+	return "", string(base64Encode(data))
+}
+
+// jsonBytesValue returns the data held in the plain
+// and base64 JSON fields for the given field name.
+func jsonBytesValue(field string, plain, b64 string) ([]byte, error) {
+	if b64 == "" {
+		return []byte(plain), nil
+	}
+	if plain != "" {
+		return nil, fmt.Errorf("both %s and %s64 found", field, field)
+	}
+	data, err := base64Decode([]byte(b64))
+	if err != nil {
+		return nil, fmt.Errorf("cannot decode %s64: %v", field, err)
+	}
+	return data, nil
+}
+
+// Version specifies the binary format used when
+// marshaling a macaroon.
+type Version uint16
+
+const (
+	// V1 specifies the original binary format, as used by
+	// libmacaroons version 1. Each field is limited to
+	// less than 64KB.
+	V1 Version = 1
+
+	// V2 specifies the more compact binary format used by
+	// libmacaroons version 2. There is no limit on the size of
+	// a field.
+	V2 Version = 2
+)
+
+// String returns a string representation of the version;
+// for example V1 formats as "v1".
+func (v Version) String() string {
+	return fmt.Sprintf("v%d", uint16(v))
+}
+
+// Version returns the binary format that will be used when the
+// macaroon is marshaled. Macaroons created with New use V1;
+// macaroons created with UnmarshalBinary use the version that
+// they were marshaled with.
+func (m *Macaroon) Version() Version {
+	if m.version == 0 {
+		return V1
+	}
+	return m.version
+}
+
+// SetVersion sets the binary format that will be used
+// when the macaroon is marshaled.
+func (m *Macaroon) SetVersion(v Version) {
+	m.version = v
+}
+
 // MarshalBinary implements encoding.BinaryMarshaler.
+// The macaroon is marshaled in the binary format
+// specified by its version.
 func (m *Macaroon) MarshalBinary() ([]byte, error) {
-	data := make([]byte, len(m.data), len(m.data)+len(m.sig))
-	copy(data, m.data)
-	data, _, ok := rawAppendPacket(data, fieldSignature, m.sig)
-	if !ok {
-		panic("cannot append signature")
+	return m.appendBinary(nil)
+}
+
+// appendBinary appends the binary encoding of m to data.
+func (m *Macaroon) appendBinary(data []byte) ([]byte, error) {
+	switch v := m.Version(); v {
+	case V1:
+		return m.appendBinaryV1(data)
+	case V2:
+		return m.appendBinaryV2(data), nil
+	default:
+		return nil, fmt.Errorf("unknown macaroon version %v", v)
 	}
-	return data, nil
 }
 
-// The binary format of a macaroon is as follows.
+// The version 1 binary format of a macaroon is as follows.
 // Each identifier repesents a packet.
 //
 // location
 // identifier
+// algorithm?
 // (
-//	caveatId?
+//	caveatId
 //	verificationId?
 //	caveatLocation?
 // )*
 // signature
 
+func (m *Macaroon) appendBinaryV1(data []byte) ([]byte, error) {
+	appendField := func(field string, fieldData []byte) error {
+		var ok bool
+		data, _, ok = appendPacket(data, field, fieldData)
+		if !ok {
+			return fmt.Errorf("field %q too big for %v format", field, V1)
+		}
+		return nil
+	}
+	if err := appendField(fieldLocation, m.dataBytes(m.location)); err != nil {
+		return nil, err
+	}
+	if err := appendField(fieldIdentifier, m.dataBytes(m.id)); err != nil {
+		return nil, err
+	}
+	if m.alg != HMACSHA256 {
+		if err := appendField(fieldAlgorithm, []byte(m.alg.String())); err != nil {
+			return nil, err
+		}
+	}
+	for _, cav := range m.caveats {
+		if err := appendField(fieldCaveatId, m.dataBytes(cav.caveatId)); err != nil {
+			return nil, err
+		}
+		if cav.verificationId.len > 0 {
+			if err := appendField(fieldVerificationId, m.dataBytes(cav.verificationId)); err != nil {
+				return nil, err
+			}
+		}
+		if cav.location.len > 0 {
+			if err := appendField(fieldCaveatLocation, m.dataBytes(cav.location)); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if err := appendField(fieldSignature, m.sig); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+func (m *Macaroon) appendBinaryV2(data []byte) []byte {
+	data = append(data, byte(V2))
+	if m.location.len > 0 {
+		data = appendPacketV2(data, fieldTypeLocation, m.dataBytes(m.location))
+	}
+	data = appendPacketV2(data, fieldTypeIdentifier, m.dataBytes(m.id))
+	if m.alg != HMACSHA256 {
+		data = appendPacketV2(data, fieldTypeAlgorithm, []byte(m.alg.String()))
+	}
+	data = appendEOSV2(data)
+	for _, cav := range m.caveats {
+		if cav.location.len > 0 {
+			data = appendPacketV2(data, fieldTypeLocation, m.dataBytes(cav.location))
+		}
+		data = appendPacketV2(data, fieldTypeIdentifier, m.dataBytes(cav.caveatId))
+		if cav.verificationId.len > 0 {
+			data = appendPacketV2(data, fieldTypeVerificationId, m.dataBytes(cav.verificationId))
+		}
+		data = appendEOSV2(data)
+	}
+	data = appendEOSV2(data)
+	return appendPacketV2(data, fieldTypeSignature, m.sig)
+}
+
 // UnmarshalBinary implements encoding.BinaryUnmarshaler.
+// It accepts both V1 and V2 formats. It uses the default
+// UnmarshalLimits.
 func (m *Macaroon) UnmarshalBinary(data []byte) error {
-	m.data = append([]byte(nil), data...)
+	return m.UnmarshalBinaryWithLimits(data, UnmarshalLimits{})
+}
 
-	var err error
-	var start int
+// UnmarshalBinaryWithLimits is like UnmarshalBinary except that
+// it uses the given limits. If the data exceeds any of the
+// limits, it returns a *LimitError; if it is otherwise
+// malformed, it returns a *FormatError.
+func (m *Macaroon) UnmarshalBinaryWithLimits(data []byte, limits UnmarshalLimits) error {
+	limits = limits.withDefaults()
+	if err := limits.checkSize(len(data)); err != nil {
+		return err
+	}
+	var m1 Macaroon
+	rest, err := m1.parseBinary(data, &limits)
+	if err != nil {
+		return unmarshalError("", err)
+	}
+	if len(rest) > 0 {
+		return &FormatError{Reason: "unexpected data after signature"}
+	}
+	*m = m1
+	return nil
+}
+
+// parseBinary parses a binary-marshalled macaroon from the start
+// of data and returns any data remaining after its signature.
+func (m *Macaroon) parseBinary(data []byte, limits *UnmarshalLimits) ([]byte, error) {
+	m.data = nil
+	m.caveats = nil
+	m.alg = HMACSHA256
+	if len(data) == 0 {
+		return nil, fmt.Errorf("empty macaroon data")
+	}
+	// The version 1 format always starts with an ASCII
+	// hex digit, so there is no ambiguity.
+	if data[0] == byte(V2) {
+		m.version = V2
+		return m.parseBinaryV2(data[1:], limits)
+	}
+	m.version = V1
+	return m.parseBinaryV1(data, limits)
+}
 
-	start, m.location, err = m.expectPacket(0, fieldLocation)
+func (m *Macaroon) parseBinaryV1(data []byte, limits *UnmarshalLimits) ([]byte, error) {
+	start, p, err := expectPacket(data, 0, fieldLocation)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	start, m.id, err = m.expectPacket(start, fieldIdentifier)
+	if err := limits.checkField(fieldLocation, p.dataBytes(data)); err != nil {
+		return nil, err
+	}
+	m.location = m.appendData(p.dataBytes(data))
+	start, p, err = expectPacket(data, start, fieldIdentifier)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	if err := limits.checkField(fieldIdentifier, p.dataBytes(data)); err != nil {
+		return nil, err
+	}
+	m.id = m.appendData(p.dataBytes(data))
+	if p, err := parsePacket(data, start); err == nil && string(p.fieldName(data)) == fieldAlgorithm {
+		m.alg, err = parseAlgorithm(string(p.dataBytes(data)))
+		if err != nil {
+			return nil, err
+		}
+		start += p.len()
 	}
 	var cav caveat
+	inCaveat, haveVid, haveLoc := false, false, false
 	for {
-		p, err := m.parsePacket(start)
+		if start >= len(data) {
+			return nil, fmt.Errorf("missing signature")
+		}
+		p, err := parsePacket(data, start)
 		if err != nil {
-			return err
+			return nil, err
 		}
 		start += p.len()
-		switch field := string(m.fieldName(p)); field {
+		field, pdata := string(p.fieldName(data)), p.dataBytes(data)
+		switch field {
 		case fieldSignature:
 			// At the end of the caveats we find the signature.
-			if cav.caveatId.len() != 0 {
+			if inCaveat {
 				m.caveats = append(m.caveats, cav)
 			}
-			// Remove the signature from data.
-			m.data = m.data[0:p.start]
-			m.sig = append([]byte(nil), m.dataBytes(p)...)
-			return nil
+			if err := checkSignature(pdata); err != nil {
+				return nil, err
+			}
+			m.sig = append([]byte(nil), pdata...)
+			return data[start:], nil
 		case fieldCaveatId:
-			if cav.caveatId.len() != 0 {
+			if inCaveat {
 				m.caveats = append(m.caveats, cav)
 			}
-			cav.caveatId = p
+			if err := limits.checkCaveats(len(m.caveats) + 1); err != nil {
+				return nil, err
+			}
+			if err := limits.checkField(field, pdata); err != nil {
+				return nil, err
+			}
+			if len(pdata) == 0 {
+				return nil, fmt.Errorf("no identifier in caveat")
+			}
+			cav = caveat{caveatId: m.appendData(pdata)}
+			inCaveat, haveVid, haveLoc = true, false, false
 		case fieldVerificationId:
-			if cav.verificationId.len() != 0 {
-				return fmt.Errorf("repeated field %q in caveat", fieldVerificationId)
+			if !inCaveat {
+				return nil, fmt.Errorf("field %q found before %q", field, fieldCaveatId)
 			}
-			cav.verificationId = p
+			if haveVid {
+				return nil, fmt.Errorf("repeated field %q in caveat", field)
+			}
+			if err := limits.checkField(field, pdata); err != nil {
+				return nil, err
+			}
+			cav.verificationId = m.appendData(pdata)
+			haveVid = true
 		case fieldCaveatLocation:
-			if cav.location.len() != 0 {
-				return fmt.Errorf("repeated field %q in caveat", fieldLocation)
+			if !inCaveat {
+				return nil, fmt.Errorf("field %q found before %q", field, fieldCaveatId)
+			}
+			if haveLoc {
+				return nil, fmt.Errorf("repeated field %q in caveat", field)
+			}
+			if err := limits.checkField(field, pdata); err != nil {
+				return nil, err
 			}
-			cav.location = p
+			cav.location = m.appendData(pdata)
+			haveLoc = true
 		default:
-			return fmt.Errorf("unexpected field %q", field)
+			return nil, fmt.Errorf("unexpected field %q", field)
 		}
 	}
-	return nil
 }
 
-func (m *Macaroon) expectPacket(start int, kind string) (int, packet, error) {
-	p, err := m.parsePacket(start)
+func expectPacket(data []byte, start int, kind string) (int, packet, error) {
+	p, err := parsePacket(data, start)
 	if err != nil {
 		return 0, packet{}, err
 	}
-	if field := string(m.fieldName(p)); field != kind {
+	if field := string(p.fieldName(data)); field != kind {
 		return 0, packet{}, fmt.Errorf("unexpected field %q; expected %s", field, kind)
 	}
 	return start + p.len(), p, nil
 }
+
+// parseBinaryV2 parses a macaroon in the version 2 format
+// from data, which should not include the version byte.
+func (m *Macaroon) parseBinaryV2(data []byte, limits *UnmarshalLimits) ([]byte, error) {
+	section, data, err := parseSectionV2(data)
+	if err != nil {
+		return nil, err
+	}
+	var loc []byte
+	if len(section) > 0 && section[0].fieldType == fieldTypeLocation {
+		loc, section = section[0].data, section[1:]
+	}
+	if len(section) == 0 || section[0].fieldType != fieldTypeIdentifier {
+		return nil, fmt.Errorf("invalid macaroon header")
+	}
+	id, section := section[0].data, section[1:]
+	if len(section) > 0 && section[0].fieldType == fieldTypeAlgorithm {
+		m.alg, err = parseAlgorithm(string(section[0].data))
+		if err != nil {
+			return nil, err
+		}
+		section = section[1:]
+	}
+	if len(section) != 0 {
+		return nil, fmt.Errorf("invalid macaroon header")
+	}
+	if err := limits.checkField(fieldLocation, loc); err != nil {
+		return nil, err
+	}
+	if err := limits.checkField(fieldIdentifier, id); err != nil {
+		return nil, err
+	}
+	m.location = m.appendData(loc)
+	m.id = m.appendData(id)
+	for {
+		if len(data) == 0 {
+			return nil, fmt.Errorf("unexpected end of data")
+		}
+		if data[0] == fieldTypeEOS {
+			data = data[1:]
+			break
+		}
+		if err := limits.checkCaveats(len(m.caveats) + 1); err != nil {
+			return nil, err
+		}
+		section, data, err = parseSectionV2(data)
+		if err != nil {
+			return nil, err
+		}
+		var cav caveat
+		if len(section) > 0 && section[0].fieldType == fieldTypeLocation {
+			if err := limits.checkField(fieldCaveatLocation, section[0].data); err != nil {
+				return nil, err
+			}
+			cav.location, section = m.appendData(section[0].data), section[1:]
+		}
+		if len(section) == 0 || section[0].fieldType != fieldTypeIdentifier || len(section[0].data) == 0 {
+			return nil, fmt.Errorf("no identifier in caveat")
+		}
+		if err := limits.checkField(fieldCaveatId, section[0].data); err != nil {
+			return nil, err
+		}
+		cav.caveatId, section = m.appendData(section[0].data), section[1:]
+		if len(section) > 0 && section[0].fieldType == fieldTypeVerificationId {
+			if err := limits.checkField(fieldVerificationId, section[0].data); err != nil {
+				return nil, err
+			}
+			cav.verificationId, section = m.appendData(section[0].data), section[1:]
+		}
+		if len(section) != 0 {
+			return nil, fmt.Errorf("unexpected field type %d in caveat", section[0].fieldType)
+		}
+		m.caveats = append(m.caveats, cav)
+	}
+	p, data, err := parsePacketV2(data)
+	if err != nil {
+		return nil, err
+	}
+	if p.fieldType != fieldTypeSignature {
+		return nil, fmt.Errorf("unexpected field type %d; expected signature", p.fieldType)
+	}
+	if err := checkSignature(p.data); err != nil {
+		return nil, err
+	}
+	m.sig = append([]byte(nil), p.data...)
+	return data, nil
+}
+
+// MarshalText implements encoding.TextMarshaler. The text form of
+// a macaroon is its binary form encoded with URL-safe base64 without
+// padding, as produced by libmacaroons and pymacaroons serialize.
+func (m *Macaroon) MarshalText() ([]byte, error) {
+	data, err := m.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	return base64Encode(data), nil
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler.
+// It accepts both URL-safe and standard base64
+// encodings, with or without padding. It uses the
+// default UnmarshalLimits.
+func (m *Macaroon) UnmarshalText(text []byte) error {
+	limits := UnmarshalLimits{}.withDefaults()
+	if err := limits.checkTextSize(text); err != nil {
+		return err
+	}
+	data, err := base64Decode(text)
+	if err != nil {
+		return &FormatError{Reason: fmt.Sprintf("cannot decode macaroon: %v", err)}
+	}
+	return m.UnmarshalBinaryWithLimits(data, limits)
+}
+
+// Slice holds a slice of macaroons. This is conventionally
+// a primary macaroon followed by the discharge macaroons
+// for its third party caveats.
+type Slice []*Macaroon
+
+// MarshalBinary implements encoding.BinaryMarshaler.
+// The binary form of a slice is the concatenation of the
+// binary forms of its macaroons.
+func (s Slice) MarshalBinary() ([]byte, error) {
+	var data []byte
+	for _, m := range s {
+		var err error
+		data, err = m.appendBinary(data)
+		if err != nil {
+			return nil, fmt.Errorf("cannot marshal macaroon %q: %v", m.Id(), err)
+		}
+	}
+	return data, nil
+}
+
+// UnmarshalBinary implements encoding.BinaryUnmarshaler.
+// It uses the default UnmarshalLimits.
+func (s *Slice) UnmarshalBinary(data []byte) error {
+	return s.UnmarshalBinaryWithLimits(data, UnmarshalLimits{})
+}
+
+// UnmarshalBinaryWithLimits is like UnmarshalBinary except
+// that it uses the given limits. The MaxSize limit applies
+// to the data for the whole slice; the other limits apply
+// to each macaroon.
+func (s *Slice) UnmarshalBinaryWithLimits(data []byte, limits UnmarshalLimits) error {
+	limits = limits.withDefaults()
+	if err := limits.checkSize(len(data)); err != nil {
+		return err
+	}
+	ms := (*s)[:0]
+	for len(data) > 0 {
+		var m Macaroon
+		rest, err := m.parseBinary(data, &limits)
+		if err != nil {
+			return unmarshalError(fmt.Sprintf("cannot unmarshal macaroon %d", len(ms)), err)
+		}
+		ms = append(ms, &m)
+		data = rest
+	}
+	*s = ms
+	return nil
+}
+
+// MarshalJSON implements json.Marshaler. The JSON form of
+// a slice is an array holding the JSON form of each macaroon.
+func (s Slice) MarshalJSON() ([]byte, error) {
+	if s == nil {
+		s = Slice{}
+	}
+	return json.Marshal([]*Macaroon(s))
+}
+
+// UnmarshalJSON implements json.Unmarshaler.
+// It uses the default UnmarshalLimits.
+func (s *Slice) UnmarshalJSON(data []byte) error {
+	return s.UnmarshalJSONWithLimits(data, UnmarshalLimits{})
+}
+
+// UnmarshalJSONWithLimits is like UnmarshalJSON except
+// that it uses the given limits. The MaxSize limit applies
+// to the data for the whole slice; the other limits apply
+// to each macaroon.
+func (s *Slice) UnmarshalJSONWithLimits(data []byte, limits UnmarshalLimits) error {
+	limits = limits.withDefaults()
+	if err := limits.checkSize(len(data)); err != nil {
+		return err
+	}
+	var rawms []json.RawMessage
+	if err := json.Unmarshal(data, &rawms); err != nil {
+		return &FormatError{Reason: fmt.Sprintf("cannot unmarshal json data: %v", err)}
+	}
+	var ms Slice
+	if rawms != nil {
+		ms = make(Slice, len(rawms))
+	}
+	for i, raw := range rawms {
+		if string(raw) == "null" {
+			return &FormatError{Reason: fmt.Sprintf("null macaroon at index %d", i)}
+		}
+		m, err := parseJSON(raw, &limits)
+		if err != nil {
+			return unmarshalError(fmt.Sprintf("cannot unmarshal macaroon %d", i), err)
+		}
+		ms[i] = m
+	}
+	*s = ms
+	return nil
+}
+
+// MarshalText implements encoding.TextMarshaler. The text
+// form of a slice is its binary form encoded in the same way
+// as for a single macaroon.
+func (s Slice) MarshalText() ([]byte, error) {
+	data, err := s.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	return base64Encode(data), nil
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler.
+// It uses the default UnmarshalLimits.
+func (s *Slice) UnmarshalText(text []byte) error {
+	limits := UnmarshalLimits{}.withDefaults()
+	if err := limits.checkTextSize(text); err != nil {
+		return err
+	}
+	data, err := base64Decode(text)
+	if err != nil {
+		return &FormatError{Reason: fmt.Sprintf("cannot decode macaroons: %v", err)}
+	}
+	return s.UnmarshalBinaryWithLimits(data, limits)
+}
+
+func base64Encode(data []byte) []byte {
+	text := make([]byte, base64.RawURLEncoding.EncodedLen(len(data)))
+	base64.RawURLEncoding.Encode(text, data)
+	return text
+}
+
+// base64Decode decodes base64 text in either the URL-safe or
+// standard alphabet, with or without padding.
+// Padding is only accepted at the end of the text.
+func base64Decode(text []byte) ([]byte, error) {
+	n := len(text)
+	for i := 0; i < 2 && n > 0 && text[n-1] == '='; i++ {
+		n--
+	}
+	if n < len(text) && len(text)%4 != 0 {
+		return nil, fmt.Errorf("illegal base64 padding")
+	}
+	buf := make([]byte, 0, n)
+	for _, c := range text[0:n] {
+		switch c {
+		case '+':
+			c = '-'
+		case '/':
+			c = '_'
+		case '=':
+			return nil, fmt.Errorf("illegal base64 padding")
+		}
+		buf = append(buf, c)
+	}
+	data := make([]byte, base64.RawURLEncoding.DecodedLen(len(buf)))
+	n, err := base64.RawURLEncoding.Decode(data, buf)
+	if err != nil {
+		return nil, err
+	}
+	return data[0:n], nil
+}
@@ -5,7 +5,7 @@ import (
 	"fmt"
 )
 
-// The macaroon binary encoding is made from a sequence
+// The version 1 macaroon binary encoding is made from a sequence
 // of "packets", each of which has a field name and some data.
 // The encoding is:
 //
@@ -16,12 +16,12 @@ import (
 //
 // - the raw data
 //
-// For efficiency, we store all the packets inside
-// a single byte slice inside the macaroon, Macaroon.data. This
-// is reasonable to do because we only ever append
-// to macaroons.
+// - a terminating newline character.
 //
-// The packet struct below holds a reference into Macaroon.data.
+// This is the same as the format used by libmacaroons.
+//
+// The packet struct below holds a reference into a byte
+// slice holding a sequence of packets.
 type packet struct {
 	start     int32
 	totalLen  uint16
@@ -32,32 +32,32 @@ func (p packet) len() int {
 	return int(p.totalLen)
 }
 
-// dataBytes returns the data payload of the packet.
-func (m *Macaroon) dataBytes(p packet) []byte {
-	return m.data[p.start+int32(p.headerLen) : p.start+int32(p.totalLen)]
-}
-
-func (m *Macaroon) dataStr(p packet) string {
-	return string(m.dataBytes(p))
+// dataBytes returns the data payload of the packet,
+// which must have been parsed from buf.
+func (p packet) dataBytes(buf []byte) []byte {
+	if p.totalLen == 0 {
+		return nil
+	}
+	return buf[p.start+int32(p.headerLen) : p.start+int32(p.totalLen)-1]
 }
 
 // packetBytes returns the entire packet.
-func (m *Macaroon) packetBytes(p packet) []byte {
-	return m.data[p.start : p.start+int32(p.totalLen)]
+func (p packet) packetBytes(buf []byte) []byte {
+	return buf[p.start : p.start+int32(p.totalLen)]
 }
 
 // fieldName returns the field name of the packet.
-func (m *Macaroon) fieldName(p packet) []byte {
+func (p packet) fieldName(buf []byte) []byte {
 	if p.totalLen == 0 {
 		return nil
 	}
-	return m.data[p.start+4 : p.start+int32(p.headerLen)-1]
+	return buf[p.start+4 : p.start+int32(p.headerLen)-1]
 }
 
 // parsePacket parses the packet starting at the given
-// index into m.data.
-func (m *Macaroon) parsePacket(start int) (packet, error) {
-	data := m.data[start:]
+// index into buf.
+func parsePacket(buf []byte, start int) (packet, error) {
+	data := buf[start:]
 	if len(data) < 6 {
 		return packet{}, fmt.Errorf("packet too short")
 	}
@@ -68,7 +68,13 @@ func (m *Macaroon) parsePacket(start int) (packet, error) {
 	if plen > len(data) {
 		return packet{}, fmt.Errorf("packet size too big")
 	}
-	data = data[4:plen]
+	if plen < 6 {
+		return packet{}, fmt.Errorf("packet size too small")
+	}
+	if data[plen-1] != '\n' {
+		return packet{}, fmt.Errorf("no terminating newline in packet")
+	}
+	data = data[4 : plen-1]
 	i := bytes.IndexByte(data, ' ')
 	if i <= 0 {
 		return packet{}, fmt.Errorf("cannot parse field name")
@@ -83,21 +89,12 @@ func (m *Macaroon) parsePacket(start int) (packet, error) {
 const maxPacketLen = 0xffff
 
 // appendPacket appends a packet with the given field name
-// and data to m.data, and returns the packet appended.
+// and data to buf, and returns the new slice along with
+// the packet appended.
 //
 // It returns false (and a zero packet) if the packet was too big.
-func (m *Macaroon) appendPacket(field string, data []byte) (packet, bool) {
-	mdata, p, ok := rawAppendPacket(m.data, field, data)
-	if !ok {
-		return p, false
-	}
-	m.data = mdata
-	return p, true
-}
-
-// rawAppendPacket appends a packet to the given byte slice.
-func rawAppendPacket(buf []byte, field string, data []byte) ([]byte, packet, bool) {
-	plen := 4 + len(field) + 1 + len(data)
+func appendPacket(buf []byte, field string, data []byte) ([]byte, packet, bool) {
+	plen := 4 + len(field) + 1 + len(data) + 1
 	if plen > maxPacketLen {
 		return nil, packet{}, false
 	}
@@ -110,6 +107,7 @@ func rawAppendPacket(buf []byte, field string, data []byte) ([]byte, packet, boo
 	buf = append(buf, field...)
 	buf = append(buf, ' ')
 	buf = append(buf, data...)
+	buf = append(buf, '\n')
 	return buf, s, true
 }
 
@@ -13,58 +13,53 @@ type packetSuite struct{}
 var _ = gc.Suite(&packetSuite{})
 
 func (*packetSuite) TestAppendPacket(c *gc.C) {
-	var m Macaroon
-	p, ok := m.appendPacket("field", []byte("some data"))
+	data, p, ok := appendPacket(nil, "field", []byte("some data"))
 	c.Assert(ok, gc.Equals, true)
-	c.Assert(string(m.data), gc.Equals, "0013field some data")
+	c.Assert(string(data), gc.Equals, "0014field some data\n")
 	c.Assert(p, gc.Equals, packet{
 		start:     0,
-		totalLen:  19,
+		totalLen:  20,
 		headerLen: 10,
 	})
 
-	p, ok = m.appendPacket("otherfield", []byte("more and more data"))
+	data, p, ok = appendPacket(data, "otherfield", []byte("more and more data"))
 	c.Assert(ok, gc.Equals, true)
-	c.Assert(string(m.data), gc.Equals, "0013field some data0021otherfield more and more data")
+	c.Assert(string(data), gc.Equals, "0014field some data\n0022otherfield more and more data\n")
 	c.Assert(p, gc.Equals, packet{
-		start:     19,
-		totalLen:  33,
+		start:     20,
+		totalLen:  34,
 		headerLen: 15,
 	})
 }
 
 func (*packetSuite) TestAppendPacketTooBig(c *gc.C) {
-	var m Macaroon
-	data := make([]byte, 65532)
-	p, ok := m.appendPacket("field", data)
+	data, p, ok := appendPacket(nil, "field", make([]byte, 65532))
 	c.Assert(ok, gc.Equals, false)
+	c.Assert(data, gc.IsNil)
 	c.Assert(p, gc.Equals, packet{})
 }
 
 func (*packetSuite) TestDataBytes(c *gc.C) {
-	var m Macaroon
-	m.appendPacket("first", []byte("first data"))
-	p, ok := m.appendPacket("field", []byte("some data"))
+	data, _, _ := appendPacket(nil, "first", []byte("first data"))
+	data, p, ok := appendPacket(data, "field", []byte("some data"))
 	c.Assert(ok, gc.Equals, true)
-	c.Assert(string(m.dataBytes(p)), gc.Equals, "some data")
+	c.Assert(string(p.dataBytes(data)), gc.Equals, "some data")
 }
 
 func (*packetSuite) TestPacketBytes(c *gc.C) {
-	var m Macaroon
-	m.appendPacket("first", []byte("first data"))
-	p, ok := m.appendPacket("field", []byte("some data"))
+	data, _, _ := appendPacket(nil, "first", []byte("first data"))
+	data, p, ok := appendPacket(data, "field", []byte("some data"))
 	c.Assert(ok, gc.Equals, true)
-	c.Assert(string(m.packetBytes(p)), gc.Equals, "0013field some data")
+	c.Assert(string(p.packetBytes(data)), gc.Equals, "0014field some data\n")
 }
 
 func (*packetSuite) TestFieldName(c *gc.C) {
-	var m Macaroon
-	m.appendPacket("first", []byte("first data"))
-	p, ok := m.appendPacket("field", []byte("some data"))
+	data, _, _ := appendPacket(nil, "first", []byte("first data"))
+	data, p, ok := appendPacket(data, "field", []byte("some data"))
 	c.Assert(ok, gc.Equals, true)
-	c.Assert(string(m.fieldName(p)), gc.Equals, "field")
+	c.Assert(string(p.fieldName(data)), gc.Equals, "field")
 
-	c.Assert(m.fieldName(packet{}), gc.HasLen, 0)
+	c.Assert(packet{}.fieldName(data), gc.HasLen, 0)
 }
 
 var parsePacketTests = []struct {
@@ -77,42 +72,50 @@ var parsePacketTests = []struct {
 }{{
 	expectErr: "packet too short",
 }, {
-	data:  "0013field some data",
+	data:  "0014field some data\n",
 	start: 0,
 	expect: packet{
 		start:     0,
-		totalLen:  19,
+		totalLen:  20,
 		headerLen: 10,
 	},
 	expectData:  "some data",
 	expectField: "field",
 }, {
-	data:      "0013field some data",
+	data:      "0014field some data\n",
 	start:     1,
 	expectErr: "packet size too big",
 }, {
-	data:  "0013field some data0013field some data",
-	start: 0x13,
+	data:  "0014field some data\n0014field some data\n",
+	start: 0x14,
 	expect: packet{
-		start:     0x13,
-		totalLen:  19,
+		start:     0x14,
+		totalLen:  20,
 		headerLen: 10,
 	},
 	expectData:  "some data",
 	expectField: "field",
 }, {
-	data:      "0013fieldwithoutanyspaceordata",
+	data:      "0013field some data",
+	start:     0,
+	expectErr: "no terminating newline in packet",
+}, {
+	data:      "0004field some data",
+	start:     0,
+	expectErr: "packet size too small",
+}, {
+	data:      "001ffieldwithoutanyspaceordata\n",
 	start:     0,
 	expectErr: "cannot parse field name",
 }, {
-	data:  "fedcsomefield " + strings.Repeat("x", 0xfedc-4-len("somefield ")),
+	data:  "fedcsomefield " + strings.Repeat("x", 0xfedc-4-len("somefield ")-1) + "\n",
 	start: 0,
 	expect: packet{
 		start:     0,
 		totalLen:  0xfedc,
 		headerLen: 14,
 	},
-	expectData:  strings.Repeat("x", 0xfedc-4-len("somefield ")),
+	expectData:  strings.Repeat("x", 0xfedc-4-len("somefield ")-1),
 	expectField: "somefield",
 }, {
 	data:      "zzzzbadpacketsizenomacaroon",
@@ -123,10 +126,8 @@ var parsePacketTests = []struct {
 func (*packetSuite) TestParsePacket(c *gc.C) {
 	for i, test := range parsePacketTests {
 		c.Logf("test %d: %q", i, truncate(test.data))
-		m := Macaroon{
-			data: []byte(test.data),
-		}
-		p, err := m.parsePacket(test.start)
+		data := []byte(test.data)
+		p, err := parsePacket(data, test.start)
 		if test.expectErr != "" {
 			c.Assert(err, gc.ErrorMatches, test.expectErr)
 			c.Assert(p, gc.Equals, packet{})
@@ -134,14 +135,14 @@ func (*packetSuite) TestParsePacket(c *gc.C) {
 		}
 		c.Assert(err, gc.IsNil)
 		c.Assert(p, gc.Equals, test.expect)
-		c.Assert(string(m.dataBytes(p)), gc.Equals, test.expectData)
-		c.Assert(string(m.fieldName(p)), gc.Equals, test.expectField)
+		c.Assert(string(p.dataBytes(data)), gc.Equals, test.expectData)
+		c.Assert(string(p.fieldName(data)), gc.Equals, test.expectField)
 
 		// append the same packet again and check that
 		// the contents are the same.
-		p1, ok := m.appendPacket(test.expectField, []byte(test.expectData))
+		data, p1, ok := appendPacket(data, test.expectField, []byte(test.expectData))
 		c.Assert(ok, gc.Equals, true)
-		c.Assert(string(m.packetBytes(p)), gc.Equals, string(m.packetBytes(p1)))
+		c.Assert(string(p.packetBytes(data)), gc.Equals, string(p1.packetBytes(data)))
 	}
 }
 
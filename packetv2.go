@@ -0,0 +1,108 @@
+package macaroon
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// The version 2 macaroon binary encoding is more compact than
+// version 1 and places no limit on the size of a field. It is
+// the same as the format used by libmacaroons version 2.
+//
+// Fields are grouped into sections. Each field is encoded as:
+//
+// - a single byte holding the field type.
+//
+// - the length of the field data, as an unsigned varint.
+//
+// - the raw data.
+//
+// Within a section, fields must appear in ascending order of
+// field type. Each section is terminated by a single zero byte.
+//
+// A macaroon is encoded as a version byte (2) followed by:
+//
+//	header section: location? identifier algorithm?
+//	caveat sections: (location? identifier verificationId?)*
+//	a zero byte terminating the caveat sections
+//	signature field
+const (
+	fieldTypeEOS            = 0
+	fieldTypeLocation       = 1
+	fieldTypeIdentifier     = 2
+	fieldTypeVerificationId = 4
+	fieldTypeSignature      = 6
+
+	// fieldTypeAlgorithm is not defined by libmacaroons.
+	// It holds the name of the macaroon's algorithm and
+	// is omitted for the default algorithm.
+	fieldTypeAlgorithm = 8
+)
+
+// packetV2 holds a field parsed from the version 2 encoding.
+type packetV2 struct {
+	fieldType byte
+	data      []byte
+}
+
+// parsePacketV2 parses the field at the start of buf and
+// returns it along with the data remaining after it.
+// An end-of-section marker is returned as a packet
+// with field type fieldTypeEOS.
+func parsePacketV2(buf []byte) (packetV2, []byte, error) {
+	if len(buf) == 0 {
+		return packetV2{}, nil, fmt.Errorf("unexpected end of data")
+	}
+	fieldType := buf[0]
+	if fieldType == fieldTypeEOS {
+		return packetV2{}, buf[1:], nil
+	}
+	plen, n := binary.Uvarint(buf[1:])
+	if n <= 0 {
+		return packetV2{}, nil, fmt.Errorf("cannot parse field length")
+	}
+	buf = buf[1+n:]
+	if plen > uint64(len(buf)) {
+		return packetV2{}, nil, fmt.Errorf("field length too big")
+	}
+	return packetV2{
+		fieldType: fieldType,
+		data:      buf[0:plen],
+	}, buf[plen:], nil
+}
+
+// parseSectionV2 parses the fields of a section from the start of
+// buf, up to and including its end-of-section marker, and returns
+// them along with the data remaining after the section.
+func parseSectionV2(buf []byte) ([]packetV2, []byte, error) {
+	var section []packetV2
+	for {
+		p, rest, err := parsePacketV2(buf)
+		if err != nil {
+			return nil, nil, err
+		}
+		buf = rest
+		if p.fieldType == fieldTypeEOS {
+			return section, buf, nil
+		}
+		if len(section) > 0 && p.fieldType <= section[len(section)-1].fieldType {
+			return nil, nil, fmt.Errorf("fields out of order")
+		}
+		section = append(section, p)
+	}
+}
+
+// appendPacketV2 appends a field with the given type and data
+// to buf and returns the new slice.
+func appendPacketV2(buf []byte, fieldType byte, data []byte) []byte {
+	var lenBuf [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(lenBuf[:], uint64(len(data)))
+	buf = append(buf, fieldType)
+	buf = append(buf, lenBuf[0:n]...)
+	return append(buf, data...)
+}
+
+// appendEOSV2 appends an end-of-section marker to buf.
+func appendEOSV2(buf []byte) []byte {
+	return append(buf, fieldTypeEOS)
+}
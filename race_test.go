@@ -0,0 +1,9 @@
+//go:build race
+// +build race
+
+package macaroon_test
+
+// raceEnabled reports whether the race detector is enabled.
+// When it is, sync.Pool drops items at random, so
+// verification may allocate.
+const raceEnabled = true
@@ -0,0 +1,154 @@
+package macaroon
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+)
+
+// Trace holds a record of the verification of a macaroon.
+type Trace struct {
+	// Id and Location hold the id and location
+	// of the verified macaroon.
+	Id       string
+	Location string
+
+	// SignatureOK records whether the signatures of the
+	// macaroon and its discharges were found to be valid.
+	// The signatures are verified before any caveats
+	// are checked. A missing discharge macaroon does not
+	// affect this; it is recorded as the error of the
+	// third party caveat instead.
+	SignatureOK bool
+
+	// Caveats holds an entry for each caveat that was
+	// checked, in the order that they were checked.
+	// Verification stops at the first caveat that
+	// fails, so later caveats may not be present.
+	// It is empty if the signatures were not valid.
+	Caveats []CaveatTrace
+
+	// Err holds the error that caused verification to fail,
+	// or nil if the macaroon was verified successfully.
+	Err error
+}
+
+// CaveatTrace holds a record of the checking of a single caveat.
+type CaveatTrace struct {
+	// Caveat holds the caveat that was checked.
+	Caveat Caveat
+
+	// Discharges holds a trace for each discharge macaroon
+	// with an id matching a third party caveat that was tried,
+	// in the order that they were tried. If the caveat was
+	// satisfied, the last entry records the discharge that
+	// satisfied it.
+	Discharges []*Trace
+
+	// Err holds the reason that the caveat was not satisfied,
+	// or nil if it was.
+	Err error
+}
+
+// fail records err as the reason for ct's failure
+// and returns it. It does nothing if ct is nil.
+func (ct *CaveatTrace) fail(err error) error {
+	if ct != nil {
+		ct.Err = err
+	}
+	return err
+}
+
+// VerifyWithTrace is like VerifyWithOptions except that it
+// also returns a trace recording the checks that were made.
+func (m *Macaroon) VerifyWithTrace(rootKey []byte, check func(caveat string) error, discharges []*Macaroon, opts VerifyOptions) (*Trace, error) {
+	var t Trace
+	v := newVerifier(check, discharges, opts)
+	err := v.verifyPrimary(m, rootKey, &t)
+	v.release()
+	return &t, err
+}
+
+// String returns a human-readable description of the trace,
+// one line for each macaroon, caveat and signature check.
+func (t *Trace) String() string {
+	var buf bytes.Buffer
+	t.write(&buf, 0)
+	return buf.String()
+}
+
+func (t *Trace) write(buf *bytes.Buffer, depth int) {
+	indent := strings.Repeat("\t", depth)
+	fmt.Fprintf(buf, "%smacaroon %q", indent, t.Id)
+	if t.Location != "" {
+		fmt.Fprintf(buf, " at %q", t.Location)
+	}
+	buf.WriteString(": ")
+	writeResult(buf, t.Err)
+	if t.SignatureOK {
+		fmt.Fprintf(buf, "%s\tsignature: ok\n", indent)
+	} else if isSignatureError(t.Err) {
+		fmt.Fprintf(buf, "%s\tsignature: %v\n", indent, t.Err)
+	}
+	for _, ct := range t.Caveats {
+		if ct.Caveat.IsThirdParty() {
+			fmt.Fprintf(buf, "%s\tthird party caveat %q at %q: ", indent, ct.Caveat.Id, ct.Caveat.Location)
+		} else {
+			fmt.Fprintf(buf, "%s\tfirst party caveat %q: ", indent, ct.Caveat.Id)
+		}
+		writeResult(buf, ct.Err)
+		for _, dt := range ct.Discharges {
+			dt.write(buf, depth+2)
+		}
+	}
+}
+
+// isSignatureError reports whether err results from
+// an invalid signature.
+func isSignatureError(err error) bool {
+	switch err.(type) {
+	case *SignatureMismatchError, *AlgorithmMismatchError:
+		return true
+	}
+	return false
+}
+
+func writeResult(buf *bytes.Buffer, err error) {
+	if err != nil {
+		fmt.Fprintf(buf, "error: %v\n", err)
+	} else {
+		buf.WriteString("ok\n")
+	}
+}
+
+// TraceVerifier implements Verifier. It verifies
+// macaroons using the given check function and
+// discharge macaroons, recording a trace of each
+// verification.
+type TraceVerifier struct {
+	// Check is called to check each first party caveat.
+	Check func(caveat string) error
+
+	// Discharges holds the discharge macaroons
+	// available for third party caveats.
+	Discharges []*Macaroon
+
+	// Options holds the options used for verification.
+	Options VerifyOptions
+
+	// Trace holds the trace of the most recent call to Verify.
+	Trace *Trace
+}
+
+// Verify implements Verifier.Verify. It returns true
+// if m is valid; otherwise it returns false and an
+// error describing why verification failed. In either
+// case, the trace of the verification is stored in v.Trace.
+func (v *TraceVerifier) Verify(m *Macaroon, rootKey []byte) (bool, error) {
+	t, err := m.VerifyWithTrace(rootKey, v.Check, v.Discharges, v.Options)
+	v.Trace = t
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
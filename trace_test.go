@@ -0,0 +1,151 @@
+package macaroon_test
+
+import (
+	"fmt"
+
+	gc "gopkg.in/check.v1"
+
+	"github.com/rogpeppe/macaroon"
+)
+
+type traceSuite struct{}
+
+var _ = gc.Suite(&traceSuite{})
+
+var _ macaroon.Verifier = (*macaroon.TraceVerifier)(nil)
+
+func (*traceSuite) TestTraceSuccess(c *gc.C) {
+	rootKey, primary, discharges := makeMacaroons([]macaroonSpec{{
+		rootKey: "root-key",
+		id:      "root-id",
+		caveats: []caveat{{
+			condition: "wonderful",
+		}, {
+			condition: "bob-is-great",
+			location:  "bob",
+			rootKey:   "bob-caveat-root-key",
+		}},
+	}, {
+		location: "bob",
+		rootKey:  "bob-caveat-root-key",
+		id:       "bob-is-great",
+		caveats: []caveat{{
+			condition: "splendid",
+		}},
+	}})
+	t, err := primary.VerifyWithTrace(rootKey, func(string) error { return nil }, discharges, macaroon.VerifyOptions{})
+	c.Assert(err, gc.IsNil)
+	c.Assert(t.Err, gc.IsNil)
+	c.Assert(t.SignatureOK, gc.Equals, true)
+	c.Assert(t.Caveats, gc.HasLen, 2)
+	c.Assert(t.Caveats[1].Discharges, gc.HasLen, 1)
+	c.Assert(t.Caveats[1].Discharges[0].SignatureOK, gc.Equals, true)
+	c.Assert(t.String(), gc.Equals, `
+macaroon "root-id": ok
+	signature: ok
+	first party caveat "wonderful": ok
+	third party caveat "bob-is-great" at "bob": ok
+		macaroon "bob-is-great" at "bob": ok
+			signature: ok
+			first party caveat "splendid": ok
+`[1:])
+}
+
+func (*traceSuite) TestTraceCaveatFailure(c *gc.C) {
+	rootKey, primary, discharges := makeMacaroons([]macaroonSpec{{
+		rootKey: "root-key",
+		id:      "root-id",
+		caveats: []caveat{{
+			condition: "bob-is-great",
+			location:  "bob",
+			rootKey:   "bob-caveat-root-key",
+		}, {
+			condition: "wonderful",
+		}},
+	}, {
+		location: "bob",
+		rootKey:  "bob-caveat-root-key",
+		id:       "bob-is-great",
+		caveats: []caveat{{
+			condition: "splendid",
+		}},
+	}})
+	check := func(cav string) error {
+		if cav == "splendid" {
+			return fmt.Errorf("not splendid")
+		}
+		return nil
+	}
+	t, err := primary.VerifyWithTrace(rootKey, check, discharges, macaroon.VerifyOptions{})
+	c.Assert(err, gc.ErrorMatches, "not splendid")
+	c.Assert(t.Err, gc.Equals, err)
+	c.Assert(t.SignatureOK, gc.Equals, true)
+	c.Assert(t.Caveats, gc.HasLen, 1)
+	c.Assert(t.Caveats[0].Err, gc.Equals, err)
+	c.Assert(t.String(), gc.Equals, `
+macaroon "root-id": error: not splendid
+	signature: ok
+	third party caveat "bob-is-great" at "bob": error: not splendid
+		macaroon "bob-is-great" at "bob": error: not splendid
+			signature: ok
+			first party caveat "splendid": error: not splendid
+`[1:])
+}
+
+func (*traceSuite) TestTraceSignatureFailure(c *gc.C) {
+	m := MustNew(testKey("root-key"), "root-id", "")
+	err := m.AddFirstPartyCaveat("wonderful")
+	c.Assert(err, gc.IsNil)
+	t, err := m.VerifyWithTrace([]byte("wrong-key"), func(string) error { return nil }, nil, macaroon.VerifyOptions{})
+	c.Assert(err, gc.ErrorMatches, "signature mismatch after caveat verification")
+	c.Assert(t.SignatureOK, gc.Equals, false)
+	c.Assert(t.Caveats, gc.HasLen, 0)
+	c.Assert(t.String(), gc.Equals, `
+macaroon "root-id": error: signature mismatch after caveat verification
+	signature: signature mismatch after caveat verification
+`[1:])
+}
+
+func (*traceSuite) TestTraceMissingDischarge(c *gc.C) {
+	rootKey, primary, _ := makeMacaroons([]macaroonSpec{{
+		rootKey: "root-key",
+		id:      "root-id",
+		caveats: []caveat{{
+			condition: "bob-is-great",
+			location:  "bob",
+			rootKey:   "bob-caveat-root-key",
+		}},
+	}})
+	t, err := primary.VerifyWithTrace(rootKey, func(string) error { return nil }, nil, macaroon.VerifyOptions{})
+	c.Assert(err, gc.ErrorMatches, `cannot find discharge macaroon for caveat "bob-is-great"`)
+	c.Assert(t.Err, gc.Equals, err)
+	c.Assert(t.SignatureOK, gc.Equals, true)
+	c.Assert(t.Caveats, gc.HasLen, 1)
+	c.Assert(t.Caveats[0].Caveat.Id, gc.Equals, "bob-is-great")
+	c.Assert(t.Caveats[0].Caveat.Location, gc.Equals, "bob")
+	c.Assert(t.Caveats[0].Discharges, gc.HasLen, 0)
+	c.Assert(t.Caveats[0].Err, gc.Equals, err)
+	c.Assert(t.String(), gc.Equals, `macaroon "root-id": error: cannot find discharge macaroon for caveat "bob-is-great"
+	signature: ok
+	third party caveat "bob-is-great" at "bob": error: cannot find discharge macaroon for caveat "bob-is-great"
+`)
+}
+
+func (*traceSuite) TestTraceVerifier(c *gc.C) {
+	rootKey, primary, discharges := makeMacaroons(recursiveThirdPartyCaveatMacaroons)
+	v := &macaroon.TraceVerifier{
+		Check:      func(string) error { return nil },
+		Discharges: discharges,
+	}
+	ok, err := v.Verify(primary, rootKey)
+	c.Assert(err, gc.IsNil)
+	c.Assert(ok, gc.Equals, true)
+	c.Assert(v.Trace, gc.NotNil)
+	c.Assert(v.Trace.Id, gc.Equals, "root-id")
+	c.Assert(v.Trace.SignatureOK, gc.Equals, true)
+
+	ok, err = v.Verify(primary, []byte("wrong-key"))
+	c.Assert(err, gc.NotNil)
+	c.Assert(ok, gc.Equals, false)
+	c.Assert(v.Trace.Err, gc.Equals, err)
+}
@@ -0,0 +1,707 @@
+package macaroon
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"fmt"
+	"hash/maphash"
+	"sync"
+)
+
+// Default limits used when verifying macaroons.
+const (
+	// DefaultMaxDischargeDepth holds the default maximum
+	// nesting depth of discharge macaroons.
+	DefaultMaxDischargeDepth = 16
+
+	// DefaultMaxCaveats holds the default maximum number
+	// of caveats that will be checked in a single verification.
+	// It is also the default maximum number of caveats
+	// in an unmarshaled macaroon; see UnmarshalLimits.
+	DefaultMaxCaveats = 1024
+)
+
+// VerifyOptions holds options that control the verification
+// of a macaroon and its discharges. The zero value
+// specifies the default limits.
+type VerifyOptions struct {
+	// MaxDischargeDepth holds the maximum nesting depth
+	// of discharge macaroons. A discharge macaroon for a
+	// caveat in the primary macaroon is at depth 1, a discharge
+	// for one of its caveats is at depth 2, and so on. If this
+	// is zero, DefaultMaxDischargeDepth is used.
+	MaxDischargeDepth int
+
+	// MaxCaveats holds the maximum total number of
+	// caveats that will be checked, including those
+	// in discharge macaroons. If this is zero,
+	// DefaultMaxCaveats is used.
+	MaxCaveats int
+
+	// DischargeOnce specifies that each discharge macaroon
+	// must be used exactly once. When this is false, a discharge
+	// macaroon may be used to satisfy any number of third party
+	// caveats, and unused discharge macaroons are ignored.
+	// A discharge macaroon is only counted as used when it
+	// satisfies a caveat, not when it is tried and fails.
+	DischargeOnce bool
+
+	// RequireAlgorithm specifies that the macaroon must use
+	// Algorithm. The algorithm is recorded in the macaroon
+	// itself, so when this is false any algorithm is accepted.
+	// Discharge macaroons must always use the same algorithm
+	// as the macaroon they discharge.
+	RequireAlgorithm bool
+
+	// Algorithm holds the algorithm required
+	// when RequireAlgorithm is true.
+	Algorithm Algorithm
+}
+
+// CaveatError is returned when a first party caveat
+// is not satisfied.
+type CaveatError struct {
+	// MacaroonId holds the id of the macaroon
+	// containing the caveat.
+	MacaroonId string
+
+	// InDischarge records whether the caveat was
+	// in a discharge macaroon rather than
+	// the primary macaroon.
+	InDischarge bool
+
+	// Index holds the index of the caveat
+	// within its macaroon.
+	Index int
+
+	// Condition holds the caveat's condition.
+	Condition string
+
+	// Err holds the error returned by the check function.
+	Err error
+}
+
+// Error implements error.Error by returning
+// the error returned by the check function.
+func (e *CaveatError) Error() string {
+	return e.Err.Error()
+}
+
+// AlgorithmMismatchError is returned when a macaroon does not
+// use the required algorithm: the algorithm specified in
+// VerifyOptions for the primary macaroon, or the algorithm of
+// the primary macaroon for a discharge macaroon.
+type AlgorithmMismatchError struct {
+	// MacaroonId holds the id of the macaroon.
+	MacaroonId string
+
+	// InDischarge records whether the macaroon
+	// is a discharge macaroon.
+	InDischarge bool
+
+	// Algorithm holds the algorithm used by the macaroon.
+	Algorithm Algorithm
+
+	// Expected holds the required algorithm.
+	Expected Algorithm
+}
+
+func (e *AlgorithmMismatchError) Error() string {
+	return fmt.Sprintf("macaroon %q uses algorithm %v, not %v", e.MacaroonId, e.Algorithm, e.Expected)
+}
+
+// DischargeNotFoundError is returned when there is no
+// discharge macaroon for a third party caveat.
+type DischargeNotFoundError struct {
+	// CaveatId holds the id of the third party caveat.
+	CaveatId string
+
+	// Location holds the location of the third party caveat.
+	Location string
+}
+
+func (e *DischargeNotFoundError) Error() string {
+	return fmt.Sprintf("cannot find discharge macaroon for caveat %q", e.CaveatId)
+}
+
+// SignatureMismatchError is returned when a macaroon's signature
+// is invalid, usually because the macaroon was minted with
+// a different root key or has been tampered with.
+type SignatureMismatchError struct {
+	// MacaroonId holds the id of the invalid macaroon.
+	MacaroonId string
+
+	// InDischarge records whether the invalid macaroon
+	// is a discharge macaroon.
+	InDischarge bool
+
+	// CaveatIndex holds the index of the third party
+	// caveat whose verification id could not be decrypted,
+	// or -1 if the signature did not match after
+	// all the caveats were checked.
+	CaveatIndex int
+}
+
+func (e *SignatureMismatchError) Error() string {
+	if e.CaveatIndex >= 0 {
+		return fmt.Sprintf("failed to decrypt caveat %d signature", e.CaveatIndex)
+	}
+	return "signature mismatch after caveat verification"
+}
+
+// DischargeCycleError is returned when a discharge macaroon
+// is required, directly or indirectly, to discharge one
+// of its own caveats.
+type DischargeCycleError struct {
+	// Id holds the id of the discharge macaroon.
+	Id string
+}
+
+func (e *DischargeCycleError) Error() string {
+	return fmt.Sprintf("discharge macaroon %q is part of a cycle", e.Id)
+}
+
+// DischargeDepthError is returned when the discharge
+// macaroons are nested more deeply than allowed.
+type DischargeDepthError struct {
+	// Id holds the id of the discharge macaroon that
+	// exceeded the limit.
+	Id string
+
+	// MaxDepth holds the limit that was exceeded.
+	MaxDepth int
+}
+
+func (e *DischargeDepthError) Error() string {
+	return fmt.Sprintf("discharge macaroon %q exceeds maximum discharge depth of %d", e.Id, e.MaxDepth)
+}
+
+// CaveatCountError is returned when verification requires
+// more caveats to be checked than allowed.
+type CaveatCountError struct {
+	// MaxCaveats holds the limit that was exceeded.
+	MaxCaveats int
+}
+
+func (e *CaveatCountError) Error() string {
+	return fmt.Sprintf("too many caveats (maximum %d)", e.MaxCaveats)
+}
+
+// DischargeReusedError is returned when VerifyOptions.DischargeOnce
+// is set and a discharge macaroon is used more than once.
+type DischargeReusedError struct {
+	// Id holds the id of the discharge macaroon.
+	Id string
+}
+
+func (e *DischargeReusedError) Error() string {
+	return fmt.Sprintf("discharge macaroon %q used more than once", e.Id)
+}
+
+// DischargeUnusedError is returned when VerifyOptions.DischargeOnce
+// is set and a discharge macaroon is not used.
+type DischargeUnusedError struct {
+	// Id holds the id of the discharge macaroon.
+	Id string
+}
+
+func (e *DischargeUnusedError) Error() string {
+	return fmt.Sprintf("discharge macaroon %q was not used", e.Id)
+}
+
+// VerifyWithOptions is like Verify except that the limits
+// on verification can be specified.
+func (m *Macaroon) VerifyWithOptions(rootKey []byte, check func(caveat string) error, discharges []*Macaroon, opts VerifyOptions) error {
+	v := newVerifier(check, discharges, opts)
+	err := v.verifyPrimary(m, rootKey, nil)
+	v.release()
+	return err
+}
+
+// verifier holds the state of a single macaroon verification.
+// Verifiers are reused so that verification does not need
+// to allocate in the common case. Once a verifier has
+// been used for a macaroon of a given shape, the only
+// allocations made when verifying a similar macaroon are
+// the conversions of first party caveat conditions to
+// strings for the check function.
+type verifier struct {
+	check      func(caveat string) error
+	discharges []*Macaroon
+	opts       VerifyOptions
+
+	// index maps the hash of each discharge macaroon id
+	// to the index of the first discharge macaroon with
+	// that hash. The indexes of the others can be found
+	// by following next. The ids are hashed so that
+	// building the index does not allocate a string for
+	// each id; callers must compare the ids themselves.
+	index map[uint64]int
+
+	// idHash is used to hash the discharge macaroon ids.
+	idHash maphash.Hash
+
+	// next holds, for each discharge macaroon, the index
+	// of the next discharge macaroon with the same id
+	// hash, or -1 if there is none.
+	next []int
+
+	// used records the number of times each discharge
+	// macaroon has been used.
+	used []int
+
+	// uses holds the index of each discharge macaroon
+	// that has been used, in order, so that the uses made
+	// while checking a discharge macaroon that is not
+	// used in the end can be undone.
+	uses []int
+
+	// path holds the discharge macaroons currently being
+	// verified, outermost first.
+	path []*Macaroon
+
+	// ncaveats holds the number of caveats checked so far.
+	ncaveats int
+
+	// hasher is used to calculate all signatures. It uses
+	// the primary macaroon's algorithm, which must also be
+	// used by all the discharge macaroons.
+	hasher *hasher
+
+	// hashers holds a hasher for each algorithm
+	// that has been used by the verifier.
+	hashers [numAlgorithms]*hasher
+
+	// rootKey holds the key derived from the primary
+	// macaroon's root key.
+	rootKey [keyLen]byte
+
+	// bufs holds the signature buffers for each
+	// level of the path.
+	bufs []*sigBuffers
+
+	// root holds the verified primary macaroon.
+	root verifiedMacaroon
+
+	// nodes holds the verified discharge macaroons.
+	// The first nnodes are in use by the current
+	// verification; the rest are kept for reuse along
+	// with their candidate slices.
+	nodes  []*verifiedMacaroon
+	nnodes int
+}
+
+// sigBuffers holds the buffers used when verifying
+// the signature of a single macaroon.
+type sigBuffers struct {
+	sig    [keyLen]byte
+	cavKey [keyLen]byte
+	nonce  [nonceLen]byte
+}
+
+var verifierPool = sync.Pool{
+	New: func() interface{} {
+		return &verifier{
+			index: make(map[uint64]int),
+		}
+	},
+}
+
+func newVerifier(check func(caveat string) error, discharges []*Macaroon, opts VerifyOptions) *verifier {
+	v := verifierPool.Get().(*verifier)
+	v.reset(check, discharges, opts)
+	return v
+}
+
+// reset prepares v to verify a macaroon with the
+// given discharges. A verifier that has been used
+// must be cleared before it is reset.
+func (v *verifier) reset(check func(caveat string) error, discharges []*Macaroon, opts VerifyOptions) {
+	if opts.MaxDischargeDepth == 0 {
+		opts.MaxDischargeDepth = DefaultMaxDischargeDepth
+	}
+	if opts.MaxCaveats == 0 {
+		opts.MaxCaveats = DefaultMaxCaveats
+	}
+	v.check = check
+	v.discharges = discharges
+	v.opts = opts
+	v.ncaveats = 0
+	v.used = resetInts(v.used, len(discharges), 0)
+	v.uses = v.uses[:0]
+	v.next = resetInts(v.next, len(discharges), -1)
+	// Index the discharges in reverse so that the
+	// candidates for a caveat are found in order.
+	for i := len(discharges) - 1; i >= 0; i-- {
+		dm := discharges[i]
+		h := v.hashId(dm.dataBytes(dm.id))
+		if j, ok := v.index[h]; ok {
+			v.next[i] = j
+		}
+		v.index[h] = i
+	}
+}
+
+// hashId returns the hash of the given macaroon id.
+func (v *verifier) hashId(id []byte) uint64 {
+	v.idHash.Reset()
+	v.idHash.Write(id)
+	return v.idHash.Sum64()
+}
+
+// release returns v to the pool of verifiers.
+// It must not be used afterwards.
+func (v *verifier) release() {
+	v.clear()
+	verifierPool.Put(v)
+}
+
+// clear removes all references to the
+// last verified macaroon from v.
+func (v *verifier) clear() {
+	for id := range v.index {
+		delete(v.index, id)
+	}
+	for i := range v.path {
+		v.path[i] = nil
+	}
+	v.path = v.path[:0]
+	for _, n := range v.nodes[:v.nnodes] {
+		n.m = nil
+	}
+	v.nnodes = 0
+	v.check = nil
+	v.discharges = nil
+	v.hasher = nil
+	v.root.m = nil
+}
+
+// resetInts returns a slice of n ints, all set to x,
+// reusing the storage of s if possible.
+func resetInts(s []int, n int, x int) []int {
+	if cap(s) < n {
+		s = make([]int, n)
+	}
+	s = s[:n]
+	for i := range s {
+		s[i] = x
+	}
+	return s
+}
+
+// setAlgorithm sets the algorithm used
+// to calculate signatures.
+func (v *verifier) setAlgorithm(alg Algorithm) {
+	if v.hashers[alg] == nil {
+		v.hashers[alg] = newHasher(alg)
+	}
+	v.hasher = v.hashers[alg]
+}
+
+// newNode returns a verifiedMacaroon for a discharge
+// macaroon, reusing one from an earlier verification
+// if possible.
+func (v *verifier) newNode() *verifiedMacaroon {
+	if v.nnodes == len(v.nodes) {
+		v.nodes = append(v.nodes, new(verifiedMacaroon))
+	}
+	n := v.nodes[v.nnodes]
+	v.nnodes++
+	return n
+}
+
+// buffers returns the signature buffers for
+// the given depth in the path.
+func (v *verifier) buffers(depth int) *sigBuffers {
+	for len(v.bufs) <= depth {
+		v.bufs = append(v.bufs, new(sigBuffers))
+	}
+	return v.bufs[depth]
+}
+
+// verifyPrimary verifies the primary macaroon m, which
+// was minted with the given root key.
+//
+// Verification happens in two phases. First the signatures
+// of m and all the discharge macaroons that might be used to
+// satisfy its third party caveats are checked, so that no
+// potentially expensive caveat checks are made for
+// a forged macaroon. Then the first party caveats are checked.
+func (v *verifier) verifyPrimary(m *Macaroon, rootKey []byte, t *Trace) error {
+	var n *verifiedMacaroon
+	var err error
+	if v.opts.RequireAlgorithm && m.alg != v.opts.Algorithm {
+		err = &AlgorithmMismatchError{
+			MacaroonId: m.Id(),
+			Algorithm:  m.alg,
+			Expected:   v.opts.Algorithm,
+		}
+	} else {
+		v.setAlgorithm(m.alg)
+		n, err = v.verifySignature(m, -1, nil, v.hasher.keyedHash(v.rootKey[:], keyGenerator, rootKey))
+	}
+	if err == nil {
+		err = v.checkCaveats(n, t)
+	} else if t != nil {
+		t.Id = m.Id()
+		t.Location = m.Location()
+	}
+	if err == nil && v.opts.DischargeOnce {
+		for i, n := range v.used {
+			if n == 0 {
+				err = &DischargeUnusedError{Id: v.discharges[i].Id()}
+				break
+			}
+		}
+	}
+	if t != nil {
+		t.Err = err
+	}
+	return err
+}
+
+// verifiedMacaroon holds a macaroon with a valid signature,
+// along with the discharge macaroons with valid signatures
+// that might satisfy each of its third party caveats.
+type verifiedMacaroon struct {
+	m *Macaroon
+
+	// index holds the index of the macaroon in
+	// the verifier's discharges, or -1 for
+	// the primary macaroon.
+	index int
+
+	// discharges holds an entry for each of m's caveats.
+	// For a third party caveat, the entry holds the
+	// candidate discharge macaroons in the order
+	// that they were found. It is empty if there is
+	// no discharge macaroon for the caveat.
+	discharges [][]*verifiedMacaroon
+}
+
+// reset prepares n to hold the verified macaroon m,
+// reusing the storage of its candidate slices.
+func (n *verifiedMacaroon) reset(m *Macaroon, index int) {
+	n.m = m
+	n.index = index
+	if cap(n.discharges) < len(m.caveats) {
+		discharges := make([][]*verifiedMacaroon, len(m.caveats))
+		copy(discharges, n.discharges[:cap(n.discharges)])
+		n.discharges = discharges
+	}
+	n.discharges = n.discharges[:len(m.caveats)]
+	for i := range n.discharges {
+		n.discharges[i] = n.discharges[i][:0]
+	}
+}
+
+// verifySignature verifies the signature of m against the given
+// key, along with the signatures of any discharge macaroons for
+// its third party caveats. If rootSig is empty, m is taken
+// to be the primary macaroon; otherwise m is a discharge
+// macaroon which should have been bound to the primary
+// macaroon with signature rootSig.
+func (v *verifier) verifySignature(m *Macaroon, index int, rootSig []byte, rootKey []byte) (*verifiedMacaroon, error) {
+	isPrimary := len(rootSig) == 0
+	if isPrimary {
+		rootSig = m.sig
+	} else if m.alg != v.hasher.alg {
+		return nil, &AlgorithmMismatchError{
+			MacaroonId:  m.Id(),
+			InDischarge: true,
+			Algorithm:   m.alg,
+			Expected:    v.hasher.alg,
+		}
+	}
+	var n *verifiedMacaroon
+	if isPrimary {
+		n = &v.root
+	} else {
+		n = v.newNode()
+	}
+	n.reset(m, index)
+	// The buffers for this macaroon are not touched by
+	// the verification of its discharges, which are
+	// deeper in the path.
+	b := v.buffers(len(v.path))
+	caveatSig := v.hasher.keyedHash(b.sig[:], rootKey, m.dataBytes(m.id))
+	for i, cav := range m.caveats {
+		v.ncaveats++
+		if v.ncaveats > v.opts.MaxCaveats {
+			return nil, &CaveatCountError{MaxCaveats: v.opts.MaxCaveats}
+		}
+		if cav.isThirdParty() {
+			cavKey, err := decryptKey(&b.cavKey, &b.nonce, &b.sig, m.dataBytes(cav.verificationId))
+			if err != nil {
+				return nil, &SignatureMismatchError{
+					MacaroonId:  m.Id(),
+					InDischarge: !isPrimary,
+					CaveatIndex: i,
+				}
+			}
+			n.discharges[i], err = v.verifyDischargeSignatures(n.discharges[i], m, cav, rootSig, cavKey)
+			if err != nil {
+				return nil, err
+			}
+		}
+		caveatSig = v.hasher.caveatSignature(b.sig[:], caveatSig, m.dataBytes(cav.caveatId), m.dataBytes(cav.verificationId))
+	}
+	if !isPrimary {
+		caveatSig = v.hasher.keyedHash2(b.sig[:], zeroKey[:], rootSig, caveatSig)
+	}
+	if !hmac.Equal(caveatSig, m.sig) {
+		return nil, &SignatureMismatchError{
+			MacaroonId:  m.Id(),
+			InDischarge: !isPrimary,
+			CaveatIndex: -1,
+		}
+	}
+	return n, nil
+}
+
+// verifyDischargeSignatures appends to candidates all the
+// discharge macaroons with valid signatures for the third party
+// caveat cav in m, and returns the resulting slice.
+// Violations of the verification limits are returned
+// immediately; otherwise if no discharge macaroon has a
+// valid signature, we choose an arbitrary error from one
+// of the failed verifications. If there are no discharge
+// macaroons for the caveat at all, it returns no candidates
+// and no error; that is reported when the caveat is checked.
+func (v *verifier) verifyDischargeSignatures(candidates []*verifiedMacaroon, m *Macaroon, cav caveat, rootSig, cavKey []byte) ([]*verifiedMacaroon, error) {
+	var verifyErr error
+	found := false
+	cavId := m.dataBytes(cav.caveatId)
+	i, ok := v.index[v.hashId(cavId)]
+	for ; i >= 0 && ok; i = v.next[i] {
+		dm := v.discharges[i]
+		if !bytes.Equal(dm.dataBytes(dm.id), cavId) {
+			continue
+		}
+		found = true
+		for _, pm := range v.path {
+			if pm == dm {
+				return nil, &DischargeCycleError{Id: dm.Id()}
+			}
+		}
+		if len(v.path) >= v.opts.MaxDischargeDepth {
+			return nil, &DischargeDepthError{
+				Id:       dm.Id(),
+				MaxDepth: v.opts.MaxDischargeDepth,
+			}
+		}
+		v.path = append(v.path, dm)
+		dn, err := v.verifySignature(dm, i, rootSig, cavKey)
+		v.path = v.path[0 : len(v.path)-1]
+		if err != nil {
+			if isLimitError(err) {
+				return nil, err
+			}
+			verifyErr = err
+			continue
+		}
+		candidates = append(candidates, dn)
+	}
+	if found && len(candidates) == 0 {
+		return nil, verifyErr
+	}
+	return candidates, nil
+}
+
+// checkCaveats checks the first party caveats in the
+// macaroon n and in the discharge macaroons used to
+// satisfy its third party caveats. If there's more than
+// one candidate discharge macaroon for a caveat, they are
+// tried in turn until one succeeds.
+//
+// If t is non-nil, a record of the checks is stored in it.
+func (v *verifier) checkCaveats(n *verifiedMacaroon, t *Trace) error {
+	if t == nil {
+		return v.checkCaveats1(n, nil)
+	}
+	t.Id = n.m.Id()
+	t.Location = n.m.Location()
+	t.SignatureOK = true
+	t.Err = v.checkCaveats1(n, t)
+	return t.Err
+}
+
+func (v *verifier) checkCaveats1(n *verifiedMacaroon, t *Trace) error {
+	m := n.m
+	for i, cav := range m.caveats {
+		var ct *CaveatTrace
+		if t != nil {
+			t.Caveats = append(t.Caveats, CaveatTrace{
+				Caveat: m.exportCaveat(cav),
+			})
+			ct = &t.Caveats[len(t.Caveats)-1]
+		}
+		if !cav.isThirdParty() {
+			if err := v.check(m.dataStr(cav.caveatId)); err != nil {
+				return ct.fail(&CaveatError{
+					MacaroonId:  m.Id(),
+					InDischarge: n.index >= 0,
+					Index:       i,
+					Condition:   m.dataStr(cav.caveatId),
+					Err:         err,
+				})
+			}
+			continue
+		}
+		var err error
+		if len(n.discharges[i]) == 0 {
+			err = &DischargeNotFoundError{
+				CaveatId: m.dataStr(cav.caveatId),
+				Location: m.dataStr(cav.location),
+			}
+		}
+		for _, dn := range n.discharges[i] {
+			if v.opts.DischargeOnce && v.used[dn.index] > 0 {
+				// The discharge macaroon has already satisfied
+				// another caveat, so try any other candidates.
+				if err == nil {
+					err = &DischargeReusedError{Id: dn.m.Id()}
+				}
+				continue
+			}
+			var dt *Trace
+			if ct != nil {
+				dt = new(Trace)
+				ct.Discharges = append(ct.Discharges, dt)
+			}
+			nuses := len(v.uses)
+			err = v.checkCaveats(dn, dt)
+			if err == nil {
+				v.used[dn.index]++
+				v.uses = append(v.uses, dn.index)
+				break
+			}
+			// Only the discharge macaroons that satisfy a caveat
+			// are counted as used, so undo any uses made
+			// while checking this one.
+			for _, j := range v.uses[nuses:] {
+				v.used[j]--
+			}
+			v.uses = v.uses[:nuses]
+			if isLimitError(err) {
+				break
+			}
+		}
+		if err != nil {
+			return ct.fail(err)
+		}
+	}
+	return nil
+}
+
+// isLimitError reports whether err results from a violation
+// of the verification limits.
+func isLimitError(err error) bool {
+	switch err.(type) {
+	case *DischargeCycleError,
+		*DischargeDepthError,
+		*CaveatCountError:
+		return true
+	}
+	return false
+}
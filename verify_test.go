@@ -0,0 +1,433 @@
+package macaroon_test
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+
+	gc "gopkg.in/check.v1"
+
+	"github.com/rogpeppe/macaroon"
+)
+
+type verifySuite struct{}
+
+var _ = gc.Suite(&verifySuite{})
+
+func alwaysOK(string) error {
+	return nil
+}
+
+// thirdParty returns a third party caveat with the given
+// condition, using the condition as the root key.
+func thirdParty(condition string) caveat {
+	return caveat{
+		condition: condition,
+		location:  condition + "-location",
+		rootKey:   condition + "-key",
+	}
+}
+
+// discharge returns a discharge macaroon spec for a third party
+// caveat created by thirdParty.
+func discharge(condition string, caveats ...caveat) macaroonSpec {
+	return macaroonSpec{
+		id:       condition,
+		location: condition + "-location",
+		rootKey:  condition + "-key",
+		caveats:  caveats,
+	}
+}
+
+func primarySpec(caveats ...caveat) macaroonSpec {
+	return macaroonSpec{
+		id:      "root-id",
+		rootKey: "root-key",
+		caveats: caveats,
+	}
+}
+
+// chainSpecs returns the specs for a primary macaroon
+// with a chain of n nested discharge macaroons.
+func chainSpecs(n int) []macaroonSpec {
+	specs := []macaroonSpec{primarySpec(thirdParty("d1"))}
+	for i := 1; i <= n; i++ {
+		var caveats []caveat
+		if i < n {
+			caveats = append(caveats, thirdParty(fmt.Sprintf("d%d", i+1)))
+		}
+		specs = append(specs, discharge(fmt.Sprintf("d%d", i), caveats...))
+	}
+	return specs
+}
+
+var verifyOptionsTests = []struct {
+	about     string
+	macaroons []macaroonSpec
+	opts      macaroon.VerifyOptions
+	expectErr string
+	errType   interface{}
+}{{
+	about: "discharge satisfying its own caveat",
+	macaroons: []macaroonSpec{
+		primarySpec(thirdParty("a")),
+		discharge("a", thirdParty("a")),
+	},
+	expectErr: `discharge macaroon "a" is part of a cycle`,
+	errType:   (*macaroon.DischargeCycleError)(nil),
+}, {
+	about: "discharges satisfying each other's caveats",
+	macaroons: []macaroonSpec{
+		primarySpec(thirdParty("a")),
+		discharge("a", thirdParty("b")),
+		discharge("b", thirdParty("a")),
+	},
+	expectErr: `discharge macaroon "a" is part of a cycle`,
+	errType:   (*macaroon.DischargeCycleError)(nil),
+}, {
+	about:     "discharge chain within limit",
+	macaroons: chainSpecs(3),
+	opts: macaroon.VerifyOptions{
+		MaxDischargeDepth: 3,
+	},
+}, {
+	about:     "discharge chain too deep",
+	macaroons: chainSpecs(3),
+	opts: macaroon.VerifyOptions{
+		MaxDischargeDepth: 2,
+	},
+	expectErr: `discharge macaroon "d3" exceeds maximum discharge depth of 2`,
+	errType:   (*macaroon.DischargeDepthError)(nil),
+}, {
+	about:     "discharge chain too deep for default limit",
+	macaroons: chainSpecs(macaroon.DefaultMaxDischargeDepth + 1),
+	expectErr: fmt.Sprintf(`discharge macaroon "d%d" exceeds maximum discharge depth of %d`, macaroon.DefaultMaxDischargeDepth+1, macaroon.DefaultMaxDischargeDepth),
+	errType:   (*macaroon.DischargeDepthError)(nil),
+}, {
+	about: "caveat count within limit",
+	macaroons: []macaroonSpec{
+		primarySpec(caveat{condition: "a"}, thirdParty("b")),
+		discharge("b", caveat{condition: "c"}),
+	},
+	opts: macaroon.VerifyOptions{
+		MaxCaveats: 3,
+	},
+}, {
+	about: "too many caveats",
+	macaroons: []macaroonSpec{
+		primarySpec(caveat{condition: "a"}, thirdParty("b")),
+		discharge("b", caveat{condition: "c"}, caveat{condition: "d"}),
+	},
+	opts: macaroon.VerifyOptions{
+		MaxCaveats: 3,
+	},
+	expectErr: `too many caveats \(maximum 3\)`,
+	errType:   (*macaroon.CaveatCountError)(nil),
+}, {
+	about: "discharge used twice",
+	macaroons: []macaroonSpec{
+		primarySpec(thirdParty("a"), thirdParty("a")),
+		discharge("a"),
+	},
+}, {
+	about: "discharge used twice with DischargeOnce",
+	macaroons: []macaroonSpec{
+		primarySpec(thirdParty("a"), thirdParty("a")),
+		discharge("a"),
+	},
+	opts: macaroon.VerifyOptions{
+		DischargeOnce: true,
+	},
+	expectErr: `discharge macaroon "a" used more than once`,
+	errType:   (*macaroon.DischargeReusedError)(nil),
+}, {
+	about: "discharge unused",
+	macaroons: []macaroonSpec{
+		primarySpec(thirdParty("a")),
+		discharge("a"),
+		discharge("b"),
+	},
+}, {
+	about: "discharge unused with DischargeOnce",
+	macaroons: []macaroonSpec{
+		primarySpec(thirdParty("a")),
+		discharge("a"),
+		discharge("b"),
+	},
+	opts: macaroon.VerifyOptions{
+		DischargeOnce: true,
+	},
+	expectErr: `discharge macaroon "b" was not used`,
+	errType:   (*macaroon.DischargeUnusedError)(nil),
+}, {
+	about: "each discharge used once with DischargeOnce",
+	macaroons: []macaroonSpec{
+		primarySpec(thirdParty("a"), thirdParty("b")),
+		discharge("a", thirdParty("c")),
+		discharge("b"),
+		discharge("c"),
+	},
+	opts: macaroon.VerifyOptions{
+		DischargeOnce: true,
+	},
+}}
+
+func (*verifySuite) TestVerifyOptions(c *gc.C) {
+	for i, test := range verifyOptionsTests {
+		c.Logf("test %d: %s", i, test.about)
+		rootKey, primary, discharges := makeMacaroons(test.macaroons)
+		err := primary.VerifyWithOptions(rootKey, alwaysOK, discharges, test.opts)
+		if test.expectErr == "" {
+			c.Assert(err, gc.IsNil)
+			continue
+		}
+		c.Assert(err, gc.ErrorMatches, test.expectErr)
+		c.Assert(err, gc.FitsTypeOf, test.errType)
+
+		t, err := primary.VerifyWithTrace(rootKey, alwaysOK, discharges, test.opts)
+		c.Assert(err, gc.ErrorMatches, test.expectErr)
+		c.Assert(t.Err, gc.Equals, err)
+	}
+}
+
+func (*verifySuite) TestVerifyDefaultsDetectCycle(c *gc.C) {
+	rootKey, primary, discharges := makeMacaroons([]macaroonSpec{
+		primarySpec(thirdParty("a")),
+		discharge("a", thirdParty("b")),
+		discharge("b", thirdParty("a")),
+	})
+	err := primary.Verify(rootKey, alwaysOK, discharges)
+	c.Assert(err, gc.FitsTypeOf, (*macaroon.DischargeCycleError)(nil))
+}
+
+func (*verifySuite) TestVerifyErrorTypes(c *gc.C) {
+	rootKey, primary, discharges := makeMacaroons([]macaroonSpec{
+		primarySpec(caveat{condition: "a"}, thirdParty("b")),
+		discharge("b", caveat{condition: "c"}),
+	})
+	check := func(failing string) func(string) error {
+		return func(cond string) error {
+			if cond == failing {
+				return fmt.Errorf("%s failed", cond)
+			}
+			return nil
+		}
+	}
+
+	err := primary.Verify(rootKey, check("a"), discharges)
+	c.Assert(err, gc.ErrorMatches, "a failed")
+	cavErr, ok := err.(*macaroon.CaveatError)
+	c.Assert(ok, gc.Equals, true)
+	c.Assert(cavErr.MacaroonId, gc.Equals, "root-id")
+	c.Assert(cavErr.InDischarge, gc.Equals, false)
+	c.Assert(cavErr.Index, gc.Equals, 0)
+	c.Assert(cavErr.Condition, gc.Equals, "a")
+
+	err = primary.Verify(rootKey, check("c"), discharges)
+	c.Assert(err, gc.ErrorMatches, "c failed")
+	cavErr, ok = err.(*macaroon.CaveatError)
+	c.Assert(ok, gc.Equals, true)
+	c.Assert(cavErr.MacaroonId, gc.Equals, "b")
+	c.Assert(cavErr.InDischarge, gc.Equals, true)
+	c.Assert(cavErr.Index, gc.Equals, 0)
+
+	err = primary.Verify(rootKey, alwaysOK, nil)
+	c.Assert(err, gc.DeepEquals, &macaroon.DischargeNotFoundError{
+		CaveatId: "b",
+		Location: "b-location",
+	})
+
+	err = primary.Verify([]byte("wrong-key"), alwaysOK, discharges)
+	c.Assert(err, gc.DeepEquals, &macaroon.SignatureMismatchError{
+		MacaroonId:  "root-id",
+		CaveatIndex: 1,
+	})
+
+	// An unbound discharge macaroon has the wrong signature.
+	_, _, unbound := makeMacaroons([]macaroonSpec{
+		primarySpec(),
+		discharge("b", caveat{condition: "c"}),
+	})
+	err = primary.Verify(rootKey, alwaysOK, unbound)
+	c.Assert(err, gc.DeepEquals, &macaroon.SignatureMismatchError{
+		MacaroonId:  "b",
+		InDischarge: true,
+		CaveatIndex: -1,
+	})
+}
+
+func (*verifySuite) TestSignaturesVerifiedBeforeCaveatsChecked(c *gc.C) {
+	rootKey, primary, discharges := makeMacaroons([]macaroonSpec{
+		primarySpec(caveat{condition: "a"}, thirdParty("b")),
+		discharge("b", caveat{condition: "c"}),
+	})
+	var checked []string
+	check := func(cond string) error {
+		checked = append(checked, cond)
+		return nil
+	}
+	err := primary.Verify([]byte("wrong-key"), check, discharges)
+	c.Assert(err, gc.FitsTypeOf, (*macaroon.SignatureMismatchError)(nil))
+	c.Assert(checked, gc.HasLen, 0)
+
+	// A forged discharge macaroon prevents any checks too.
+	forged := MustNew(testKey("other-key"), "b", "b-location")
+	forged.AddFirstPartyCaveat("c")
+	forged.Bind(primary.Signature())
+	err = primary.Verify(rootKey, check, []*macaroon.Macaroon{forged})
+	c.Assert(err, gc.FitsTypeOf, (*macaroon.SignatureMismatchError)(nil))
+	c.Assert(checked, gc.HasLen, 0)
+
+	err = primary.Verify(rootKey, check, discharges)
+	c.Assert(err, gc.IsNil)
+	c.Assert(checked, gc.DeepEquals, []string{"a", "c"})
+}
+
+func (*verifySuite) TestVerifyTriesAllValidDischarges(c *gc.C) {
+	// When there are several discharge macaroons with valid
+	// signatures for a caveat, each is tried in turn.
+	rootKey, primary, discharges := makeMacaroons([]macaroonSpec{
+		primarySpec(thirdParty("b")),
+		discharge("b", caveat{condition: "expired"}),
+		discharge("b", caveat{condition: "fresh"}),
+	})
+	check := func(cond string) error {
+		if cond == "expired" {
+			return fmt.Errorf("discharge expired")
+		}
+		return nil
+	}
+	err := primary.Verify(rootKey, check, discharges)
+	c.Assert(err, gc.IsNil)
+
+	t, err := primary.VerifyWithTrace(rootKey, check, discharges, macaroon.VerifyOptions{})
+	c.Assert(err, gc.IsNil)
+	c.Assert(t.Caveats[0].Discharges, gc.HasLen, 2)
+	c.Assert(t.Caveats[0].Discharges[0].Err, gc.ErrorMatches, "discharge expired")
+	c.Assert(t.Caveats[0].Discharges[1].Err, gc.IsNil)
+
+	// A discharge with an invalid signature is ignored
+	// if another is valid.
+	forged := MustNew(testKey("other-key"), "b", "b-location")
+	forged.Bind(primary.Signature())
+	err = primary.Verify(rootKey, check, []*macaroon.Macaroon{forged, discharges[1]})
+	c.Assert(err, gc.IsNil)
+}
+
+func (*verifySuite) TestDischargeOnceCountsOnlySatisfyingDischarges(c *gc.C) {
+	check := func(cond string) error {
+		if cond == "bad" {
+			return fmt.Errorf("bad caveat")
+		}
+		return nil
+	}
+	opts := macaroon.VerifyOptions{
+		DischargeOnce: true,
+	}
+	// The first discharge for "a" fails its caveats, so it
+	// is not counted as used and can satisfy the other caveat.
+	rootKey, primary, discharges := makeMacaroons([]macaroonSpec{
+		primarySpec(thirdParty("a"), thirdParty("a")),
+		discharge("a", caveat{condition: "bad"}),
+		discharge("a"),
+	})
+	err := primary.VerifyWithOptions(rootKey, check, discharges, opts)
+	c.Assert(err, gc.ErrorMatches, "bad caveat")
+	c.Assert(err, gc.FitsTypeOf, (*macaroon.CaveatError)(nil))
+
+	// The discharge for "c" is not counted as used by the
+	// failed discharge for "a", so it can satisfy the
+	// primary's caveat. The failed discharge remains unused.
+	rootKey, primary, discharges = makeMacaroons([]macaroonSpec{
+		primarySpec(thirdParty("a"), thirdParty("c")),
+		discharge("a", thirdParty("c"), caveat{condition: "bad"}),
+		discharge("a"),
+		discharge("c"),
+	})
+	err = primary.VerifyWithOptions(rootKey, check, discharges, opts)
+	c.Assert(err, gc.ErrorMatches, `discharge macaroon "a" was not used`)
+	c.Assert(err, gc.FitsTypeOf, (*macaroon.DischargeUnusedError)(nil))
+	err = primary.VerifyWithOptions(rootKey, check, discharges[1:], opts)
+	c.Assert(err, gc.IsNil)
+}
+
+func (*verifySuite) TestVerifyAllocations(c *gc.C) {
+	if raceEnabled {
+		c.Skip("verification allocates when the race detector is enabled")
+	}
+	rootKey, primary, _ := makeMacaroons([]macaroonSpec{primarySpec()})
+	allocs := testing.AllocsPerRun(100, func() {
+		if err := primary.Verify(rootKey, alwaysOK, nil); err != nil {
+			panic(err)
+		}
+	})
+	c.Assert(allocs, gc.Equals, 0.0)
+
+	// The only allocation for a first party caveat
+	// is the conversion of its condition to a string.
+	rootKey, primary, _ = makeMacaroons([]macaroonSpec{
+		primarySpec(caveat{condition: "a"}, caveat{condition: "b"}),
+	})
+	allocs = testing.AllocsPerRun(100, func() {
+		if err := primary.Verify(rootKey, alwaysOK, nil); err != nil {
+			panic(err)
+		}
+	})
+	c.Assert(allocs <= 2, gc.Equals, true, gc.Commentf("allocs %v", allocs))
+
+	// Third party caveats do not allocate, whether their
+	// discharges are nested or there are several candidates
+	// for a caveat.
+	specs := chainSpecs(5)
+	specs[0].caveats = append(specs[0].caveats, thirdParty("x"), thirdParty("y"))
+	specs = append(specs, discharge("x"), discharge("y"), discharge("x"))
+	rootKey, primary, discharges := makeMacaroons(specs)
+	allocs = testing.AllocsPerRun(100, func() {
+		if err := primary.Verify(rootKey, alwaysOK, discharges); err != nil {
+			panic(err)
+		}
+	})
+	c.Assert(allocs, gc.Equals, 0.0)
+}
+
+func (*verifySuite) TestVerifyStateNotShared(c *gc.C) {
+	// Verification state is reused between verifications,
+	// so check that a failed verification does not affect
+	// a subsequent one.
+	rootKey, primary, discharges := makeMacaroons([]macaroonSpec{
+		primarySpec(thirdParty("b"), thirdParty("b")),
+		discharge("b"),
+	})
+	for i := 0; i < 3; i++ {
+		err := primary.VerifyWithOptions(rootKey, alwaysOK, discharges, macaroon.VerifyOptions{
+			DischargeOnce: true,
+		})
+		c.Assert(err, gc.FitsTypeOf, (*macaroon.DischargeReusedError)(nil))
+		err = primary.Verify(rootKey, alwaysOK, discharges)
+		c.Assert(err, gc.IsNil)
+		err = primary.Verify(rootKey, alwaysOK, nil)
+		c.Assert(err, gc.FitsTypeOf, (*macaroon.DischargeNotFoundError)(nil))
+	}
+}
+
+func (*verifySuite) TestVerifyConcurrently(c *gc.C) {
+	rootKey, primary, discharges := makeMacaroons(chainSpecs(5))
+	var wg sync.WaitGroup
+	errs := make([]error, 20)
+	for i := range errs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 10; j++ {
+				if err := primary.Verify(rootKey, alwaysOK, discharges); err != nil {
+					errs[i] = err
+					return
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		c.Assert(err, gc.IsNil)
+	}
+}
@@ -0,0 +1,113 @@
+package macaroon
+
+import (
+	"crypto/sha256"
+)
+
+// View provides read-only access to a macaroon. A View
+// holds its own copy of the macaroon, so it cannot be changed
+// through the View or through the macaroon it was made from,
+// which makes it safe to share between goroutines and to keep
+// in caches. Use Attenuate or Macaroon to obtain a macaroon
+// that can be changed.
+//
+// The zero View is not valid.
+type View struct {
+	m *Macaroon
+}
+
+// View returns a read-only view of a copy of m.
+// Later changes to m do not affect the view.
+func (m *Macaroon) View() View {
+	return View{m.Clone()}
+}
+
+// Macaroon returns a copy of the viewed macaroon
+// that can be changed freely.
+func (v View) Macaroon() *Macaroon {
+	return v.m.Clone()
+}
+
+// Attenuate is like Macaroon.Attenuate.
+func (v View) Attenuate(conditions ...string) (*Macaroon, error) {
+	return v.m.Attenuate(conditions...)
+}
+
+// Location returns the macaroon's location hint.
+func (v View) Location() string {
+	return v.m.Location()
+}
+
+// Id returns the id of the macaroon.
+func (v View) Id() string {
+	return v.m.Id()
+}
+
+// IdBytes returns the id of the macaroon as a byte slice.
+func (v View) IdBytes() []byte {
+	return v.m.IdBytes()
+}
+
+// Signature returns the macaroon's signature.
+func (v View) Signature() []byte {
+	return v.m.Signature()
+}
+
+// Caveats returns the macaroon's caveats.
+func (v View) Caveats() []Caveat {
+	return v.m.Caveats()
+}
+
+// Algorithm returns the algorithm used to compute
+// the macaroon's signatures.
+func (v View) Algorithm() Algorithm {
+	return v.m.Algorithm()
+}
+
+// Version returns the binary format version
+// that will be used to marshal the macaroon.
+func (v View) Version() Version {
+	return v.m.Version()
+}
+
+// Equal reports whether the viewed macaroons are equal;
+// see Macaroon.Equal.
+func (v View) Equal(v1 View) bool {
+	return v.m.Equal(v1.m)
+}
+
+// Fingerprint returns the fingerprint of the macaroon;
+// see Macaroon.Fingerprint.
+func (v View) Fingerprint() [sha256.Size]byte {
+	return v.m.Fingerprint()
+}
+
+// Inspect returns a human-readable description of the macaroon.
+func (v View) Inspect() string {
+	return v.m.Inspect()
+}
+
+// Verify is like Macaroon.Verify.
+func (v View) Verify(rootKey []byte, check func(caveat string) error, discharges []*Macaroon) error {
+	return v.m.Verify(rootKey, check, discharges)
+}
+
+// VerifyWithOptions is like Macaroon.VerifyWithOptions.
+func (v View) VerifyWithOptions(rootKey []byte, check func(caveat string) error, discharges []*Macaroon, opts VerifyOptions) error {
+	return v.m.VerifyWithOptions(rootKey, check, discharges, opts)
+}
+
+// MarshalBinary implements encoding.BinaryMarshaler.
+func (v View) MarshalBinary() ([]byte, error) {
+	return v.m.MarshalBinary()
+}
+
+// MarshalJSON implements json.Marshaler.
+func (v View) MarshalJSON() ([]byte, error) {
+	return v.m.MarshalJSON()
+}
+
+// MarshalText implements encoding.TextMarshaler.
+func (v View) MarshalText() ([]byte, error) {
+	return v.m.MarshalText()
+}
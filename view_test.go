@@ -0,0 +1,114 @@
+package macaroon_test
+
+import (
+	"encoding/json"
+	"fmt"
+
+	gc "gopkg.in/check.v1"
+
+	"github.com/rogpeppe/macaroon"
+)
+
+type viewSuite struct{}
+
+var _ = gc.Suite(&viewSuite{})
+
+func (*viewSuite) TestAttenuate(c *gc.C) {
+	rootKey := testKey("secret")
+	m := MustNew(rootKey, "some id", "a location")
+	err := m.AddFirstPartyCaveat("a")
+	c.Assert(err, gc.IsNil)
+	sig := m.Signature()
+
+	m1, err := m.Attenuate("b", "c")
+	c.Assert(err, gc.IsNil)
+	m2, err := m.Attenuate("d")
+	c.Assert(err, gc.IsNil)
+
+	// The original macaroon is unchanged.
+	c.Assert(m.Caveats(), gc.DeepEquals, []macaroon.Caveat{{Id: "a"}})
+	c.Assert(m.Signature(), gc.DeepEquals, sig)
+
+	c.Assert(m1.Caveats(), gc.DeepEquals, []macaroon.Caveat{{Id: "a"}, {Id: "b"}, {Id: "c"}})
+	c.Assert(m2.Caveats(), gc.DeepEquals, []macaroon.Caveat{{Id: "a"}, {Id: "d"}})
+
+	// Attenuating is the same as adding caveats to a clone.
+	m3 := m.Clone()
+	m3.AddFirstPartyCaveat("b")
+	m3.AddFirstPartyCaveat("c")
+	c.Assert(m1.Equal(m3), gc.Equals, true)
+
+	err = m1.Verify(rootKey, allowConditions("a", "b", "c"), nil)
+	c.Assert(err, gc.IsNil)
+	err = m2.Verify(rootKey, allowConditions("a", "d"), nil)
+	c.Assert(err, gc.IsNil)
+
+	// Adding caveats to the original does not affect
+	// the attenuated macaroons.
+	err = m.AddFirstPartyCaveat("e")
+	c.Assert(err, gc.IsNil)
+	c.Assert(m1.Caveats(), gc.HasLen, 3)
+	c.Assert(m2.Caveats(), gc.HasLen, 2)
+	err = m2.Verify(rootKey, allowConditions("a", "d"), nil)
+	c.Assert(err, gc.IsNil)
+}
+
+func (*viewSuite) TestAttenuateNoConditions(c *gc.C) {
+	m := MustNew(testKey("secret"), "some id", "a location")
+	m1, err := m.Attenuate()
+	c.Assert(err, gc.IsNil)
+	c.Assert(m1, gc.Not(gc.Equals), m)
+	c.Assert(m1.Equal(m), gc.Equals, true)
+}
+
+func (*viewSuite) TestView(c *gc.C) {
+	rootKey := testKey("secret")
+	m := MustNew(rootKey, "some id", "a location")
+	err := m.AddFirstPartyCaveat("a")
+	c.Assert(err, gc.IsNil)
+	v := m.View()
+
+	c.Assert(v.Id(), gc.Equals, "some id")
+	c.Assert(v.Location(), gc.Equals, "a location")
+	c.Assert(v.Signature(), gc.DeepEquals, m.Signature())
+	c.Assert(v.Caveats(), gc.DeepEquals, m.Caveats())
+	c.Assert(v.Fingerprint(), gc.Equals, m.Fingerprint())
+	c.Assert(v.Inspect(), gc.Equals, m.Inspect())
+	err = v.Verify(rootKey, allowConditions("a"), nil)
+	c.Assert(err, gc.IsNil)
+
+	// Changes to the original macaroon or to macaroons
+	// obtained from the view do not affect the view.
+	m.AddFirstPartyCaveat("b")
+	m1 := v.Macaroon()
+	m1.AddFirstPartyCaveat("c")
+	m2, err := v.Attenuate("d")
+	c.Assert(err, gc.IsNil)
+	c.Assert(v.Caveats(), gc.DeepEquals, []macaroon.Caveat{{Id: "a"}})
+	c.Assert(v.Equal(m.View()), gc.Equals, false)
+	c.Assert(v.Equal(v.Macaroon().View()), gc.Equals, true)
+	err = v.Verify(rootKey, allowConditions("a"), nil)
+	c.Assert(err, gc.IsNil)
+	err = m2.Verify(rootKey, allowConditions("a", "d"), nil)
+	c.Assert(err, gc.IsNil)
+
+	// A view marshals in the same way as its macaroon.
+	data, err := json.Marshal(v)
+	c.Assert(err, gc.IsNil)
+	expect, err := json.Marshal(v.Macaroon())
+	c.Assert(err, gc.IsNil)
+	c.Assert(string(data), gc.Equals, string(expect))
+}
+
+// allowConditions returns a caveat checker that
+// allows only the given conditions.
+func allowConditions(conds ...string) func(string) error {
+	return func(cond string) error {
+		for _, c := range conds {
+			if c == cond {
+				return nil
+			}
+		}
+		return fmt.Errorf("condition %q not allowed", cond)
+	}
+}